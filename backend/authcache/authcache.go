@@ -0,0 +1,214 @@
+package authcache
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+// What the CSMS last said about an idToken
+type Entry struct {
+	IdToken     AuthorizeRequest.IdTokenType
+	IdTokenInfo AuthorizeResponse.IdTokenInfoType
+	LastUsed    time.Time
+}
+
+// LastUsed is persisted at most this often, a lookup does not rewrite the bucket every time
+const lastUsedFlushInterval = time.Minute
+
+// C10: IdTokenInfos of the idTokens the CSMS authorized recently, used to authorize while offline.
+// Entries are persisted, the least recently used one is evicted when the storage limit is reached.
+type AuthCache struct {
+	entries map[string]*Entry
+	store   persistence.Store
+	// Set if a LastUsed changed since the entries were persisted
+	dirty      bool
+	flushed_at time.Time
+	mu         sync.Mutex
+}
+
+// idTokens of different types may have the same value
+func key(idToken AuthorizeRequest.IdTokenType) string {
+	return string(idToken.Type) + ":" + idToken.IdToken
+}
+
+// Creates the cache with the entries that were cached before the restart
+func CreateAuthCache(store persistence.Store) *AuthCache {
+	cache_new := &AuthCache{
+		entries: make(map[string]*Entry),
+		store:   store,
+	}
+	keys, err := store.Keys(persistence.AuthCacheBucket)
+	if err != nil {
+		log.Error("unable to read the persisted authorization cache: ", err)
+		return cache_new
+	}
+	for _, k := range keys {
+		var entry Entry
+		if _, err := store.Get(persistence.AuthCacheBucket, k, &entry); err != nil {
+			log.Error("skipping unreadable authorization cache entry ", k, ": ", err)
+			continue
+		}
+		cache_new.entries[k] = &entry
+	}
+	return cache_new
+}
+
+// Stores the IdTokenInfo the CSMS sent for the idToken. maxStorage is the most bytes the cache may take.
+func (c *AuthCache) Update(idToken AuthorizeRequest.IdTokenType, info AuthorizeResponse.IdTokenInfoType, maxStorage int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := key(idToken)
+	entry := &Entry{IdToken: idToken, IdTokenInfo: info, LastUsed: time.Now()}
+	if size(entry) > maxStorage {
+		log.Warning("authorization cache: entry of ", idToken.IdToken, " does not fit into ", maxStorage, " bytes")
+		c.remove(k)
+		return
+	}
+	c.entries[k] = entry
+	for c.storage() > maxStorage {
+		c.remove(c.leastRecentlyUsed(k))
+	}
+	if err := c.store.Put(persistence.AuthCacheBucket, k, entry); err != nil {
+		log.Error("unable to persist authorization cache entry ", k, ": ", err)
+	}
+}
+
+// IdTokenInfo of the idToken, false if it is not cached. An entry that was not used for lifetime
+// or whose cacheExpiryDateTime has passed is reported as Expired, the stored IdTokenInfo is kept.
+// lifetime 0 means entries do not expire unused.
+func (c *AuthCache) Lookup(idToken AuthorizeRequest.IdTokenType, lifetime time.Duration) (AuthorizeResponse.IdTokenInfoType, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key(idToken)]
+	if !ok {
+		return AuthorizeResponse.IdTokenInfoType{}, false
+	}
+	now := time.Now()
+	info := entry.IdTokenInfo
+	if expired(entry, lifetime, now) {
+		// Using an expired entry does not make it valid again
+		info.Status = AuthorizeResponse.AuthorizationStatusEnumType_1_Expired
+		return info, true
+	}
+	entry.LastUsed = now
+	c.dirty = true
+	if now.Sub(c.flushed_at) >= lastUsedFlushInterval {
+		c.flush()
+	}
+	return info, true
+}
+
+// Persists the LastUsed times that changed since the last flush, e.g. before a shutdown
+func (c *AuthCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+}
+
+// Must be called with c.mu held. The bucket is written once for all entries.
+func (c *AuthCache) flush() {
+	if !c.dirty {
+		return
+	}
+	values := make(map[string]interface{}, len(c.entries))
+	for k, entry := range c.entries {
+		values[k] = entry
+	}
+	if err := c.store.ReplaceBucket(persistence.AuthCacheBucket, values); err != nil {
+		log.Error("unable to persist the authorization cache: ", err)
+		return
+	}
+	c.dirty = false
+	c.flushed_at = time.Now()
+}
+
+func expired(entry *Entry, lifetime time.Duration, now time.Time) bool {
+	if lifetime > 0 && now.Sub(entry.LastUsed) > lifetime {
+		return true
+	}
+	if entry.IdTokenInfo.CacheExpiryDateTime == nil {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339, *entry.IdTokenInfo.CacheExpiryDateTime)
+	return err == nil && now.After(expiry)
+}
+
+func (c *AuthCache) Remove(idToken AuthorizeRequest.IdTokenType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key(idToken))
+}
+
+// Removes every entry
+func (c *AuthCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		c.remove(k)
+	}
+}
+
+// Must be called with c.mu held
+func (c *AuthCache) remove(k string) {
+	if _, ok := c.entries[k]; !ok {
+		return
+	}
+	delete(c.entries, k)
+	if err := c.store.Delete(persistence.AuthCacheBucket, k); err != nil {
+		log.Error("unable to delete authorization cache entry ", k, ": ", err)
+	}
+}
+
+// Must be called with c.mu held. The entry just added is never evicted.
+func (c *AuthCache) leastRecentlyUsed(except string) string {
+	oldest := ""
+	for k, entry := range c.entries {
+		if k == except {
+			continue
+		}
+		if oldest == "" || entry.LastUsed.Before(c.entries[oldest].LastUsed) {
+			oldest = k
+		}
+	}
+	return oldest
+}
+
+// Cached entries ordered by idToken
+func (c *AuthCache) Entries() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return key(result[i].IdToken) < key(result[j].IdToken) })
+	return result
+}
+
+// Bytes the cache takes, the size of the JSON encoded entries
+func (c *AuthCache) Storage() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.storage()
+}
+
+// Must be called with c.mu held
+func (c *AuthCache) storage() int {
+	total := 0
+	for _, entry := range c.entries {
+		total += size(entry)
+	}
+	return total
+}
+
+func size(entry *Entry) int {
+	bytes, _ := json.Marshal(entry)
+	return len(bytes)
+}
@@ -0,0 +1,138 @@
+package authcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeResponse"
+)
+
+const (
+	accepted = AuthorizeResponse.AuthorizationStatusEnumType_1_Accepted
+	expired_ = AuthorizeResponse.AuthorizationStatusEnumType_1_Expired
+)
+
+// Large enough for every entry of the tests
+const unlimited = 1 << 20
+
+// ocpp-messages-go does not unmarshal an idToken without additionalInfo
+func testIdToken(value string) AuthorizeRequest.IdTokenType {
+	return AuthorizeRequest.IdTokenType{
+		IdToken:        value,
+		Type:           AuthorizeRequest.IdTokenEnumType_1_ISO14443,
+		AdditionalInfo: []AuthorizeRequest.AdditionalInfoType{{AdditionalIdToken: value, Type: "test"}},
+	}
+}
+
+func acceptedInfo() AuthorizeResponse.IdTokenInfoType {
+	return AuthorizeResponse.IdTokenInfoType{Status: accepted}
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		// idTokens looked up after A and B were cached, before C is added
+		lookups     []string
+		wantEvicted string
+	}{
+		{"the least recently cached entry is evicted", nil, "A"},
+		{"a lookup makes an entry recently used", []string{"A"}, "B"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := CreateAuthCache(persistence.NewMemoryStore())
+			cache.Update(testIdToken("A"), acceptedInfo(), unlimited)
+			cache.Update(testIdToken("B"), acceptedInfo(), unlimited)
+			cache.entries[key(testIdToken("A"))].LastUsed = time.Now().Add(-time.Minute * 2)
+			cache.entries[key(testIdToken("B"))].LastUsed = time.Now().Add(-time.Minute)
+			for _, id_token := range test.lookups {
+				cache.Lookup(testIdToken(id_token), 0)
+			}
+
+			// Room for two entries only
+			max_storage := cache.Storage() + 10
+			cache.Update(testIdToken("C"), acceptedInfo(), max_storage)
+
+			if cache.Storage() > max_storage {
+				t.Errorf("Storage() = %d, more than %d", cache.Storage(), max_storage)
+			}
+			for _, id_token := range []string{"A", "B", "C"} {
+				_, found := cache.Lookup(testIdToken(id_token), 0)
+				if want := id_token != test.wantEvicted; found != want {
+					t.Errorf("Lookup(%s) found = %v, want %v", id_token, found, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEntryLargerThanStorage(t *testing.T) {
+	cache := CreateAuthCache(persistence.NewMemoryStore())
+	cache.Update(testIdToken("A"), acceptedInfo(), unlimited)
+	cache.Update(testIdToken("A"), acceptedInfo(), 10)
+	if _, found := cache.Lookup(testIdToken("A"), 0); found {
+		t.Error("an entry that does not fit is still cached")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		name                string
+		lastUsed            time.Duration // before now
+		lifetime            time.Duration
+		cacheExpiryDateTime *string
+		want                AuthorizeResponse.AuthorizationStatusEnumType_1
+	}{
+		{"used within the lifetime", time.Minute, time.Hour, nil, accepted},
+		{"not used within the lifetime", time.Hour * 2, time.Hour, nil, expired_},
+		{"lifetime 0 never expires unused", time.Hour * 24 * 365, 0, nil, accepted},
+		{"cacheExpiryDateTime has passed", 0, 0, &past, expired_},
+		{"cacheExpiryDateTime is ahead", 0, 0, &future, accepted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := persistence.NewMemoryStore()
+			cache := CreateAuthCache(store)
+			info := acceptedInfo()
+			info.CacheExpiryDateTime = test.cacheExpiryDateTime
+			cache.Update(testIdToken("A"), info, unlimited)
+			cache.entries[key(testIdToken("A"))].LastUsed = time.Now().Add(-test.lastUsed)
+
+			for i := 0; i < 2; i++ {
+				got, found := cache.Lookup(testIdToken("A"), test.lifetime)
+				if !found || got.Status != test.want {
+					t.Errorf("lookup %d: Lookup() = %v, %v, want %v", i+1, got.Status, found, test.want)
+				}
+			}
+			// The status is derived on every lookup, the cached IdTokenInfo stays as the CSMS sent it
+			if status := cache.entries[key(testIdToken("A"))].IdTokenInfo.Status; status != accepted {
+				t.Errorf("cached status = %v, want %v", status, accepted)
+			}
+		})
+	}
+}
+
+func TestLastUsedIsPersisted(t *testing.T) {
+	store := persistence.NewMemoryStore()
+	cache := CreateAuthCache(store)
+	// ocpp-messages-go does not unmarshal an idTokenInfo without evseId either
+	info := acceptedInfo()
+	info.EvseId = []int{1}
+	cache.Update(testIdToken("A"), info, unlimited)
+	cache.Lookup(testIdToken("A"), 0)
+	last_used := cache.entries[key(testIdToken("A"))].LastUsed
+	cache.Flush()
+
+	restored := CreateAuthCache(store)
+	entry, ok := restored.entries[key(testIdToken("A"))]
+	if !ok {
+		t.Fatal("entry not restored")
+	}
+	if !entry.LastUsed.Equal(last_used) {
+		t.Errorf("restored LastUsed = %v, want %v", entry.LastUsed, last_used)
+	}
+}
@@ -0,0 +1,102 @@
+package chargingstation
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/displayserver"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/ClearCacheRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/ClearCacheResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+func (cs *ChargingStation) authCacheEnabled() bool {
+	return cs.DeviceModel.GetBool("AuthCacheCtrlr", "Enabled")
+}
+
+// C10: keeps the IdTokenInfo of an AuthorizeResponse or TransactionEventResponse. The idToken and the info
+// may be of any message package, they are converted through their JSON form.
+func (cs *ChargingStation) cacheIdTokenInfo(idToken interface{}, idTokenInfo interface{}) {
+	if !cs.authCacheEnabled() {
+		return
+	}
+	var id_token AuthorizeRequest.IdTokenType
+	var info AuthorizeResponse.IdTokenInfoType
+	if err := convert(idToken, &id_token); err != nil {
+		log.Error("authorization cache: invalid idToken: ", err)
+		return
+	}
+	if err := convert(idTokenInfo, &info); err != nil {
+		log.Error("authorization cache: invalid idTokenInfo: ", err)
+		return
+	}
+	// C14: idTokens of the local authorization list are not cached
+	if _, found := cs.localListIdTokenInfo(id_token); found {
+		return
+	}
+	max_storage, _ := cs.DeviceModel.GetMaxLimit(devicemodel.Component{Name: "AuthCacheCtrlr"}, devicemodel.Variable{Name: "Storage"})
+	cs.AuthCache.Update(id_token, info, int(max_storage))
+	cs.updateAuthCacheStorage()
+}
+
+// Cached IdTokenInfo of the idToken, false if the cache is disabled or the idToken is not cached
+func (cs *ChargingStation) cachedIdTokenInfo(idToken AuthorizeRequest.IdTokenType) (AuthorizeResponse.IdTokenInfoType, bool) {
+	if !cs.authCacheEnabled() {
+		return AuthorizeResponse.IdTokenInfoType{}, false
+	}
+	return cs.AuthCache.Lookup(idToken, cs.DeviceModel.GetSeconds("AuthCacheCtrlr", "LifeTime"))
+}
+
+// C11: removes every entry of the authorization cache, e.g. after a card was revoked
+func (cs *ChargingStation) handleClearCache(req *ClearCacheRequest.ClearCacheRequestJson) (interface{}, error) {
+	if !cs.authCacheEnabled() {
+		return ClearCacheResponse.ClearCacheResponseJson{
+			Status:     ClearCacheResponse.ClearCacheStatusEnumType_1_Rejected,
+			StatusInfo: &ClearCacheResponse.StatusInfoType{ReasonCode: "NotEnabled"},
+		}, nil
+	}
+	cs.AuthCache.Clear()
+	cs.updateAuthCacheStorage()
+	log.Info("Authorization cache cleared")
+	return ClearCacheResponse.ClearCacheResponseJson{
+		Status: ClearCacheResponse.ClearCacheStatusEnumType_1_Accepted,
+	}, nil
+}
+
+// Contents of the authorization cache for the diagnostics of the display server
+func (cs *ChargingStation) authCacheForUI() displayserver.AuthCacheDataForUI {
+	data := displayserver.AuthCacheDataForUI{
+		Enabled: cs.authCacheEnabled(),
+		Storage: cs.AuthCache.Storage(),
+		Entries: make([]displayserver.AuthCacheEntryForUI, 0),
+	}
+	for _, entry := range cs.AuthCache.Entries() {
+		ui_entry := displayserver.AuthCacheEntryForUI{
+			IdToken:             entry.IdToken.IdToken,
+			Type:                string(entry.IdToken.Type),
+			Status:              string(entry.IdTokenInfo.Status),
+			CacheExpiryDateTime: entry.IdTokenInfo.CacheExpiryDateTime,
+			LastUsed:            entry.LastUsed.Format(time.RFC3339),
+		}
+		if entry.IdTokenInfo.GroupIdToken != nil {
+			ui_entry.GroupIdToken = &entry.IdTokenInfo.GroupIdToken.IdToken
+		}
+		data.Entries = append(data.Entries, ui_entry)
+	}
+	return data
+}
+
+// Keeps AuthCacheCtrlr.Storage up to date
+func (cs *ChargingStation) updateAuthCacheStorage() {
+	if err := cs.DeviceModel.UpdateValue(
+		devicemodel.Component{Name: "AuthCacheCtrlr"},
+		devicemodel.Variable{Name: "Storage"},
+		devicemodel.Actual,
+		strconv.Itoa(cs.AuthCache.Storage()),
+	); err != nil {
+		log.Error("device model: AuthCacheCtrlr.Storage: ", err)
+	}
+}
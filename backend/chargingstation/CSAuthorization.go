@@ -1,58 +1,112 @@
 package chargingstation
 
 import (
-	"fmt"
+	"context"
+	"time"
 
-	"github.com/google/uuid"
+	"github.com/gregszalay/ocpp-charging-station-go/displayserver"
 	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
 	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeRequest"
 	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeResponse"
-	"github.com/gregszalay/ocpp-messages-go/wrappers"
-	"github.com/sanity-io/litter"
 	log "github.com/sirupsen/logrus"
 )
 
-func (cs *ChargingStation) authorizeWithRFID(rfid string, onAuthSuccess func(), onAuthFailure func()) {
+// idToken presented at the display, e.g. an RFID card (ISO14443) or a KeyCode
+func uiIdToken(idToken displayserver.IdTokenForUI) (AuthorizeRequest.IdTokenType, error) {
+	var result AuthorizeRequest.IdTokenType
+	err := convert(idToken, &result)
+	return result, err
+}
+
+// Sends an AuthorizeRequest for any type of idToken and returns the response of the CSMS
+func (cs *ChargingStation) authorize(ctx context.Context, idToken AuthorizeRequest.IdTokenType) (*AuthorizeResponse.AuthorizeResponseJson, error) {
 	// Create AuthorizeRequest
 	authorizeRequest := AuthorizeRequest.AuthorizeRequestJson{
-		IdToken: AuthorizeRequest.IdTokenType{
-			IdToken: rfid,
-			Type:    AuthorizeRequest.IdTokenEnumType_1_ISO14443,
-		},
-	}
-
-	// Wrap AuthorizeRequest in CALL
-	call_wrapper := &wrappers.CALL{
-		MessageTypeId: wrappers.CALL_TYPE,
-		MessageId:     uuid.New().String(),
-		Action:        "Authorize",
-		Payload:       authorizeRequest,
-	}
-
-	// Send AuthorizeRequest and provide the callback implementation
-	cs.OcppClient.Send(ocppclient.AsyncOcppCall{
-		Message: *call_wrapper,
-		SuccessCallback: func(callresult wrappers.CALLRESULT) {
-			var resp AuthorizeResponse.AuthorizeResponseJson
-			payload_unmarshal_err := resp.UnmarshalJSON(callresult.GetPayloadAsJSON())
-			if payload_unmarshal_err != nil {
-				fmt.Printf("Failed to unmarshal CALLRESULT message payload. Error: %s", payload_unmarshal_err)
-			} else {
-				fmt.Println("Payload as an OBJECT:")
-				fmt.Println("*******************************")
-				litter.Dump(resp)
-			}
-			if resp.IdTokenInfo.Status != AuthorizeResponse.AuthorizationStatusEnumType_1_Accepted {
-				log.Error("Idtoken not accepted, unable to start charging")
-				onAuthFailure()
-				return
-			} else {
-				// If the idToken is accepted, start the charging in the EVSE
-				onAuthSuccess()
-			}
-		},
-		ErrorCallback: func(wrappers.CALLERROR) {
-			log.Error("Failed to send authorize req")
-		},
-	})
+		IdToken: idToken,
+	}
+
+	// Send AuthorizeRequest and wait for the response
+	response, err := cs.OcppClient.Call(ctx, "Authorize", authorizeRequest)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(*AuthorizeResponse.AuthorizeResponseJson)
+	log.Debug("AuthorizeResponse: ", resp.IdTokenInfo.Status)
+	return resp, nil
+}
+
+// Authorizes the idToken, returns false if the idToken was not accepted
+func (cs *ChargingStation) isIdTokenAuthorized(ctx context.Context, idToken AuthorizeRequest.IdTokenType) bool {
+	_, ok := cs.authorizeIdToken(ctx, idToken)
+	return ok
+}
+
+// Authorizes the idToken with the CSMS and returns what the CSMS knows about it, e.g. its group.
+// If the CSMS cannot be reached the idToken is authorized offline, if the CSMS answers with an error it is not authorized.
+func (cs *ChargingStation) authorizeIdToken(ctx context.Context, idToken AuthorizeRequest.IdTokenType) (*AuthorizeResponse.IdTokenInfoType, bool) {
+	// There is nothing to authorize if the Charging Station was started without identification, e.g. by a start button
+	if idToken.Type == AuthorizeRequest.IdTokenEnumType_1_NoAuthorization {
+		return &AuthorizeResponse.IdTokenInfoType{Status: AuthorizeResponse.AuthorizationStatusEnumType_1_Accepted}, true
+	}
+	// C13: with LocalPreAuthorize an idToken that is known to be valid is not sent to the CSMS
+	if cs.DeviceModel.GetBool("AuthCtrlr", "LocalPreAuthorize") {
+		if info, found := cs.localIdTokenInfo(idToken); found && info.Status == AuthorizeResponse.AuthorizationStatusEnumType_1_Accepted {
+			log.Info("Idtoken authorized locally")
+			return &info, true
+		}
+	}
+	if !cs.OcppClient.IsConnected() {
+		return cs.authorizeOffline(idToken)
+	}
+	call_ctx, cancel := context.WithTimeout(ctx, cs.messageTimeout())
+	defer cancel()
+	resp, err := cs.authorize(call_ctx, idToken)
+	if err != nil && ocppclient.IsUnreachable(err) {
+		log.Error("Failed to send authorize req: ", err)
+		return cs.authorizeOffline(idToken)
+	}
+	if err != nil {
+		// The CSMS answered, but not with an idTokenInfo
+		log.Error("Authorize req failed: ", err)
+		return &AuthorizeResponse.IdTokenInfoType{Status: AuthorizeResponse.AuthorizationStatusEnumType_1_Unknown}, false
+	}
+	cs.cacheIdTokenInfo(idToken, resp.IdTokenInfo)
+	if resp.IdTokenInfo.Status != AuthorizeResponse.AuthorizationStatusEnumType_1_Accepted {
+		log.Error("Idtoken not accepted: ", resp.IdTokenInfo.Status)
+		return &resp.IdTokenInfo, false
+	}
+	return &resp.IdTokenInfo, true
+}
+
+func (cs *ChargingStation) messageTimeout() time.Duration {
+	return time.Duration(cs.DeviceModel.GetInstanceInt("OCPPCommCtrlr", "MessageTimeout", "Default")) * time.Second
+}
+
+// C12/C15: while offline, idTokens are authorized from the local list or the cache if LocalAuthorizeOffline is set,
+// unknown idTokens only if OfflineTxForUnknownIdEnabled is set
+func (cs *ChargingStation) authorizeOffline(idToken AuthorizeRequest.IdTokenType) (*AuthorizeResponse.IdTokenInfoType, bool) {
+	if info, found := cs.localIdTokenInfo(idToken); found {
+		if cs.DeviceModel.GetBool("AuthCtrlr", "LocalAuthorizeOffline") {
+			accepted := info.Status == AuthorizeResponse.AuthorizationStatusEnumType_1_Accepted
+			log.Info("Idtoken authorized offline: ", info.Status)
+			return &info, accepted
+		}
+		// A known idToken is not unknown, even if its status may not be used to authorize it offline
+		log.Error("Idtoken cannot be authorized offline")
+		return &info, false
+	}
+	if cs.DeviceModel.GetBool("AuthCtrlr", "OfflineTxForUnknownIdEnabled") {
+		log.Info("Unknown idtoken authorized offline")
+		return &AuthorizeResponse.IdTokenInfoType{Status: AuthorizeResponse.AuthorizationStatusEnumType_1_Unknown}, true
+	}
+	log.Error("Idtoken cannot be authorized offline")
+	return &AuthorizeResponse.IdTokenInfoType{Status: AuthorizeResponse.AuthorizationStatusEnumType_1_Unknown}, false
+}
+
+// C14: the local authorization list takes precedence over the authorization cache
+func (cs *ChargingStation) localIdTokenInfo(idToken AuthorizeRequest.IdTokenType) (AuthorizeResponse.IdTokenInfoType, bool) {
+	if info, found := cs.localListIdTokenInfo(idToken); found {
+		return info, true
+	}
+	return cs.cachedIdTokenInfo(idToken)
 }
@@ -0,0 +1,225 @@
+package chargingstation
+
+import (
+	"fmt"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/ChangeAvailabilityRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/ChangeAvailabilityResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+// Every EVSE has a single connector
+const connectorId = 1
+
+// Part of the Charging Station whose availability can be changed: the whole station (0, 0), an EVSE (id, 0) or a connector
+type availabilityTarget struct {
+	EvseId      int
+	ConnectorId int
+}
+
+func (t availabilityTarget) key() string {
+	return fmt.Sprintf("%d/%d", t.EvseId, t.ConnectorId)
+}
+
+func (t availabilityTarget) components() []devicemodel.Component {
+	switch {
+	case t.EvseId == 0:
+		return []devicemodel.Component{{Name: "ChargingStation"}}
+	case t.ConnectorId == 0:
+		return []devicemodel.Component{{Name: "EVSE", EvseId: t.EvseId}}
+	default:
+		return []devicemodel.Component{{Name: "Connector", EvseId: t.EvseId, ConnectorId: t.ConnectorId}}
+	}
+}
+
+// Restores the operational status set by the CSMS before the restart
+func (cs *ChargingStation) restoreAvailability() {
+	keys, err := cs.Store.Keys(persistence.AvailabilityBucket)
+	if err != nil {
+		log.Error("unable to read the persisted availability: ", err)
+		return
+	}
+	for _, key := range keys {
+		var target availabilityTarget
+		if _, err := cs.Store.Get(persistence.AvailabilityBucket, key, &target); err != nil {
+			log.Error("skipping unreadable persisted availability ", key, ": ", err)
+			continue
+		}
+		cs.inoperative[target] = true
+		cs.updateAvailableVariable(target, false)
+	}
+}
+
+// A connector is operative if neither the station, nor its EVSE, nor the connector itself is inoperative.
+// G03.FR.05: while a change to Inoperative is scheduled, an EVSE without a transaction is not operative either.
+func (cs *ChargingStation) isOperative(evseId int) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.EVSEIdsToTxsMap[evseId] == nil && cs.inoperativeScheduled(evseId) {
+		return false
+	}
+	return !cs.inoperative[availabilityTarget{}] &&
+		!cs.inoperative[availabilityTarget{EvseId: evseId}] &&
+		!cs.inoperative[availabilityTarget{EvseId: evseId, ConnectorId: connectorId}]
+}
+
+// Must be called with cs.mu held
+func (cs *ChargingStation) inoperativeScheduled(evseId int) bool {
+	for target, operative := range cs.scheduled_availability {
+		if !operative && (target.EvseId == 0 || target.EvseId == evseId) {
+			return true
+		}
+	}
+	return false
+}
+
+// The EVSEs of the target without a transaction report their status, e.g. Unavailable once a change is scheduled
+func (cs *ChargingStation) notifyIdleEvses(target availabilityTarget) {
+	for _, evseId := range target.evseIds(cs) {
+		if cs.transactionOn(evseId) == nil {
+			cs.SendStatusNotification(cs.Evses[evseId])
+		}
+	}
+}
+
+// G03/G04: changes the operational status of the station, an EVSE or a connector.
+// Becoming inoperative is scheduled until the affected transactions have ended.
+func (cs *ChargingStation) handleChangeAvailability(req *ChangeAvailabilityRequest.ChangeAvailabilityRequestJson) (interface{}, error) {
+	target := availabilityTarget{}
+	if req.Evse != nil && req.Evse.Id != 0 {
+		if _, ok := cs.Evses[req.Evse.Id]; !ok {
+			return rejectAvailability("UnknownEvse"), nil
+		}
+		target.EvseId = req.Evse.Id
+		if req.Evse.ConnectorId != nil {
+			if *req.Evse.ConnectorId != connectorId {
+				return rejectAvailability("UnknownConnector"), nil
+			}
+			target.ConnectorId = connectorId
+		}
+	}
+	operative := req.OperationalStatus == ChangeAvailabilityRequest.OperationalStatusEnumType_1_Operative
+
+	if !operative {
+		for _, evseId := range target.evseIds(cs) {
+			if cs.transactionOn(evseId) != nil {
+				log.Info("Change of ", target.components()[0], " to Inoperative scheduled, waiting for the transactions to end")
+				cs.mu.Lock()
+				cs.scheduled_availability[target] = false
+				cs.mu.Unlock()
+				cs.notifyIdleEvses(target)
+				return ChangeAvailabilityResponse.ChangeAvailabilityResponseJson{
+					Status: ChangeAvailabilityResponse.ChangeAvailabilityStatusEnumType_1_Scheduled,
+				}, nil
+			}
+		}
+	}
+
+	cs.mu.Lock()
+	_, was_scheduled := cs.scheduled_availability[target]
+	delete(cs.scheduled_availability, target)
+	cs.mu.Unlock()
+	if !cs.setAvailability(target, operative) && was_scheduled {
+		// The idle EVSEs that were blocked by the cancelled change are available again
+		cs.notifyIdleEvses(target)
+	}
+	return ChangeAvailabilityResponse.ChangeAvailabilityResponseJson{
+		Status: ChangeAvailabilityResponse.ChangeAvailabilityStatusEnumType_1_Accepted,
+	}, nil
+}
+
+func rejectAvailability(reasonCode string) ChangeAvailabilityResponse.ChangeAvailabilityResponseJson {
+	return ChangeAvailabilityResponse.ChangeAvailabilityResponseJson{
+		Status:     ChangeAvailabilityResponse.ChangeAvailabilityStatusEnumType_1_Rejected,
+		StatusInfo: &ChangeAvailabilityResponse.StatusInfoType{ReasonCode: reasonCode},
+	}
+}
+
+// EVSEs affected by a change of the target, in ascending order
+func (t availabilityTarget) evseIds(cs *ChargingStation) []int {
+	if t.EvseId != 0 {
+		return []int{t.EvseId}
+	}
+	return cs.sortedEvseIds()
+}
+
+// Returns false if the target was in that status already
+func (cs *ChargingStation) setAvailability(target availabilityTarget, operative bool) bool {
+	cs.mu.Lock()
+	changed := cs.inoperative[target] == operative
+	if operative {
+		delete(cs.inoperative, target)
+	} else {
+		cs.inoperative[target] = true
+	}
+	cs.mu.Unlock()
+	if !changed {
+		return false
+	}
+
+	log.Info(target.components()[0], " is now ", operationalStatus(operative))
+	var err error
+	if operative {
+		err = cs.Store.Delete(persistence.AvailabilityBucket, target.key())
+	} else {
+		err = cs.Store.Put(persistence.AvailabilityBucket, target.key(), target)
+	}
+	if err != nil {
+		log.Error("unable to persist the availability: ", err)
+	}
+	cs.updateAvailableVariable(target, operative)
+
+	for _, evseId := range target.evseIds(cs) {
+		cs.SendStatusNotification(cs.Evses[evseId])
+	}
+	return true
+}
+
+func operationalStatus(operative bool) string {
+	if operative {
+		return "Operative"
+	}
+	return "Inoperative"
+}
+
+func (cs *ChargingStation) updateAvailableVariable(target availabilityTarget, operative bool) {
+	for _, component := range target.components() {
+		if err := cs.DeviceModel.UpdateValue(component, devicemodel.Variable{Name: "Available"}, devicemodel.Actual, fmt.Sprint(operative)); err != nil {
+			log.Error("device model: ", component, ".Available: ", err)
+		}
+	}
+}
+
+// Applies the changes to Inoperative that were waiting for the transaction on the EVSE to end
+func (cs *ChargingStation) runScheduledAvailabilityChanges(evseId int) {
+	cs.mu.Lock()
+	due := make([]availabilityTarget, 0)
+	for target := range cs.scheduled_availability {
+		if target.EvseId != 0 && target.EvseId != evseId {
+			continue
+		}
+		due = append(due, target)
+	}
+	cs.mu.Unlock()
+
+	for _, target := range due {
+		idle := true
+		for _, id := range target.evseIds(cs) {
+			if cs.transactionOn(id) != nil {
+				idle = false
+			}
+		}
+		if !idle {
+			continue
+		}
+		cs.mu.Lock()
+		operative, ok := cs.scheduled_availability[target]
+		delete(cs.scheduled_availability, target)
+		cs.mu.Unlock()
+		if ok {
+			cs.setAvailability(target, operative)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package chargingstation
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-messages-go/types/BootNotificationRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/BootNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/HeartbeatRequest"
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Used if the CSMS does not provide an interval in the BootNotificationResponse
+const defaultBootRetryInterval = time.Second * 30
+
+// CSMS requests that must not be executed while the registration is Pending (B02)
+var notAllowedWhilePending = map[string]bool{
+	"RequestStartTransaction": true,
+	"RequestStopTransaction":  true,
+	"UnlockConnector":         true,
+}
+
+// Sends a BootNotificationRequest and waits for the response of the CSMS
+func (cs *ChargingStation) SendBootNotification(ctx context.Context) (*BootNotificationResponse.BootNotificationResponseJson, error) {
+
+	bootNotificationRequest := BootNotificationRequest.BootNotificationRequestJson{
+		Reason: cs.boot_reason,
+		ChargingStation: BootNotificationRequest.ChargingStationType{
+			Model:      cs.DeviceModel.GetString("ChargingStation", "Model"),
+			VendorName: cs.DeviceModel.GetString("ChargingStation", "VendorName"),
+		},
+	}
+
+	response, err := cs.OcppClient.Call(ctx, "BootNotification", bootNotificationRequest)
+	if err != nil {
+		return nil, err
+	}
+	return response.(*BootNotificationResponse.BootNotificationResponseJson), nil
+}
+
+// B01-B03: repeats the BootNotification until the CSMS accepts the Charging Station
+func (cs *ChargingStation) boot() {
+	for {
+		resp, err := cs.SendBootNotification(context.Background())
+		if err != nil {
+			log.Error("BootNotification failed: ", err, ". Retrying in ", defaultBootRetryInterval)
+			if !cs.waitForBoot(defaultBootRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		interval := time.Duration(resp.Interval) * time.Second
+		cs.setRegistrationStatus(resp.Status)
+		log.Info("BootNotification ", resp.Status, ", interval: ", interval)
+
+		if resp.Status == BootNotificationResponse.RegistrationStatusEnumType_1_Accepted {
+			if interval > 0 {
+				cs.DeviceModel.UpdateValue(
+					devicemodel.Component{Name: "OCPPCommCtrlr"},
+					devicemodel.Variable{Name: "HeartbeatInterval"},
+					devicemodel.Actual,
+					strconv.Itoa(resp.Interval),
+				)
+				cs.SetHeartbeatInterval(interval)
+			}
+			cs.clearBootReason()
+			cs.onRegistrationAccepted()
+			return
+		}
+
+		// Pending or Rejected: the CSMS tells when to try again
+		if interval <= 0 {
+			interval = defaultBootRetryInterval
+		}
+		if !cs.waitForBoot(interval) {
+			return
+		}
+	}
+}
+
+// Waits until the next BootNotification is due or the CSMS triggers one, returns false if the Charging Station was stopped
+func (cs *ChargingStation) waitForBoot(duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-cs.boot_now:
+		return true
+	case <-cs.stopped:
+		return false
+	}
+}
+
+// Makes the boot loop send the next BootNotification right away
+func (cs *ChargingStation) triggerBoot() {
+	select {
+	case cs.boot_now <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for the given duration, returns false if the Charging Station was stopped in the meantime
+func (cs *ChargingStation) sleep(duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-cs.stopped:
+		return false
+	}
+}
+
+func (cs *ChargingStation) setRegistrationStatus(status BootNotificationResponse.RegistrationStatusEnumType_1) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.registration_status = status
+}
+
+func (cs *ChargingStation) isAccepted() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.registration_status == BootNotificationResponse.RegistrationStatusEnumType_1_Accepted
+}
+
+func (cs *ChargingStation) onRegistrationAccepted() {
+	// Messages queued before the registration, e.g. TransactionEvents of a previous run, can be delivered now
+	cs.OcppClient.SetQueuedCallsHeld(false)
+	for _, evse := range cs.Evses {
+		cs.SendStatusNotification(evse)
+	}
+}
+
+// Rejects the CSMS requests that are not allowed in the current registration state
+func (cs *ChargingStation) checkRegistration(action string) error {
+	cs.mu.Lock()
+	status := cs.registration_status
+	cs.mu.Unlock()
+	switch status {
+	case BootNotificationResponse.RegistrationStatusEnumType_1_Accepted:
+		return nil
+	case BootNotificationResponse.RegistrationStatusEnumType_1_Pending:
+		if !notAllowedWhilePending[action] {
+			return nil
+		}
+	}
+	return &ocppclient.CallError{
+		ErrorCode:        string(wrappers.SecurityError),
+		ErrorDescription: action + " is not allowed, registration status: " + string(status),
+	}
+}
+
+func (cs *ChargingStation) SetHeartbeatInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	cs.mu.Lock()
+	cs.heartbeat_interval = interval
+	cs.mu.Unlock()
+	select {
+	case cs.heartbeat_reset <- interval:
+	default:
+	}
+}
+
+func (cs *ChargingStation) SendHeartbeat(ctx context.Context) error {
+	heartbeatRequest := HeartbeatRequest.HeartbeatRequestJson{
+		CustomData: &HeartbeatRequest.CustomDataType{
+			VendorId: "example-station-vendor",
+		},
+	}
+	log.Info("Sending heartbeat")
+	if _, err := cs.OcppClient.Call(ctx, "Heartbeat", heartbeatRequest); err != nil {
+		log.Info("Heartbeat message not sent: ", err)
+		return err
+	}
+	log.Info("Heartbeat message sent")
+	return nil
+}
+
+// HEARTBEAT JOB, the ticker is re-armed whenever the interval changes
+func (cs *ChargingStation) runHeartbeat() {
+	cs.mu.Lock()
+	interval := cs.heartbeat_interval
+	cs.mu.Unlock()
+	ticker_status := time.NewTicker(interval)
+	defer ticker_status.Stop()
+	for {
+		select {
+		case <-ticker_status.C:
+			if !cs.isAccepted() {
+				continue
+			}
+			cs.SendHeartbeat(context.Background())
+		case interval := <-cs.heartbeat_reset:
+			ticker_status.Reset(interval)
+		case <-cs.stopped:
+			return
+		}
+	}
+}
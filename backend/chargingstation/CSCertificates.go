@@ -0,0 +1,71 @@
+package chargingstation
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/SignCertificateRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/SignCertificateResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the private keys kept as secrets of the store, until the CSMS sends the signed certificate
+var privateKeyKeys = map[SignCertificateRequest.CertificateSigningUseEnumType_1]string{
+	SignCertificateRequest.CertificateSigningUseEnumType_1_ChargingStationCertificate: "charging_station_private_key",
+	SignCertificateRequest.CertificateSigningUseEnumType_1_V2GCertificate:             "v2g_private_key",
+}
+
+// A02/A03: generates a new key pair and asks the CSMS to sign a certificate for it.
+// CertificateSigned is not handled yet, so the signed certificate is not installed and the key is not used.
+func (cs *ChargingStation) sendSignCertificate(ctx context.Context, use SignCertificateRequest.CertificateSigningUseEnumType_1) error {
+	csr, err := cs.createCSR(use)
+	if err != nil {
+		return err
+	}
+	response, err := cs.OcppClient.Call(ctx, "SignCertificate", SignCertificateRequest.SignCertificateRequestJson{
+		CertificateType: &use,
+		Csr:             csr,
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("SignCertificate ", use, ": ", response.(*SignCertificateResponse.SignCertificateResponseJson).Status)
+	return nil
+}
+
+// PEM encoded certificate signing request of a new P-256 key, the key is persisted for the signed certificate
+func (cs *ChargingStation) createCSR(use SignCertificateRequest.CertificateSigningUseEnumType_1) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   cs.DeviceModel.GetString("SecurityCtrlr", "Identity"),
+			Organization: []string{cs.DeviceModel.GetString("SecurityCtrlr", "OrganizationName")},
+		},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return "", err
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	key_pem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})
+	if err := cs.Store.PutSecret(privateKeyKeys[use]+".pem", key_pem); err != nil {
+		return "", err
+	}
+	// Earlier versions kept the key in the station bucket
+	if err := cs.Store.Delete(persistence.StationBucket, privateKeyKeys[use]); err != nil {
+		log.Error("unable to delete the private key from the station bucket: ", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
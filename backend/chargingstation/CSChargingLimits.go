@@ -0,0 +1,152 @@
+package chargingstation
+
+import (
+	"math"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/evsemanager"
+	"github.com/gregszalay/ocpp-charging-station-go/smartcharging"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventRequest"
+	log "github.com/sirupsen/logrus"
+)
+
+// How far ahead the composite schedules are calculated to find the next change of a limit
+const limitHorizon = time.Hour * 24
+
+// Makes runChargingLimits re-evaluate the limits, e.g. after a profile or a transaction changed
+func (cs *ChargingStation) chargingLimitsChanged() {
+	select {
+	case cs.limits_changed <- struct{}{}:
+	default:
+	}
+}
+
+// CHARGING LIMITS JOB, sends the limits of the composite schedules to the EVSEs whenever a period changes
+func (cs *ChargingStation) runChargingLimits() {
+	for {
+		timer := time.NewTimer(cs.applyChargingLimits())
+		select {
+		case <-timer.C:
+		case <-cs.limits_changed:
+			timer.Stop()
+		case <-cs.stopped:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Sends the current limit of every EVSE to its controller, returns the time until the next limit changes.
+// With load management the limits are also lowered to the share of the EVSEs in the site limit.
+// An EVSE that neither a profile nor the load management limits gets no limit.
+func (cs *ChargingStation) applyChargingLimits() time.Duration {
+	now := time.Now()
+	next_change := limitHorizon
+	limits := make(map[int]*smartcharging.Period)
+	limited := make(map[int]bool)
+	for _, evseId := range cs.sortedEvseIds() {
+		tx := cs.profileTransaction(evseId)
+		composite := cs.SmartCharging.CompositeSchedule(
+			evseId,
+			now,
+			limitHorizon,
+			smartcharging.Amperes,
+			tx,
+			cs.maxPower(evseId),
+		)
+		if len(composite.Periods) == 0 {
+			continue
+		}
+		limited[evseId] = cs.SmartCharging.IsLimited(evseId, now, tx)
+		if len(composite.Periods) > 1 {
+			next_start := composite.ScheduleStart.Add(time.Duration(composite.Periods[1].StartPeriod) * time.Second)
+			if until := time.Until(next_start); until < next_change {
+				next_change = until
+			}
+		}
+		limits[evseId] = &composite.Periods[0]
+	}
+	if cs.loadManagementEnabled() {
+		profile_limits := make(map[int]float64, len(limits))
+		for evseId, period := range limits {
+			profile_limits[evseId] = period.Limit
+		}
+		cs.balanceLoad(limits)
+		for evseId, period := range limits {
+			if period.Limit < profile_limits[evseId] {
+				limited[evseId] = true
+			}
+		}
+		if next_change > loadBalancingInterval {
+			next_change = loadBalancingInterval
+		}
+	}
+	for _, evseId := range cs.sortedEvseIds() {
+		period, ok := limits[evseId]
+		if ok && limited[evseId] {
+			cs.applyChargingLimit(cs.Evses[evseId], *period)
+		} else {
+			cs.clearChargingLimit(cs.Evses[evseId])
+		}
+	}
+	return next_change
+}
+
+// Clears the limit of the EVSE if one was sent, the end of a limit is reported like a significant change
+func (cs *ChargingStation) clearChargingLimit(evse *evsemanager.EVSE) {
+	if evse.ChargingLimitUnit == "" {
+		return
+	}
+	log.Info("Charging limit of EVSE ", evse.Id, " cleared")
+	evse.ClearChargingLimit()
+	cs.reportChargingRateChanged(evse)
+}
+
+// Phases the limit applies to
+func limitPhases(period smartcharging.Period) int {
+	if period.NumberPhases != nil && *period.NumberPhases > 0 {
+		return *period.NumberPhases
+	}
+	return smartcharging.DefaultPhases
+}
+
+// Sends the limit to the EVSE if it differs from the last one, a significant change is reported in a TransactionEvent
+func (cs *ChargingStation) applyChargingLimit(evse *evsemanager.EVSE, period smartcharging.Period) {
+	phases := limitPhases(period)
+	unit := string(smartcharging.Amperes)
+	if evse.ChargingLimit == period.Limit && evse.ChargingLimitUnit == unit && evse.ChargingLimitPhases == phases {
+		return
+	}
+	previous := evse.ChargingLimit
+	log.Info("Charging limit of EVSE ", evse.Id, ": ", period.Limit, " ", unit, " on ", phases, " phases")
+	evse.SetChargingLimit(period.Limit, unit, phases)
+
+	if !cs.isSignificantChange(previous, period.Limit) {
+		return
+	}
+	cs.reportChargingRateChanged(evse)
+}
+
+func (cs *ChargingStation) reportChargingRateChanged(evse *evsemanager.EVSE) {
+	tx := cs.transactionOn(evse.Id)
+	if tx == nil {
+		return
+	}
+	// ==> TXEventReq: Updated, ChargingRateChanged
+	if _, err := cs.sendTransactionEvent(
+		tx,
+		TransactionEventRequest.TransactionEventEnumType_1_Updated,
+		TransactionEventRequest.TriggerReasonEnumType_1_ChargingRateChanged,
+	); err != nil {
+		log.Error("TransactionEventReq NOT sent: ", err)
+	}
+}
+
+// A change is significant if it is more than LimitChangeSignificance relative to the previous limit.
+// previous is 0 if the EVSE had no limit or a limit of 0, any new limit is significant then.
+func (cs *ChargingStation) isSignificantChange(previous float64, limit float64) bool {
+	if previous == 0 {
+		return true
+	}
+	return math.Abs(limit-previous)/previous > cs.DeviceModel.GetDecimal("SmartChargingCtrlr", "LimitChangeSignificance")
+}
@@ -0,0 +1,41 @@
+package chargingstation
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// Stores the security settings the Charging Station was started with in SecurityCtrlr
+func (cs *ChargingStation) initSecurityCtrlr(config ocppclient.ClientConfig) {
+	security := devicemodel.Component{Name: "SecurityCtrlr"}
+	values := map[string]string{
+		"SecurityProfile":   strconv.Itoa(config.SecurityProfile),
+		"Identity":          config.Identity,
+		"BasicAuthPassword": config.BasicAuthPassword,
+	}
+	for name, value := range values {
+		if err := cs.DeviceModel.UpdateValue(security, devicemodel.Variable{Name: name}, devicemodel.Actual, value); err != nil {
+			log.Error("invalid ", name, ": ", err)
+		}
+	}
+}
+
+// Settings of the OCPP client, read from OCPPCommCtrlr and SecurityCtrlr
+func (cs *ChargingStation) clientConfig(base ocppclient.ClientConfig) ocppclient.ClientConfig {
+	dm := cs.DeviceModel
+	config := base
+	config.RetryBackOffWaitMinimum = dm.GetSeconds("OCPPCommCtrlr", "RetryBackOffWaitMinimum")
+	config.RetryBackOffRandomRange = dm.GetSeconds("OCPPCommCtrlr", "RetryBackOffRandomRange")
+	config.RetryBackOffRepeatTimes = dm.GetInt("OCPPCommCtrlr", "RetryBackOffRepeatTimes")
+	config.MessageTimeout = time.Duration(dm.GetInstanceInt("OCPPCommCtrlr", "MessageTimeout", "Default")) * time.Second
+	config.TransactionMessageAttempts = dm.GetInstanceInt("OCPPCommCtrlr", "MessageAttempts", "TransactionEvent")
+	config.TransactionMessageRetryInterval = time.Duration(dm.GetInstanceInt("OCPPCommCtrlr", "MessageAttemptInterval", "TransactionEvent")) * time.Second
+	config.SecurityProfile = dm.GetInt("SecurityCtrlr", "SecurityProfile")
+	config.Identity = dm.GetString("SecurityCtrlr", "Identity")
+	config.BasicAuthPassword = dm.GetString("SecurityCtrlr", "BasicAuthPassword")
+	return config
+}
@@ -0,0 +1,50 @@
+package chargingstation
+
+import (
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-messages-go/types/DataTransferRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/DataTransferResponse"
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Registers the handlers of the requests the CSMS can send to the Charging Station.
+// Actions without a handler are answered with a NotImplemented CALLERROR.
+func (cs *ChargingStation) registerHandlers() {
+	cs.handle("ChangeAvailability", ocppclient.TypedHandler(cs.handleChangeAvailability))
+	cs.handle("ClearCache", ocppclient.TypedHandler(cs.handleClearCache))
+	cs.handle("ClearChargingProfile", ocppclient.TypedHandler(cs.handleClearChargingProfile))
+	cs.handle("DataTransfer", ocppclient.TypedHandler(cs.handleDataTransfer))
+	cs.handle("GetBaseReport", ocppclient.TypedHandler(cs.handleGetBaseReport))
+	cs.handle("GetChargingProfiles", ocppclient.TypedHandler(cs.handleGetChargingProfiles))
+	cs.handle("GetCompositeSchedule", ocppclient.TypedHandler(cs.handleGetCompositeSchedule))
+	cs.handle("GetLocalListVersion", ocppclient.TypedHandler(cs.handleGetLocalListVersion))
+	cs.handle("GetReport", ocppclient.TypedHandler(cs.handleGetReport))
+	cs.handle("GetVariables", ocppclient.TypedHandler(cs.handleGetVariables))
+	cs.handle("RequestStartTransaction", ocppclient.TypedHandler(cs.handleRequestStartTransaction))
+	cs.handle("RequestStopTransaction", ocppclient.TypedHandler(cs.handleRequestStopTransaction))
+	cs.handle("Reset", ocppclient.TypedHandler(cs.handleReset))
+	cs.handle("SendLocalList", ocppclient.TypedHandler(cs.handleSendLocalList))
+	cs.handle("SetChargingProfile", ocppclient.TypedHandler(cs.handleSetChargingProfile))
+	cs.handle("SetVariables", ocppclient.TypedHandler(cs.handleSetVariables))
+	cs.handle("TriggerMessage", ocppclient.TypedHandler(cs.handleTriggerMessage))
+	cs.handle("UnlockConnector", ocppclient.TypedHandler(cs.handleUnlockConnector))
+}
+
+// Registers a handler that is only invoked if the registration state of the Charging Station allows it
+func (cs *ChargingStation) handle(action string, handler ocppclient.CallHandler) {
+	cs.OcppClient.RegisterHandler(action, func(call wrappers.CALL) (interface{}, error) {
+		if err := cs.checkRegistration(action); err != nil {
+			return nil, err
+		}
+		return handler(call)
+	})
+}
+
+// No vendor specific extensions are supported
+func (cs *ChargingStation) handleDataTransfer(req *DataTransferRequest.DataTransferRequestJson) (interface{}, error) {
+	log.Info("DataTransfer received from CSMS for vendor ", req.VendorId)
+	return DataTransferResponse.DataTransferResponseJson{
+		Status: DataTransferResponse.DataTransferStatusEnumType_1_UnknownVendorId,
+	}, nil
+}
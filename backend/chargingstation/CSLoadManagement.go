@@ -0,0 +1,71 @@
+package chargingstation
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/loadmanager"
+	"github.com/gregszalay/ocpp-charging-station-go/smartcharging"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the site limit is shared again based on what the EVs draw
+const loadBalancingInterval = time.Second * 10
+
+func (cs *ChargingStation) loadManagementEnabled() bool {
+	return cs.DeviceModel.GetBool("LoadManagementCtrlr", "Enabled")
+}
+
+// Lowers the limits of the EVSEs with an EV connected to their share of LoadManagementCtrlr.SiteLimit
+func (cs *ChargingStation) balanceLoad(limits map[int]*smartcharging.Period) {
+	currents := make(map[int]float64, len(limits))
+	measured := make(map[int]*float64, len(limits))
+	for evseId, period := range limits {
+		currents[evseId] = period.Limit
+		if evse := cs.Evses[evseId]; evse.IsCharging == 1 {
+			current := float64(evse.PowerActiveImport_w) / smartcharging.NominalVoltage / float64(limitPhases(*period))
+			measured[evseId] = &current
+		}
+	}
+	allocations := cs.LoadManager.Distribute(
+		cs.DeviceModel.GetDecimal("LoadManagementCtrlr", "SiteLimit"),
+		loadmanager.Strategy(cs.DeviceModel.GetString("LoadManagementCtrlr", "Strategy")),
+		currents,
+		measured,
+	)
+	for evseId, allocation := range allocations {
+		if allocation < limits[evseId].Limit {
+			log.Debug("Load management: EVSE ", evseId, " limited to ", allocation, " A")
+			limits[evseId].Limit = allocation
+		}
+	}
+}
+
+// Gives the EVSE the priority of the idToken group that authorized its transaction
+func (cs *ChargingStation) prioritizeGroup(evseId int, groupIdToken string) {
+	priority := cs.groupPriority(groupIdToken)
+	cs.LoadManager.SetPriority(evseId, priority)
+	if priority != 0 {
+		log.Info("Load management: EVSE ", evseId, " has priority ", priority, " of group ", groupIdToken)
+		cs.chargingLimitsChanged()
+	}
+}
+
+// Priority of the group in LoadManagementCtrlr.GroupPriorities, e.g. "FLEET:2,STAFF:1", 0 if it is not listed
+func (cs *ChargingStation) groupPriority(groupIdToken string) int {
+	if groupIdToken == "" {
+		return 0
+	}
+	for _, entry := range strings.Split(cs.DeviceModel.GetString("LoadManagementCtrlr", "GroupPriorities"), ",") {
+		group, priority, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || group != groupIdToken {
+			continue
+		}
+		if value, err := strconv.Atoi(priority); err == nil {
+			return value
+		}
+		log.Error("invalid priority in LoadManagementCtrlr.GroupPriorities: ", entry)
+	}
+	return 0
+}
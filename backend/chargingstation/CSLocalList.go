@@ -0,0 +1,97 @@
+package chargingstation
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/localauthlist"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/GetLocalListVersionRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/GetLocalListVersionResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/SendLocalListRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/SendLocalListResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+func (cs *ChargingStation) localListEnabled() bool {
+	return cs.DeviceModel.GetBool("LocalAuthListCtrlr", "Enabled")
+}
+
+func failLocalList(reasonCode string, additionalInfo string) SendLocalListResponse.SendLocalListResponseJson {
+	response := SendLocalListResponse.SendLocalListResponseJson{
+		Status:     SendLocalListResponse.SendLocalListStatusEnumType_1_Failed,
+		StatusInfo: &SendLocalListResponse.StatusInfoType{ReasonCode: reasonCode},
+	}
+	if additionalInfo != "" {
+		response.StatusInfo.AdditionalInfo = &additionalInfo
+	}
+	return response
+}
+
+// D01: installs a Full or Differential update of the local authorization list
+func (cs *ChargingStation) handleSendLocalList(req *SendLocalListRequest.SendLocalListRequestJson) (interface{}, error) {
+	if !cs.localListEnabled() {
+		return failLocalList("NotEnabled", ""), nil
+	}
+	if items := cs.DeviceModel.GetInt("LocalAuthListCtrlr", "ItemsPerMessage"); len(req.LocalAuthorizationList) > items {
+		return failLocalList("TooManyElements", "at most "+strconv.Itoa(items)+" entries per message"), nil
+	}
+	max_entries, _ := cs.DeviceModel.GetMaxLimit(devicemodel.Component{Name: "LocalAuthListCtrlr"}, devicemodel.Variable{Name: "Entries"})
+	if err := cs.LocalList.Update(req, int(max_entries)); err != nil {
+		log.Error("SendLocalList ", req.UpdateType, " version ", req.VersionNumber, " rejected: ", err)
+		if errors.Is(err, localauthlist.ErrVersionMismatch) {
+			return SendLocalListResponse.SendLocalListResponseJson{
+				Status: SendLocalListResponse.SendLocalListStatusEnumType_1_VersionMismatch,
+			}, nil
+		}
+		if errors.Is(err, localauthlist.ErrNotPersisted) {
+			return failLocalList("InternalError", err.Error()), nil
+		}
+		return failLocalList("InvalidValue", err.Error()), nil
+	}
+	cs.updateLocalListEntries()
+	log.Info("Local authorization list updated to version ", req.VersionNumber, ", ", cs.LocalList.Len(), " entries")
+	return SendLocalListResponse.SendLocalListResponseJson{
+		Status: SendLocalListResponse.SendLocalListStatusEnumType_1_Accepted,
+	}, nil
+}
+
+// D02: version 0 means there is no list
+func (cs *ChargingStation) handleGetLocalListVersion(req *GetLocalListVersionRequest.GetLocalListVersionRequestJson) (interface{}, error) {
+	version := 0
+	if cs.localListEnabled() {
+		version = cs.LocalList.Version()
+	}
+	return GetLocalListVersionResponse.GetLocalListVersionResponseJson{VersionNumber: version}, nil
+}
+
+// IdTokenInfo of the idToken in the local authorization list, false if the list is disabled or the idToken is not in it
+func (cs *ChargingStation) localListIdTokenInfo(idToken AuthorizeRequest.IdTokenType) (AuthorizeResponse.IdTokenInfoType, bool) {
+	if !cs.localListEnabled() {
+		return AuthorizeResponse.IdTokenInfoType{}, false
+	}
+	list_info, found := cs.LocalList.Lookup(string(idToken.Type), idToken.IdToken)
+	if !found {
+		return AuthorizeResponse.IdTokenInfoType{}, false
+	}
+	var info AuthorizeResponse.IdTokenInfoType
+	if err := convert(list_info, &info); err != nil {
+		log.Error("local authorization list: invalid idTokenInfo: ", err)
+		return AuthorizeResponse.IdTokenInfoType{}, false
+	}
+	return info, true
+}
+
+// Keeps LocalAuthListCtrlr.Entries up to date
+func (cs *ChargingStation) updateLocalListEntries() {
+	if err := cs.DeviceModel.UpdateValue(
+		devicemodel.Component{Name: "LocalAuthListCtrlr"},
+		devicemodel.Variable{Name: "Entries"},
+		devicemodel.Actual,
+		strconv.Itoa(cs.LocalList.Len()),
+	); err != nil {
+		log.Error("device model: LocalAuthListCtrlr.Entries: ", err)
+	}
+}
@@ -0,0 +1,52 @@
+package chargingstation
+
+import (
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-charging-station-go/transactions"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventRequest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Keeps the transaction and its seqNo across restarts, until the Ended event is sent
+func (cs *ChargingStation) saveTransaction(tx *transactions.Transaction) {
+	if err := cs.Store.Put(persistence.TransactionsBucket, tx.Id, tx.State()); err != nil {
+		log.Error("unable to persist transaction ", tx.Id, ": ", err)
+	}
+}
+
+func (cs *ChargingStation) deleteTransaction(tx *transactions.Transaction) {
+	if err := cs.Store.Delete(persistence.TransactionsBucket, tx.Id); err != nil {
+		log.Error("unable to delete persisted transaction ", tx.Id, ": ", err)
+	}
+}
+
+// Ends the transactions that were ongoing when the Charging Station stopped.
+// The Ended events continue the seqNo of the transaction and are sent once the CSMS accepts the BootNotification.
+func (cs *ChargingStation) recoverTransactions() {
+	ids, err := cs.Store.Keys(persistence.TransactionsBucket)
+	if err != nil {
+		log.Error("unable to read persisted transactions: ", err)
+		return
+	}
+	for _, id := range ids {
+		var state transactions.TransactionState
+		if _, err := cs.Store.Get(persistence.TransactionsBucket, id, &state); err != nil {
+			log.Error("skipping unreadable persisted transaction ", id, ": ", err)
+			continue
+		}
+		tx := transactions.RestoreTransaction(state, cs.Evses[state.EvseId])
+		stopped_reason := TransactionEventRequest.ReasonEnumType_1_PowerLoss
+		tx.StoppedReason = &stopped_reason
+		tx.IsInProgress = false
+		log.Warning("Recovering transaction ", tx.Id, " on EVSE ", state.EvseId, " that was interrupted, ending it with seqNo ", tx.TxSeqNo)
+
+		// ==> TXEventReq: Ended, AbnormalCondition
+		if _, err := cs.sendTransactionEvent(
+			tx,
+			TransactionEventRequest.TransactionEventEnumType_1_Ended,
+			TransactionEventRequest.TriggerReasonEnumType_1_AbnormalCondition,
+		); err != nil {
+			log.Error("TransactionEventReq NOT sent: ", err)
+		}
+	}
+}
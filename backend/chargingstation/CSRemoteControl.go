@@ -0,0 +1,272 @@
+package chargingstation
+
+import (
+	"context"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/evsemanager"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-charging-station-go/transactions"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/RequestStartTransactionRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/RequestStartTransactionResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/RequestStopTransactionRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/RequestStopTransactionResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/UnlockConnectorRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/UnlockConnectorResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long UnlockConnector waits for the reply of the EVSE controller
+const unlockTimeout = time.Second * 5
+
+func rejectStart(reasonCode string) RequestStartTransactionResponse.RequestStartTransactionResponseJson {
+	return RequestStartTransactionResponse.RequestStartTransactionResponseJson{
+		Status:     RequestStartTransactionResponse.RequestStartStopStatusEnumType_1_Rejected,
+		StatusInfo: &RequestStartTransactionResponse.StatusInfoType{ReasonCode: reasonCode},
+	}
+}
+
+// F01/F02: starts a transaction on request of the CSMS, before or after the EV is plugged in
+func (cs *ChargingStation) handleRequestStartTransaction(req *RequestStartTransactionRequest.RequestStartTransactionRequestJson) (interface{}, error) {
+	evse := cs.evseForRemoteStart(req.EvseId)
+	if evse == nil {
+		return rejectStart("UnknownEvse"), nil
+	}
+	if !cs.isOperative(evse.Id) {
+		return rejectStart("Inoperative"), nil
+	}
+	tx := cs.transactionOn(evse.Id)
+	if tx != nil && tx.IsInProgress {
+		return rejectStart("TxInProgress"), nil
+	}
+	if req.ChargingProfile != nil {
+		if req.ChargingProfile.ChargingProfilePurpose != RequestStartTransactionRequest.ChargingProfilePurposeEnumType_1_TxProfile ||
+			req.ChargingProfile.TransactionId != nil {
+			return rejectStart("InvalidProfile"), nil
+		}
+	}
+	// The transaction is set up after the response, a second request must not get the same EVSE meanwhile
+	if !cs.reserveRemoteStart(evse.Id) {
+		return rejectStart("TxInProgress"), nil
+	}
+
+	response := RequestStartTransactionResponse.RequestStartTransactionResponseJson{
+		Status: RequestStartTransactionResponse.RequestStartStopStatusEnumType_1_Accepted,
+	}
+	if tx != nil {
+		tx_id := tx.Id
+		response.TransactionId = &tx_id
+	}
+	log.Info("RequestStartTransaction ", req.RemoteStartId, " accepted on EVSE ", evse.Id)
+	return ocppclient.FollowUp{
+		Payload: response,
+		Then:    func() { cs.remoteStart(evse, tx, req) },
+	}, nil
+}
+
+// The requested EVSE, or the first one without a transaction if the CSMS did not choose one
+func (cs *ChargingStation) evseForRemoteStart(evseId *int) *evsemanager.EVSE {
+	if evseId != nil {
+		return cs.Evses[*evseId]
+	}
+	for _, id := range cs.sortedEvseIds() {
+		if cs.transactionOn(id) == nil && cs.isOperative(id) && !cs.isReservedForRemoteStart(id) {
+			return cs.Evses[id]
+		}
+	}
+	return nil
+}
+
+// False if another accepted remote start has reserved the EVSE already
+func (cs *ChargingStation) reserveRemoteStart(evseId int) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.remote_starts[evseId] {
+		return false
+	}
+	cs.remote_starts[evseId] = true
+	return true
+}
+
+func (cs *ChargingStation) releaseRemoteStart(evseId int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.remote_starts, evseId)
+}
+
+func (cs *ChargingStation) isReservedForRemoteStart(evseId int) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.remote_starts[evseId]
+}
+
+func (cs *ChargingStation) remoteStart(evse *evsemanager.EVSE, tx *transactions.Transaction, req *RequestStartTransactionRequest.RequestStartTransactionRequestJson) {
+	tx, ok := cs.startRemoteTransaction(evse, tx, req)
+	if !ok {
+		return
+	}
+	cs.runTransactionUpdates(tx)
+}
+
+// Authorizes the remote start and sets its transaction up. The EVSE is released when this returns,
+// by then the transaction in progress keeps other starts away, or the start has failed.
+// The events are not awaited, E04: the offline queue delivers them once the CSMS can be reached.
+func (cs *ChargingStation) startRemoteTransaction(
+	evse *evsemanager.EVSE,
+	tx *transactions.Transaction,
+	req *RequestStartTransactionRequest.RequestStartTransactionRequestJson,
+) (*transactions.Transaction, bool) {
+	defer cs.releaseRemoteStart(evse.Id)
+	ctx := context.Background()
+
+	group_id_token := ""
+	if req.GroupIdToken != nil {
+		group_id_token = req.GroupIdToken.IdToken
+	}
+	if cs.DeviceModel.GetBool("AuthCtrlr", "AuthorizeRemoteStart") {
+		var id_token AuthorizeRequest.IdTokenType
+		if err := convert(req.IdToken, &id_token); err != nil {
+			log.Error("Remote start ", req.RemoteStartId, " not authorized: ", err)
+			return nil, false
+		}
+		id_token_info, ok := cs.authorizeIdToken(ctx, id_token)
+		if !ok {
+			log.Error("Remote start ", req.RemoteStartId, " not authorized")
+			return nil, false
+		}
+		if id_token_info.GroupIdToken != nil {
+			group_id_token = id_token_info.GroupIdToken.IdToken
+		}
+	}
+
+	// The EV may have been plugged in while the idToken was authorized
+	if current := cs.transactionOn(evse.Id); current != nil {
+		tx = current
+	}
+	remote_start_id := req.RemoteStartId
+	if tx == nil {
+		// F01: no EV yet, the transaction starts now and charging starts when the EV is plugged in
+		tx, _ = transactions.CreateTransaction(evse)
+		tx.RemoteStartId = &remote_start_id
+		tx.IdToken = transactionIdToken(req.IdToken)
+		tx.IsInProgress = true
+		cs.setTransaction(evse.Id, tx)
+		// ==> TXEventReq: Started, RemoteStart
+		if _, err := cs.sendTransactionEvent(
+			tx,
+			TransactionEventRequest.TransactionEventEnumType_1_Started,
+			TransactionEventRequest.TriggerReasonEnumType_1_RemoteStart,
+		); err != nil {
+			log.Error("TransactionEventReq NOT sent: ", err)
+		}
+		go cs.awaitEVConnection(evse, tx)
+	} else {
+		// F02: the EV is plugged in already, the transaction started with CablePluggedIn
+		tx.Lock()
+		tx.RemoteStartId = &remote_start_id
+		tx.IdToken = transactionIdToken(req.IdToken)
+		tx.IsInProgress = true
+		tx.Unlock()
+		// ==> TXEventReq: Updated, RemoteStart
+		if _, err := cs.sendTransactionEvent(
+			tx,
+			TransactionEventRequest.TransactionEventEnumType_1_Updated,
+			TransactionEventRequest.TriggerReasonEnumType_1_RemoteStart,
+		); err != nil {
+			log.Error("TransactionEventReq NOT sent: ", err)
+		}
+	}
+	cs.prioritizeGroup(evse.Id, group_id_token)
+	if req.ChargingProfile != nil {
+		cs.installRemoteStartProfile(evse.Id, tx, req.ChargingProfile)
+	}
+	evse.EnableCharging()
+	return tx, true
+}
+
+// Ends a remotely started transaction if the EV is not plugged in within EVConnectionTimeOut
+func (cs *ChargingStation) awaitEVConnection(evse *evsemanager.EVSE, tx *transactions.Transaction) {
+	timeout := cs.DeviceModel.GetSeconds("TxCtrlr", "EVConnectionTimeOut")
+	if timeout <= 0 || !cs.sleep(timeout) {
+		return
+	}
+	if evse.IsEVConnected == 1 || cs.transactionOn(evse.Id) != tx {
+		return
+	}
+	log.Warning("No EV connected to EVSE ", evse.Id, " within ", timeout, ", ending transaction ", tx.Id)
+	cs.stopTransaction(tx, TransactionEventRequest.ReasonEnumType_1_Timeout, TransactionEventRequest.TriggerReasonEnumType_1_EVConnectTimeout)
+	cs.SendStatusNotification(evse)
+	cs.onTransactionEnded(evse.Id)
+}
+
+// The EV was plugged in after the transaction was started remotely
+func (cs *ChargingStation) onEVConnectedToTransaction(tx *transactions.Transaction) {
+	// ==> TXEventReq: Updated, CablePluggedIn
+	if _, err := cs.sendTransactionEvent(
+		tx,
+		TransactionEventRequest.TransactionEventEnumType_1_Updated,
+		TransactionEventRequest.TriggerReasonEnumType_1_CablePluggedIn,
+	); err != nil {
+		log.Error("TransactionEventReq NOT sent: ", err)
+	}
+}
+
+// F03: stops a transaction on request of the CSMS
+func (cs *ChargingStation) handleRequestStopTransaction(req *RequestStopTransactionRequest.RequestStopTransactionRequestJson) (interface{}, error) {
+	for evseId, tx := range cs.activeTransactions() {
+		if tx.Id != req.TransactionId {
+			continue
+		}
+		evse := cs.Evses[evseId]
+		log.Info("RequestStopTransaction accepted for transaction ", tx.Id, " on EVSE ", evseId)
+		return ocppclient.FollowUp{
+			Payload: RequestStopTransactionResponse.RequestStopTransactionResponseJson{
+				Status: RequestStopTransactionResponse.RequestStartStopStatusEnumType_1_Accepted,
+			},
+			Then: func() {
+				cs.finishTransaction(
+					evse,
+					tx,
+					TransactionEventRequest.TriggerReasonEnumType_1_RemoteStop,
+					TransactionEventRequest.ReasonEnumType_1_Remote,
+				)
+			},
+		}, nil
+	}
+	return RequestStopTransactionResponse.RequestStopTransactionResponseJson{
+		Status:     RequestStopTransactionResponse.RequestStartStopStatusEnumType_1_Rejected,
+		StatusInfo: &RequestStopTransactionResponse.StatusInfoType{ReasonCode: "UnknownTransaction"},
+	}, nil
+}
+
+// F05: releases the cable of a connector, unless it is used by an authorized transaction
+func (cs *ChargingStation) handleUnlockConnector(req *UnlockConnectorRequest.UnlockConnectorRequestJson) (interface{}, error) {
+	evse, ok := cs.Evses[req.EvseId]
+	if !ok || req.ConnectorId != connectorId {
+		return UnlockConnectorResponse.UnlockConnectorResponseJson{
+			Status: UnlockConnectorResponse.UnlockStatusEnumType_1_UnknownConnector,
+		}, nil
+	}
+	if tx := cs.transactionOn(evse.Id); tx != nil && tx.IsInProgress {
+		return UnlockConnectorResponse.UnlockConnectorResponseJson{
+			Status: UnlockConnectorResponse.UnlockStatusEnumType_1_OngoingAuthorizedTransaction,
+		}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+	status, err := evse.Unlock(ctx, req.ConnectorId)
+	if err != nil {
+		log.Error("Unlocking connector ", req.ConnectorId, " of EVSE ", evse.Id, " failed: ", err)
+		return UnlockConnectorResponse.UnlockConnectorResponseJson{
+			Status:     UnlockConnectorResponse.UnlockStatusEnumType_1_UnlockFailed,
+			StatusInfo: &UnlockConnectorResponse.StatusInfoType{ReasonCode: "NoReply"},
+		}, nil
+	}
+	log.Info("Unlock connector ", req.ConnectorId, " of EVSE ", evse.Id, ": ", status)
+	return UnlockConnectorResponse.UnlockConnectorResponseJson{
+		Status: UnlockConnectorResponse.UnlockStatusEnumType_1(status),
+	}, nil
+}
@@ -0,0 +1,242 @@
+package chargingstation
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-messages-go/types/GetBaseReportRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/GetBaseReportResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/GetReportRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/GetReportResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyReportRequest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Variables that describe the state of a component, reported in a SummaryInventory
+var summaryVariables = map[string]bool{
+	"Active":            true,
+	"Available":         true,
+	"AvailabilityState": true,
+	"Enabled":           true,
+	"Problem":           true,
+}
+
+// Room left in a NotifyReport message for everything but the reportData
+const notifyReportOverhead = 256
+
+func (cs *ChargingStation) handleGetBaseReport(req *GetBaseReportRequest.GetBaseReportRequestJson) (interface{}, error) {
+	variables := make([]devicemodel.ComponentVariable, 0)
+	for _, variable := range cs.DeviceModel.Variables() {
+		switch req.ReportBase {
+		case GetBaseReportRequest.ReportBaseEnumType_1_FullInventory:
+			variables = append(variables, variable)
+		case GetBaseReportRequest.ReportBaseEnumType_1_ConfigurationInventory:
+			if isConfigurable(variable) {
+				variables = append(variables, variable)
+			}
+		case GetBaseReportRequest.ReportBaseEnumType_1_SummaryInventory:
+			if summaryVariables[variable.Variable.Name] {
+				variables = append(variables, variable)
+			}
+		}
+	}
+	log.Info("GetBaseReport ", req.ReportBase, " with requestId ", req.RequestId, ": ", len(variables), " variables")
+	if len(variables) == 0 {
+		return GetBaseReportResponse.GetBaseReportResponseJson{
+			Status: GetBaseReportResponse.GenericDeviceModelStatusEnumType_1_EmptyResultSet,
+		}, nil
+	}
+	return ocppclient.FollowUp{
+		Payload: GetBaseReportResponse.GetBaseReportResponseJson{
+			Status: GetBaseReportResponse.GenericDeviceModelStatusEnumType_1_Accepted,
+		},
+		Then: func() { cs.sendReport(req.RequestId, variables) },
+	}, nil
+}
+
+func (cs *ChargingStation) handleGetReport(req *GetReportRequest.GetReportRequestJson) (interface{}, error) {
+	if err := cs.checkItemsPerMessage("GetReport", len(req.ComponentVariable)); err != nil {
+		return nil, err
+	}
+	criteria := make([]string, 0, len(req.ComponentCriteria))
+	for _, criterion := range req.ComponentCriteria {
+		criteria = append(criteria, string(criterion))
+	}
+	all_variables := cs.DeviceModel.Variables()
+	variables := make([]devicemodel.ComponentVariable, 0)
+	for _, variable := range all_variables {
+		if len(req.ComponentVariable) > 0 && !matchesAnyComponentVariable(variable, req.ComponentVariable) {
+			continue
+		}
+		if len(criteria) > 0 && !meetsAnyCriterion(variable.Component, criteria, all_variables) {
+			continue
+		}
+		variables = append(variables, variable)
+	}
+	log.Info("GetReport with requestId ", req.RequestId, ": ", len(variables), " variables")
+	if len(variables) == 0 {
+		return GetReportResponse.GetReportResponseJson{
+			Status: GetReportResponse.GenericDeviceModelStatusEnumType_1_EmptyResultSet,
+		}, nil
+	}
+	return ocppclient.FollowUp{
+		Payload: GetReportResponse.GetReportResponseJson{
+			Status: GetReportResponse.GenericDeviceModelStatusEnumType_1_Accepted,
+		},
+		Then: func() { cs.sendReport(req.RequestId, variables) },
+	}, nil
+}
+
+// Configuration variables are the ones the CSMS can write
+func isConfigurable(variable devicemodel.ComponentVariable) bool {
+	for _, attribute := range variable.Attributes {
+		if !attribute.Constant && (attribute.Mutability == devicemodel.ReadWrite || attribute.Mutability == devicemodel.WriteOnly) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields that are left out of the requested component or variable match any value
+func matchesAnyComponentVariable(variable devicemodel.ComponentVariable, requested []GetReportRequest.ComponentVariableType) bool {
+	for _, component_variable := range requested {
+		var component ocppComponent
+		if err := convert(component_variable.Component, &component); err != nil || component.Name != variable.Component.Name {
+			continue
+		}
+		if component.Instance != nil && *component.Instance != variable.Component.Instance {
+			continue
+		}
+		if component.Evse != nil {
+			if component.Evse.Id != variable.Component.EvseId {
+				continue
+			}
+			if component.Evse.ConnectorId != nil && *component.Evse.ConnectorId != variable.Component.ConnectorId {
+				continue
+			}
+		}
+		if component_variable.Variable != nil {
+			if component_variable.Variable.Name != variable.Variable.Name {
+				continue
+			}
+			if component_variable.Variable.Instance != nil && *component_variable.Variable.Instance != variable.Variable.Instance {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// A component meets a criterion (Active, Available, Enabled, Problem) if its variable of the same name is true
+func meetsAnyCriterion(component devicemodel.Component, criteria []string, variables []devicemodel.ComponentVariable) bool {
+	for _, variable := range variables {
+		if variable.Component != component || variable.Variable.Instance != "" {
+			continue
+		}
+		for _, criterion := range criteria {
+			if variable.Variable.Name != criterion {
+				continue
+			}
+			for _, attribute := range variable.Attributes {
+				if attribute.Type == devicemodel.Actual && attribute.Value == "true" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func toReportData(variable devicemodel.ComponentVariable) NotifyReportRequest.ReportDataType {
+	report_data := NotifyReportRequest.ReportDataType{
+		VariableAttribute: make([]NotifyReportRequest.VariableAttributeType, 0, len(variable.Attributes)),
+	}
+	component, ocpp_variable := fromDeviceModel(variable.Component, variable.Variable)
+	convert(component, &report_data.Component)
+	convert(ocpp_variable, &report_data.Variable)
+
+	for _, attribute := range variable.Attributes {
+		attribute_type := NotifyReportRequest.AttributeEnumType_1(attribute.Type)
+		mutability := NotifyReportRequest.MutabilityEnumType_1(attribute.Mutability)
+		variable_attribute := NotifyReportRequest.VariableAttributeType{
+			Type:       &attribute_type,
+			Mutability: &mutability,
+			Persistent: attribute.Persistent,
+			Constant:   attribute.Constant,
+		}
+		// Write-only values, e.g. passwords, are never reported
+		if attribute.Mutability != devicemodel.WriteOnly {
+			value := attribute.Value
+			variable_attribute.Value = &value
+		}
+		report_data.VariableAttribute = append(report_data.VariableAttribute, variable_attribute)
+	}
+
+	characteristics := variable.Characteristics
+	report_data.VariableCharacteristics = &NotifyReportRequest.VariableCharacteristicsType{
+		DataType:           NotifyReportRequest.DataEnumType_1(characteristics.DataType),
+		MinLimit:           characteristics.MinLimit,
+		MaxLimit:           characteristics.MaxLimit,
+		SupportsMonitoring: characteristics.SupportsMonitoring,
+	}
+	if characteristics.Unit != "" {
+		unit := characteristics.Unit
+		report_data.VariableCharacteristics.Unit = &unit
+	}
+	if characteristics.ValuesList != "" {
+		values_list := characteristics.ValuesList
+		report_data.VariableCharacteristics.ValuesList = &values_list
+	}
+	return report_data
+}
+
+// Splits the report into NotifyReport messages that respect ItemsPerMessage[GetReport] and BytesPerMessage[GetReport]
+func (cs *ChargingStation) reportParts(variables []devicemodel.ComponentVariable) [][]NotifyReportRequest.ReportDataType {
+	items_per_message := cs.DeviceModel.GetInstanceInt("DeviceDataCtrlr", "ItemsPerMessage", "GetReport")
+	bytes_per_message := cs.DeviceModel.GetInstanceInt("DeviceDataCtrlr", "BytesPerMessage", "GetReport")
+
+	parts := make([][]NotifyReportRequest.ReportDataType, 0)
+	part := make([]NotifyReportRequest.ReportDataType, 0)
+	part_bytes := notifyReportOverhead
+	for _, variable := range variables {
+		report_data := toReportData(variable)
+		report_data_bytes := 1
+		if bytes, err := json.Marshal(report_data); err == nil {
+			report_data_bytes += len(bytes)
+		}
+		full := items_per_message > 0 && len(part) >= items_per_message
+		too_big := bytes_per_message > 0 && part_bytes+report_data_bytes > bytes_per_message
+		if len(part) > 0 && (full || too_big) {
+			parts = append(parts, part)
+			part = make([]NotifyReportRequest.ReportDataType, 0)
+			part_bytes = notifyReportOverhead
+		}
+		part = append(part, report_data)
+		part_bytes += report_data_bytes
+	}
+	return append(parts, part)
+}
+
+// Sends the report in as many NotifyReport messages as needed, tbc is set on all but the last one
+func (cs *ChargingStation) sendReport(requestId int, variables []devicemodel.ComponentVariable) {
+	generated_at := time.Now().UTC().Format(time.RFC3339)
+	parts := cs.reportParts(variables)
+	for seqNo, part := range parts {
+		notifyReportRequest := NotifyReportRequest.NotifyReportRequestJson{
+			RequestId:   requestId,
+			GeneratedAt: generated_at,
+			SeqNo:       seqNo,
+			Tbc:         seqNo < len(parts)-1,
+			ReportData:  part,
+		}
+		if _, err := cs.OcppClient.Call(context.Background(), "NotifyReport", notifyReportRequest); err != nil {
+			log.Error("NotifyReport ", seqNo, " of request ", requestId, " failed, the rest of the report is not sent: ", err)
+			return
+		}
+	}
+	log.Info("Report ", requestId, " sent in ", len(parts), " NotifyReport messages")
+}
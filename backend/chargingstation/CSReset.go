@@ -0,0 +1,165 @@
+package chargingstation
+
+import (
+	"context"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/displayserver"
+	"github.com/gregszalay/ocpp-charging-station-go/evsemanager"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-charging-station-go/transactions"
+	"github.com/gregszalay/ocpp-messages-go/types/BootNotificationRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/ResetRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/ResetResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventRequest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Key of the boot reason of the next BootNotification in the station bucket, set before a reset
+const bootReasonKey = "boot_reason"
+
+// How long the shutdown waits for the CSMS to receive the last messages
+const shutdownTimeout = time.Second * 30
+
+// B11/B12: resets the whole Charging Station or a single EVSE, OnIdle resets wait for the transactions to end
+func (cs *ChargingStation) handleReset(req *ResetRequest.ResetRequestJson) (interface{}, error) {
+	if req.EvseId != nil && *req.EvseId != 0 {
+		evse, ok := cs.Evses[*req.EvseId]
+		if !ok {
+			return ResetResponse.ResetResponseJson{
+				Status:     ResetResponse.ResetStatusEnumType_1_Rejected,
+				StatusInfo: &ResetResponse.StatusInfoType{ReasonCode: "UnknownEvse"},
+			}, nil
+		}
+		if req.Type == ResetRequest.ResetEnumType_1_OnIdle && cs.transactionOn(evse.Id) != nil {
+			log.Info("Reset of EVSE ", evse.Id, " scheduled, waiting for the transaction to end")
+			cs.mu.Lock()
+			cs.scheduled_evse_resets[evse.Id] = true
+			cs.mu.Unlock()
+			return ResetResponse.ResetResponseJson{Status: ResetResponse.ResetStatusEnumType_1_Scheduled}, nil
+		}
+		return ocppclient.FollowUp{
+			Payload: ResetResponse.ResetResponseJson{Status: ResetResponse.ResetStatusEnumType_1_Accepted},
+			Then:    func() { cs.resetEVSE(evse) },
+		}, nil
+	}
+
+	if req.Type == ResetRequest.ResetEnumType_1_OnIdle && len(cs.activeTransactions()) > 0 {
+		log.Info("Reset scheduled, waiting for the transactions to end")
+		cs.mu.Lock()
+		cs.scheduled_reset = true
+		cs.mu.Unlock()
+		return ResetResponse.ResetResponseJson{Status: ResetResponse.ResetStatusEnumType_1_Scheduled}, nil
+	}
+	return ocppclient.FollowUp{
+		Payload: ResetResponse.ResetResponseJson{Status: ResetResponse.ResetStatusEnumType_1_Accepted},
+		Then:    cs.restart,
+	}, nil
+}
+
+// Runs the resets that were scheduled until the transaction on the EVSE ended
+func (cs *ChargingStation) runScheduledResets(evseId int) {
+	cs.mu.Lock()
+	evse_reset := cs.scheduled_evse_resets[evseId]
+	delete(cs.scheduled_evse_resets, evseId)
+	station_reset := cs.scheduled_reset
+	cs.mu.Unlock()
+
+	if evse_reset {
+		cs.resetEVSE(cs.Evses[evseId])
+	}
+	if station_reset && len(cs.activeTransactions()) == 0 {
+		cs.restart()
+	}
+}
+
+// Ends the transaction on the EVSE and brings the EVSE back to its initial state
+func (cs *ChargingStation) resetEVSE(evse *evsemanager.EVSE) {
+	log.Info("Resetting EVSE ", evse.Id)
+	if tx := cs.transactionOn(evse.Id); tx != nil {
+		cs.stopTransaction(tx, TransactionEventRequest.ReasonEnumType_1_ImmediateReset, TransactionEventRequest.TriggerReasonEnumType_1_ResetCommand)
+	}
+	evse.DisableCharging()
+	cs.SendStatusNotification(evse)
+}
+
+// Ends a transaction on behalf of the Charging Station, the Ended event is queued and delivered in order
+func (cs *ChargingStation) stopTransaction(
+	tx *transactions.Transaction,
+	stoppedReason TransactionEventRequest.ReasonEnumType_1,
+	triggerReason TransactionEventRequest.TriggerReasonEnumType_1,
+) {
+	if tx.Evse != nil {
+		tx.Evse.DisableCharging()
+		cs.removeTransaction(tx.Evse.Id)
+	}
+	tx.Lock()
+	tx.IsInProgress = false
+	tx.StoppedReason = &stoppedReason
+	tx.Unlock()
+
+	// ==> TXEventReq: Ended
+	if _, err := cs.sendTransactionEvent(tx, TransactionEventRequest.TransactionEventEnumType_1_Ended, triggerReason); err != nil {
+		log.Error("TransactionEventReq NOT sent: ", err)
+	}
+}
+
+// Shuts the Charging Station down and asks main to create it again, the new instance boots with reason RemoteReset
+func (cs *ChargingStation) restart() {
+	if err := cs.Store.Put(persistence.StationBucket, bootReasonKey, BootNotificationRequest.BootReasonEnumType_1_RemoteReset); err != nil {
+		log.Error("unable to persist the boot reason: ", err)
+	}
+	cs.shutDown(TransactionEventRequest.ReasonEnumType_1_ImmediateReset, TransactionEventRequest.TriggerReasonEnumType_1_ResetCommand)
+	select {
+	case cs.Restart_requests <- struct{}{}:
+	default:
+	}
+}
+
+// Boot reason of the first BootNotification, RemoteReset if the previous instance was reset by the CSMS
+func (cs *ChargingStation) restoreBootReason() {
+	var boot_reason BootNotificationRequest.BootReasonEnumType_1
+	if found, err := cs.Store.Get(persistence.StationBucket, bootReasonKey, &boot_reason); err != nil {
+		log.Error("unable to read the persisted boot reason: ", err)
+	} else if found {
+		cs.boot_reason = boot_reason
+	}
+}
+
+func (cs *ChargingStation) clearBootReason() {
+	if err := cs.Store.Delete(persistence.StationBucket, bootReasonKey); err != nil {
+		log.Error("unable to delete the persisted boot reason: ", err)
+	}
+}
+
+func (cs *ChargingStation) shutDown(
+	stoppedReason TransactionEventRequest.ReasonEnumType_1,
+	triggerReason TransactionEventRequest.TriggerReasonEnumType_1,
+) {
+	cs.stop_once.Do(func() {
+		log.Info("Shutting down the charging station")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		for _, tx := range cs.activeTransactions() {
+			cs.stopTransaction(tx, stoppedReason, triggerReason)
+		}
+
+		// TransactionEvents that cannot be delivered now stay in the offline queue
+		if cs.isAccepted() && cs.OcppClient.IsConnected() {
+			if err := cs.OcppClient.Flush(ctx); err != nil {
+				log.Warning("not every message was delivered before the shutdown: ", err)
+			}
+		}
+
+		close(cs.stopped)
+		cs.AuthCache.Flush()
+		cs.OcppClient.Disconnect(time.Second * 5)
+		for _, evse := range cs.Evses {
+			evse.Disconnect()
+		}
+		displayserver.Stop(ctx)
+		log.Info("Charging station stopped")
+	})
+}
@@ -1,10 +1,10 @@
 package chargingstation
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
 	"github.com/gregszalay/ocpp-charging-station-go/evsemanager"
 	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
 	"github.com/gregszalay/ocpp-messages-go/types/StatusNotificationRequest"
@@ -14,18 +14,23 @@ import (
 
 func (cs *ChargingStation) SendStatusNotification(evse *evsemanager.EVSE) {
 
-	// Fetch status of the EVSE
-	var status = StatusNotificationRequest.ConnectorStatusEnumType_1_Available
-	if evse.IsError == 1 {
-		status = StatusNotificationRequest.ConnectorStatusEnumType_1_Faulted
-	}
-	if evse.IsEVConnected == 1 {
-		status = StatusNotificationRequest.ConnectorStatusEnumType_1_Occupied
+	// StatusNotifications are sent once the CSMS has accepted the BootNotification
+	if !cs.isAccepted() {
+		log.Debug("Not sending StatusNotification, the charging station is not accepted yet")
+		return
 	}
+	cs.sendStatusNotification(evse)
+}
+
+// Sends the StatusNotification regardless of the registration state, e.g. when the CSMS triggers it while Pending
+func (cs *ChargingStation) sendStatusNotification(evse *evsemanager.EVSE) {
+
+	// Fetch status of the EVSE
+	status := cs.connectorStatus(evse)
 
 	// Create StatusNotificationRequest
 	statusNotificationRequest := &StatusNotificationRequest.StatusNotificationRequestJson{
-		ConnectorId:     0, //TODO check numbering standard
+		ConnectorId:     connectorId,
 		ConnectorStatus: status,
 		EvseId:          evse.Id,
 		Timestamp:       time.Now().Format(time.RFC3339),
@@ -41,10 +46,34 @@ func (cs *ChargingStation) SendStatusNotification(evse *evsemanager.EVSE) {
 	cs.OcppClient.Send(ocppclient.AsyncOcppCall{
 		Message: *call_wrapper,
 		SuccessCallback: func(callresult wrappers.CALLRESULT) {
-			fmt.Println("Statusnotification received by CSMS")
+			log.Debug("StatusNotificationReq received by CSMS")
 		},
 		ErrorCallback: func(wrappers.CALLERROR) {
 			log.Error("Statusnotification NOT received by CSMS")
 		},
 	})
 }
+
+// Status of the connector of the EVSE, also kept in the AvailabilityState variables of the device model.
+// An ongoing transaction keeps the connector Occupied until a scheduled change to Inoperative is applied.
+func (cs *ChargingStation) connectorStatus(evse *evsemanager.EVSE) StatusNotificationRequest.ConnectorStatusEnumType_1 {
+	status := StatusNotificationRequest.ConnectorStatusEnumType_1_Available
+	switch {
+	case evse.IsError == 1:
+		status = StatusNotificationRequest.ConnectorStatusEnumType_1_Faulted
+	case !cs.isOperative(evse.Id):
+		status = StatusNotificationRequest.ConnectorStatusEnumType_1_Unavailable
+	case evse.IsEVConnected == 1 || cs.transactionOn(evse.Id) != nil:
+		status = StatusNotificationRequest.ConnectorStatusEnumType_1_Occupied
+	}
+
+	for _, component := range []devicemodel.Component{
+		{Name: "EVSE", EvseId: evse.Id},
+		{Name: "Connector", EvseId: evse.Id, ConnectorId: connectorId},
+	} {
+		if err := cs.DeviceModel.UpdateValue(component, devicemodel.Variable{Name: "AvailabilityState"}, devicemodel.Actual, string(status)); err != nil {
+			log.Error("device model: ", component, ".AvailabilityState: ", err)
+		}
+	}
+	return status
+}
@@ -0,0 +1,301 @@
+package chargingstation
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-charging-station-go/smartcharging"
+	"github.com/gregszalay/ocpp-charging-station-go/transactions"
+	"github.com/gregszalay/ocpp-messages-go/types/ClearChargingProfileRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/ClearChargingProfileResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/GetChargingProfilesRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/GetChargingProfilesResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/GetCompositeScheduleRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/GetCompositeScheduleResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/ReportChargingProfilesRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/SetChargingProfileRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/SetChargingProfileResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+func (cs *ChargingStation) smartChargingLimits() smartcharging.Limits {
+	max_entries, _ := cs.DeviceModel.GetMaxLimit(
+		devicemodel.Component{Name: "SmartChargingCtrlr"},
+		devicemodel.Variable{Name: "Entries", Instance: "ChargingProfiles"},
+	)
+	return smartcharging.Limits{
+		MaxStackLevel:      cs.DeviceModel.GetInt("SmartChargingCtrlr", "ProfileStackLevel"),
+		PeriodsPerSchedule: cs.DeviceModel.GetInt("SmartChargingCtrlr", "PeriodsPerSchedule"),
+		MaxEntries:         int(max_entries),
+		RateUnits:          cs.DeviceModel.GetString("SmartChargingCtrlr", "RateUnit"),
+	}
+}
+
+// Keeps SmartChargingCtrlr.Entries[ChargingProfiles] up to date
+func (cs *ChargingStation) updateProfileEntries() {
+	if err := cs.DeviceModel.UpdateValue(
+		devicemodel.Component{Name: "SmartChargingCtrlr"},
+		devicemodel.Variable{Name: "Entries", Instance: "ChargingProfiles"},
+		devicemodel.Actual,
+		strconv.Itoa(cs.SmartCharging.Count()),
+	); err != nil {
+		log.Error("device model: SmartChargingCtrlr.Entries: ", err)
+	}
+}
+
+// Power the EVSE can deliver without any charging profile, the sum of all EVSEs for EVSE 0
+func (cs *ChargingStation) maxPower(evseId int) float64 {
+	evse_ids := []int{evseId}
+	if evseId == 0 {
+		evse_ids = cs.sortedEvseIds()
+	}
+	total := 0.0
+	for _, id := range evse_ids {
+		power, _ := cs.DeviceModel.GetMaxLimit(devicemodel.Component{Name: "EVSE", EvseId: id}, devicemodel.Variable{Name: "Power"})
+		total += power
+	}
+	return total
+}
+
+// The ongoing transaction of the EVSE as the smart charging profiles see it, nil if there is none
+func (cs *ChargingStation) profileTransaction(evseId int) *smartcharging.Transaction {
+	tx := cs.transactionOn(evseId)
+	if tx == nil {
+		return nil
+	}
+	return &smartcharging.Transaction{Id: tx.Id, StartedAt: tx.StartedAt}
+}
+
+func rejectProfile(reasonCode string, additionalInfo string) SetChargingProfileResponse.SetChargingProfileResponseJson {
+	response := SetChargingProfileResponse.SetChargingProfileResponseJson{
+		Status:     SetChargingProfileResponse.ChargingProfileStatusEnumType_1_Rejected,
+		StatusInfo: &SetChargingProfileResponse.StatusInfoType{ReasonCode: reasonCode},
+	}
+	if additionalInfo != "" {
+		response.StatusInfo.AdditionalInfo = &additionalInfo
+	}
+	return response
+}
+
+// K01: installs a charging profile on an EVSE or on the whole Charging Station
+func (cs *ChargingStation) handleSetChargingProfile(req *SetChargingProfileRequest.SetChargingProfileRequestJson) (interface{}, error) {
+	if !cs.DeviceModel.GetBool("SmartChargingCtrlr", "Enabled") {
+		return rejectProfile("NotEnabled", ""), nil
+	}
+	if _, ok := cs.Evses[req.EvseId]; req.EvseId != 0 && !ok {
+		return rejectProfile("UnknownEvse", ""), nil
+	}
+	transaction_id := ""
+	if tx := cs.transactionOn(req.EvseId); req.EvseId != 0 && tx != nil {
+		transaction_id = tx.Id
+	}
+	if err := cs.installProfile(req.EvseId, req.ChargingProfile, transaction_id); err != nil {
+		return rejectProfile(err.ReasonCode, err.Description), nil
+	}
+	return SetChargingProfileResponse.SetChargingProfileResponseJson{
+		Status: SetChargingProfileResponse.ChargingProfileStatusEnumType_1_Accepted,
+	}, nil
+}
+
+func (cs *ChargingStation) installProfile(evseId int, profile smartcharging.ChargingProfile, transactionId string) *smartcharging.ValidationError {
+	if err := cs.SmartCharging.Validate(evseId, &profile, cs.smartChargingLimits(), transactionId); err != nil {
+		log.Warning("Charging profile ", profile.Id, " rejected: ", err)
+		return err.(*smartcharging.ValidationError)
+	}
+	cs.SmartCharging.Install(evseId, profile)
+	cs.updateProfileEntries()
+	cs.chargingLimitsChanged()
+	log.Info(profile.ChargingProfilePurpose, " ", profile.Id, " installed on EVSE ", evseId, " with stack level ", profile.StackLevel)
+	return nil
+}
+
+// F01.FR.08: the TxProfile of a RequestStartTransaction applies to the started transaction
+func (cs *ChargingStation) installRemoteStartProfile(evseId int, tx *transactions.Transaction, from interface{}) {
+	var profile smartcharging.ChargingProfile
+	if err := convert(from, &profile); err != nil {
+		log.Error("invalid charging profile in RequestStartTransaction: ", err)
+		return
+	}
+	profile.TransactionId = &tx.Id
+	cs.installProfile(evseId, profile, tx.Id)
+}
+
+// Removes the TxProfiles of a transaction that has ended
+func (cs *ChargingStation) clearTransactionProfiles(tx *transactions.Transaction) {
+	if cleared := cs.SmartCharging.ClearTransaction(tx.Id); len(cleared) > 0 {
+		log.Info(len(cleared), " TxProfiles of transaction ", tx.Id, " cleared")
+		cs.updateProfileEntries()
+		cs.chargingLimitsChanged()
+	}
+}
+
+// K10: clears a charging profile by id, or the profiles that match the criteria
+func (cs *ChargingStation) handleClearChargingProfile(req *ClearChargingProfileRequest.ClearChargingProfileRequestJson) (interface{}, error) {
+	cleared := cs.SmartCharging.Clear(func(profile smartcharging.Profile) bool {
+		if req.ChargingProfileId != nil {
+			return profile.ChargingProfile.Id == *req.ChargingProfileId
+		}
+		criteria := req.ChargingProfileCriteria
+		if criteria == nil {
+			return true
+		}
+		if criteria.EvseId != nil && profile.EvseId != *criteria.EvseId {
+			return false
+		}
+		if criteria.ChargingProfilePurpose != nil && string(profile.ChargingProfile.ChargingProfilePurpose) != string(*criteria.ChargingProfilePurpose) {
+			return false
+		}
+		return criteria.StackLevel == nil || profile.ChargingProfile.StackLevel == *criteria.StackLevel
+	})
+	if len(cleared) == 0 {
+		return ClearChargingProfileResponse.ClearChargingProfileResponseJson{
+			Status: ClearChargingProfileResponse.ClearChargingProfileStatusEnumType_1_Unknown,
+		}, nil
+	}
+	log.Info(len(cleared), " charging profiles cleared")
+	cs.updateProfileEntries()
+	cs.chargingLimitsChanged()
+	return ClearChargingProfileResponse.ClearChargingProfileResponseJson{
+		Status: ClearChargingProfileResponse.ClearChargingProfileStatusEnumType_1_Accepted,
+	}, nil
+}
+
+// K09: reports the installed profiles that match the criteria in ReportChargingProfiles messages, one per EVSE
+func (cs *ChargingStation) handleGetChargingProfiles(req *GetChargingProfilesRequest.GetChargingProfilesRequestJson) (interface{}, error) {
+	criteria := req.ChargingProfile
+	profiles := cs.SmartCharging.Profiles(func(profile smartcharging.Profile) bool {
+		if req.EvseId != nil && profile.EvseId != *req.EvseId {
+			return false
+		}
+		if criteria.ChargingProfilePurpose != nil && string(profile.ChargingProfile.ChargingProfilePurpose) != string(*criteria.ChargingProfilePurpose) {
+			return false
+		}
+		if criteria.StackLevel != nil && profile.ChargingProfile.StackLevel != *criteria.StackLevel {
+			return false
+		}
+		if len(criteria.ChargingProfileId) > 0 && !containsInt(criteria.ChargingProfileId, profile.ChargingProfile.Id) {
+			return false
+		}
+		// Every profile is set by the CSMS
+		if len(criteria.ChargingLimitSource) > 0 && !containsCSO(criteria.ChargingLimitSource) {
+			return false
+		}
+		return true
+	})
+	if len(profiles) == 0 {
+		return GetChargingProfilesResponse.GetChargingProfilesResponseJson{
+			Status: GetChargingProfilesResponse.GetChargingProfileStatusEnumType_1_NoProfiles,
+		}, nil
+	}
+	return ocppclient.FollowUp{
+		Payload: GetChargingProfilesResponse.GetChargingProfilesResponseJson{
+			Status: GetChargingProfilesResponse.GetChargingProfileStatusEnumType_1_Accepted,
+		},
+		Then: func() { cs.sendChargingProfiles(req.RequestId, profiles) },
+	}, nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCSO(sources []GetChargingProfilesRequest.ChargingLimitSourceEnumType_1) bool {
+	for _, source := range sources {
+		if source == GetChargingProfilesRequest.ChargingLimitSourceEnumType_1_CSO {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the profiles, which are ordered by EVSE, in one ReportChargingProfiles message per EVSE
+func (cs *ChargingStation) sendChargingProfiles(requestId int, profiles []smartcharging.Profile) {
+	groups := make([][]smartcharging.Profile, 0)
+	for i, profile := range profiles {
+		if i == 0 || profile.EvseId != profiles[i-1].EvseId {
+			groups = append(groups, make([]smartcharging.Profile, 0))
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], profile)
+	}
+
+	for i, group := range groups {
+		report := ReportChargingProfilesRequest.ReportChargingProfilesRequestJson{
+			RequestId:           requestId,
+			ChargingLimitSource: ReportChargingProfilesRequest.ChargingLimitSourceEnumType_1_CSO,
+			EvseId:              group[0].EvseId,
+			Tbc:                 i < len(groups)-1,
+		}
+		for _, profile := range group {
+			var reported ReportChargingProfilesRequest.ChargingProfileType
+			if err := convert(profile.ChargingProfile, &reported); err != nil {
+				log.Error("unable to report charging profile ", profile.ChargingProfile.Id, ": ", err)
+				continue
+			}
+			report.ChargingProfile = append(report.ChargingProfile, reported)
+		}
+		if _, err := cs.OcppClient.Call(context.Background(), "ReportChargingProfiles", report); err != nil {
+			log.Error("ReportChargingProfiles of request ", requestId, " failed, the rest of the profiles are not sent: ", err)
+			return
+		}
+	}
+	log.Info("Charging profiles of request ", requestId, " sent in ", len(groups), " ReportChargingProfiles messages")
+}
+
+// K08: calculates the limits of an EVSE for the requested duration from now
+func (cs *ChargingStation) handleGetCompositeSchedule(req *GetCompositeScheduleRequest.GetCompositeScheduleRequestJson) (interface{}, error) {
+	if _, ok := cs.Evses[req.EvseId]; req.EvseId != 0 && !ok {
+		return GetCompositeScheduleResponse.GetCompositeScheduleResponseJson{
+			Status:     GetCompositeScheduleResponse.GenericStatusEnumType_1_Rejected,
+			StatusInfo: &GetCompositeScheduleResponse.StatusInfoType{ReasonCode: "UnknownEvse"},
+		}, nil
+	}
+	unit := smartcharging.Amperes
+	if req.ChargingRateUnit != nil {
+		unit = smartcharging.RateUnit(*req.ChargingRateUnit)
+	}
+	if !cs.smartChargingLimits().SupportsUnit(unit) {
+		return GetCompositeScheduleResponse.GetCompositeScheduleResponseJson{
+			Status:     GetCompositeScheduleResponse.GenericStatusEnumType_1_Rejected,
+			StatusInfo: &GetCompositeScheduleResponse.StatusInfoType{ReasonCode: "UnsupportedRateUnit"},
+		}, nil
+	}
+
+	var tx *smartcharging.Transaction
+	if req.EvseId != 0 {
+		tx = cs.profileTransaction(req.EvseId)
+	}
+	composite := cs.SmartCharging.CompositeSchedule(
+		req.EvseId,
+		time.Now(),
+		time.Duration(req.Duration)*time.Second,
+		unit,
+		tx,
+		cs.maxPower(req.EvseId),
+	)
+
+	schedule := &GetCompositeScheduleResponse.CompositeScheduleType{
+		EvseId:           composite.EvseId,
+		Duration:         composite.Duration,
+		ScheduleStart:    composite.ScheduleStart.UTC().Format(time.RFC3339),
+		ChargingRateUnit: GetCompositeScheduleResponse.ChargingRateUnitEnumType_1(composite.RateUnit),
+	}
+	for _, period := range composite.Periods {
+		schedule.ChargingSchedulePeriod = append(schedule.ChargingSchedulePeriod, GetCompositeScheduleResponse.ChargingSchedulePeriodType{
+			StartPeriod:  period.StartPeriod,
+			Limit:        period.Limit,
+			NumberPhases: period.NumberPhases,
+		})
+	}
+	return GetCompositeScheduleResponse.GetCompositeScheduleResponseJson{
+		Status:   GetCompositeScheduleResponse.GenericStatusEnumType_1_Accepted,
+		Schedule: schedule,
+	}, nil
+}
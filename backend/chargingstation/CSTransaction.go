@@ -1,7 +1,7 @@
 package chargingstation
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"os/signal"
 	"time"
@@ -9,137 +9,364 @@ import (
 	"github.com/gregszalay/ocpp-charging-station-go/evsemanager"
 	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
 	"github.com/gregszalay/ocpp-charging-station-go/transactions"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeRequest"
 	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventRequest"
-	"github.com/gregszalay/ocpp-messages-go/wrappers"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventResponse"
 	log "github.com/sirupsen/logrus"
 )
 
+// Queues a TransactionEventRequest for the transaction. Events are sent in the order they are queued,
+// the transaction stays locked from numbering the event until it is queued.
+func (cs *ChargingStation) sendTransactionEvent(
+	tx *transactions.Transaction,
+	eventType TransactionEventRequest.TransactionEventEnumType_1,
+	triggerReason TransactionEventRequest.TriggerReasonEnumType_1,
+) (*ocppclient.PendingCall, error) {
+	tx.Lock()
+	defer tx.Unlock()
+	// The CSMS answers with an idTokenInfo to the event that carries the idToken
+	carries_id_token := tx.IdToken != nil && !tx.IdTokenSent
+	// Events queued while offline are sent when the connection is back
+	offline := !cs.OcppClient.IsConnected()
+	tx_event_req, _ := tx.MakeTransactionEventReq(eventType, triggerReason, offline)
+	if eventType == TransactionEventRequest.TransactionEventEnumType_1_Ended {
+		cs.deleteTransaction(tx)
+		cs.clearTransactionProfiles(tx)
+	} else {
+		cs.saveTransaction(tx)
+	}
+	pending, err := cs.OcppClient.CallAsync("TransactionEvent", tx_event_req.Payload)
+	if err != nil {
+		return nil, err
+	}
+	go cs.processTransactionEventResponse(tx, pending, carries_id_token)
+	return pending, nil
+}
+
+// What the CSMS sent for the driver of the last transaction on an EVSE, shown on the display
+type driverInfo struct {
+	TotalCost       *float64
+	PersonalMessage string
+}
+
+func (cs *ChargingStation) driverInfoOf(evseId int) driverInfo {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.driver_info[evseId]
+}
+
+func (cs *ChargingStation) updateDriverInfo(evseId int, update func(info *driverInfo)) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	info := cs.driver_info[evseId]
+	update(&info)
+	cs.driver_info[evseId] = info
+}
+
+func (cs *ChargingStation) processTransactionEventResponse(tx *transactions.Transaction, pending *ocppclient.PendingCall, carriesIdToken bool) {
+	response, err := pending.Wait(context.Background())
+	if err != nil {
+		return // reported by the sender
+	}
+	resp := response.(*TransactionEventResponse.TransactionEventResponseJson)
+	if resp.TotalCost != nil {
+		log.Info("Total cost of transaction ", tx.Id, ": ", *resp.TotalCost, " ", cs.DeviceModel.GetString("TariffCostCtrlr", "Currency"))
+	}
+	if resp.UpdatedPersonalMessage != nil {
+		log.Info("Personal message for transaction ", tx.Id, ": ", resp.UpdatedPersonalMessage.Content)
+	}
+	if tx.Evse != nil && (resp.TotalCost != nil || resp.UpdatedPersonalMessage != nil) {
+		cs.updateDriverInfo(tx.Evse.Id, func(info *driverInfo) {
+			// I02: the running cost while charging, the final cost in the response to the Ended event
+			if resp.TotalCost != nil {
+				info.TotalCost = resp.TotalCost
+			}
+			if resp.UpdatedPersonalMessage != nil {
+				info.PersonalMessage = resp.UpdatedPersonalMessage.Content
+			}
+		})
+	}
+	if carriesIdToken && resp.IdTokenInfo != nil {
+		cs.processIdTokenInfo(tx, *resp.IdTokenInfo)
+	}
+}
+
+// C15: the CSMS tells in the response whether the idToken of the transaction is valid,
+// it may reject an idToken that was authorized offline
+func (cs *ChargingStation) processIdTokenInfo(tx *transactions.Transaction, idTokenInfo TransactionEventResponse.IdTokenInfoType) {
+	// C10: the cache follows the CSMS, a status other than Accepted invalidates the cached idToken
+	cs.cacheIdTokenInfo(*tx.IdToken, idTokenInfo)
+	if idTokenInfo.Status != TransactionEventResponse.AuthorizationStatusEnumType_1_Accepted {
+		log.Warning("CSMS rejected the idToken of transaction ", tx.Id, ": ", idTokenInfo.Status)
+		cs.deauthorizeTransaction(tx)
+	}
+}
+
+// E05: stops charging if StopTxOnInvalidId is set, otherwise after MaxEnergyOnInvalidId was delivered
+func (cs *ChargingStation) deauthorizeTransaction(tx *transactions.Transaction) {
+	if !tx.IsInProgress || tx.Evse == nil || cs.transactionOn(tx.Evse.Id) != tx {
+		return
+	}
+	if cs.DeviceModel.GetBool("TxCtrlr", "StopTxOnInvalidId") {
+		cs.finishTransaction(
+			tx.Evse,
+			tx,
+			TransactionEventRequest.TriggerReasonEnumType_1_Deauthorized,
+			TransactionEventRequest.ReasonEnumType_1_DeAuthorized,
+		)
+		return
+	}
+	go cs.limitEnergyOnInvalidId(tx)
+}
+
+// The energy meter of the EVSE counts the energy of the ongoing charging session
+func (cs *ChargingStation) limitEnergyOnInvalidId(tx *transactions.Transaction) {
+	max_energy := int64(cs.DeviceModel.GetInt("TxCtrlr", "MaxEnergyOnInvalidId"))
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for tx.Evse.EnergyActiveNet_wh < max_energy {
+		select {
+		case <-ticker.C:
+			if !tx.IsInProgress {
+				return
+			}
+		case <-cs.stopped:
+			return
+		}
+	}
+	log.Warning("MaxEnergyOnInvalidId delivered, charging suspended for transaction ", tx.Id)
+	tx.Evse.DisableCharging()
+	// ==> TXEventReq: Updated, Deauthorized
+	if _, err := cs.sendTransactionEvent(
+		tx,
+		TransactionEventRequest.TransactionEventEnumType_1_Updated,
+		TransactionEventRequest.TriggerReasonEnumType_1_Deauthorized,
+	); err != nil {
+		log.Error("TransactionEventReq NOT sent: ", err)
+	}
+}
+
+// idToken of the TransactionEvents, converted from the idToken of another message
+func transactionIdToken(idToken interface{}) *TransactionEventRequest.IdTokenType {
+	var result TransactionEventRequest.IdTokenType
+	if err := convert(idToken, &result); err != nil {
+		log.Error("invalid idToken: ", err)
+		return nil
+	}
+	return &result
+}
+
+func (cs *ChargingStation) transactionOn(evseId int) *transactions.Transaction {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.EVSEIdsToTxsMap[evseId]
+}
+
+func (cs *ChargingStation) setTransaction(evseId int, tx *transactions.Transaction) {
+	cs.mu.Lock()
+	cs.EVSEIdsToTxsMap[evseId] = tx
+	// The cost and message of the previous transaction are no longer shown
+	delete(cs.driver_info, evseId)
+	cs.mu.Unlock()
+	// TxProfiles and Relative profiles depend on the transaction
+	cs.chargingLimitsChanged()
+}
+
+func (cs *ChargingStation) removeTransaction(evseId int) {
+	cs.mu.Lock()
+	delete(cs.EVSEIdsToTxsMap, evseId)
+	cs.mu.Unlock()
+	// The priority of the idToken group ends with the transaction
+	cs.LoadManager.SetPriority(evseId, 0)
+	cs.chargingLimitsChanged()
+}
+
+// Transactions that have not ended yet, by EVSE id
+func (cs *ChargingStation) activeTransactions() map[int]*transactions.Transaction {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	result := make(map[int]*transactions.Transaction, len(cs.EVSEIdsToTxsMap))
+	for evseId, tx := range cs.EVSEIdsToTxsMap {
+		result[evseId] = tx
+	}
+	return result
+}
+
+// Runs what was scheduled until the transaction on the EVSE ended
+func (cs *ChargingStation) onTransactionEnded(evseId int) {
+	cs.runScheduledAvailabilityChanges(evseId)
+	cs.runScheduledResets(evseId)
+}
+
 // Starting transaction - E02 - Cable Plugin First
 func (cs *ChargingStation) StartTransaction(evse *evsemanager.EVSE) (*transactions.Transaction, error) {
 
 	tx_new, _ := transactions.CreateTransaction(evse)
 
 	// ==> TXEventReq: Started, CablePluggedIn
-	tx_event_req, _ := tx_new.MakeTransactionEventReq(
+	pending, err := cs.sendTransactionEvent(
+		tx_new,
 		TransactionEventRequest.TransactionEventEnumType_1_Started,
 		TransactionEventRequest.TriggerReasonEnumType_1_CablePluggedIn,
 	)
-	cs.OcppClient.Send(ocppclient.AsyncOcppCall{
-		Message: tx_event_req,
-		SuccessCallback: func(callresult wrappers.CALLRESULT) {
-			fmt.Println("TransactionEventReq received by CSMS")
-		},
-		ErrorCallback: func(wrappers.CALLERROR) {
-			log.Error("TransactionEventReq NOT received by CSMS")
-		},
-	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if _, err := pending.Wait(context.Background()); err != nil {
+			log.Error("TransactionEventReq NOT received by CSMS: ", err)
+			return
+		}
+		log.Debug("TransactionEventReq received by CSMS")
+	}()
 
 	return tx_new, nil
 }
 
-func (cs *ChargingStation) AuthorizeTransaction(tx *transactions.Transaction, evse *evsemanager.EVSE, rfid string) {
+func (cs *ChargingStation) AuthorizeTransaction(tx *transactions.Transaction, evse *evsemanager.EVSE, idToken AuthorizeRequest.IdTokenType) {
+	go func() {
+		ctx := context.Background()
 
-	// Read RFID string from std input. Send AuthorizeRequest to CSMS
-	cs.authorizeWithRFID(
-		rfid,
-		func() {
-			evse.EnableCharging()
-			tx.IsInProgress = true
-			// ==> TXEventReq: Updated, Authorized
-			tx_event_req, _ := tx.MakeTransactionEventReq(
-				TransactionEventRequest.TransactionEventEnumType_1_Updated,
-				TransactionEventRequest.TriggerReasonEnumType_1_Authorized,
-			)
-			cs.OcppClient.Send(ocppclient.AsyncOcppCall{
-				Message: tx_event_req,
-				SuccessCallback: func(callresult wrappers.CALLRESULT) {
-					fmt.Println("TransactionEventReq received by CSMS")
-				},
-				ErrorCallback: func(wrappers.CALLERROR) {
-					log.Error("TransactionEventReq NOT received by CSMS")
-				}})
-
-		}, func() {
+		// Send AuthorizeRequest to CSMS
+		id_token_info, ok := cs.authorizeIdToken(ctx, idToken)
+		if !ok {
 			log.Error("Authorization failed")
-		})
+			return
+		}
+		tx.Lock()
+		tx.IdToken = transactionIdToken(idToken)
+		tx.IsInProgress = true
+		tx.Unlock()
+		if id_token_info.GroupIdToken != nil {
+			cs.prioritizeGroup(evse.Id, id_token_info.GroupIdToken.IdToken)
+		}
+		evse.EnableCharging()
 
-	go func() {
-		// TX update job
-		interrupt := make(chan os.Signal, 1)
-		signal.Notify(interrupt, os.Interrupt)
-		ticker_status := time.NewTicker(time.Second * 5)
-		defer ticker_status.Stop()
-		for {
-			select {
-			case t := <-ticker_status.C:
-				_ = t
-				if tx.IsInProgress == false {
-					return
-				} else {
-
-					// ==> TXEventReq: Updated, ChargingStateChanged
-					tx_event_req, _ := tx.MakeTransactionEventReq(
-						TransactionEventRequest.TransactionEventEnumType_1_Updated,
-						TransactionEventRequest.TriggerReasonEnumType_1_ChargingStateChanged,
-					)
-					cs.OcppClient.Send(ocppclient.AsyncOcppCall{
-						Message: tx_event_req,
-						SuccessCallback: func(callresult wrappers.CALLRESULT) {
-							fmt.Println("TransactionEventReq received by CSMS")
-						},
-						ErrorCallback: func(wrappers.CALLERROR) {
-							log.Error("TransactionEventReq NOT received by CSMS")
-						}})
-				}
-			case <-interrupt:
+		// ==> TXEventReq: Updated, Authorized. Not awaited, the updates run while the CSMS is offline too
+		if _, err := cs.sendTransactionEvent(
+			tx,
+			TransactionEventRequest.TransactionEventEnumType_1_Updated,
+			TransactionEventRequest.TriggerReasonEnumType_1_Authorized,
+		); err != nil {
+			log.Error("TransactionEventReq NOT sent: ", err)
+		}
+
+		cs.runTransactionUpdates(tx)
+	}()
+}
+
+// TX update job, runs until the transaction is no longer in progress
+func (cs *ChargingStation) runTransactionUpdates(tx *transactions.Transaction) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	interval := cs.txUpdatedInterval()
+	if interval <= 0 {
+		return // no periodic updates
+	}
+	ticker_status := time.NewTicker(interval)
+	defer ticker_status.Stop()
+	for {
+		select {
+		case <-ticker_status.C:
+			if !tx.IsInProgress {
+				return
+			}
+			if current := cs.txUpdatedInterval(); current <= 0 {
 				return
-			default:
+			} else if current != interval {
+				interval = current
+				ticker_status.Reset(interval)
+			}
+			// ==> TXEventReq: Updated, ChargingStateChanged or MeterValuePeriodic
+			trigger_reason := TransactionEventRequest.TriggerReasonEnumType_1_MeterValuePeriodic
+			tx.Lock()
+			if tx.ChargingStateChanged() {
+				trigger_reason = TransactionEventRequest.TriggerReasonEnumType_1_ChargingStateChanged
 			}
+			tx.Unlock()
+			if _, err := cs.sendTransactionEvent(
+				tx,
+				TransactionEventRequest.TransactionEventEnumType_1_Updated,
+				trigger_reason,
+			); err != nil {
+				log.Error("TransactionEventReq NOT sent: ", err)
+			}
+		case <-interrupt:
+			return
+		case <-cs.stopped:
+			return
 		}
-	}()
+	}
 }
 
-func (cs *ChargingStation) EndTransaction(evse *evsemanager.EVSE, tx *transactions.Transaction, rfid string) {
+func (cs *ChargingStation) EndTransaction(evse *evsemanager.EVSE, tx *transactions.Transaction, idToken AuthorizeRequest.IdTokenType) {
+	go func() {
+		ctx := context.Background()
 
-	// ==> AuthorizeReq. Read RFID string from std input. Send AuthorizeRequest to CSMS
-	cs.authorizeWithRFID(
-		rfid,
-		func() { // Auth success:
-			evse.DisableCharging()
-			// ==> TXEventReq: Updated, StopAuthorized. Notify the CSMS that the driver is authorized to stop the Transaction
-			tx_event_req, _ := tx.MakeTransactionEventReq(
-				TransactionEventRequest.TransactionEventEnumType_1_Updated,
-				TransactionEventRequest.TriggerReasonEnumType_1_StopAuthorized,
-			)
-			cs.OcppClient.Send(ocppclient.AsyncOcppCall{
-				Message: tx_event_req,
-				SuccessCallback: func(callresult wrappers.CALLRESULT) {
-					fmt.Println("TransactionEventReq received by CSMS")
-					// Set the callback to fire when the EV plug disconnected by the driver
-					evse.OnEVDisconnected_fire_once = func() {
-						// ==> TXEventReq: Updated, StopAuthorized. Notify the CSMS that the Transaction has ended
-						tx_event_req, _ := tx.MakeTransactionEventReq(
-							TransactionEventRequest.TransactionEventEnumType_1_Ended,
-							TransactionEventRequest.TriggerReasonEnumType_1_EVCommunicationLost,
-						)
-						cs.OcppClient.Send(ocppclient.AsyncOcppCall{
-							Message: tx_event_req,
-							SuccessCallback: func(callresult wrappers.CALLRESULT) {
-								fmt.Println("TransactionEventReq received by CSMS")
-								// ==> SendStatusNotificationReq. Notify the CSMS that the EVSE is available again
-								cs.SendStatusNotification(evse)
-								tx.IsInProgress = false
-							},
-							ErrorCallback: func(wrappers.CALLERROR) {
-								log.Error("TransactionEventReq NOT received by CSMS")
-							}})
-					}
-				},
-				ErrorCallback: func(wrappers.CALLERROR) {
-					log.Error("TransactionEventReq NOT received by CSMS")
-				}})
-		},
-		func() { // Auth failed:
+		// ==> AuthorizeReq. Send AuthorizeRequest to CSMS
+		if !cs.isIdTokenAuthorized(ctx, idToken) {
 			log.Error("Authorization failed")
-		})
+			return
+		}
+
+		// Notify the CSMS that the driver is authorized to stop the Transaction
+		cs.finishTransaction(
+			evse,
+			tx,
+			TransactionEventRequest.TriggerReasonEnumType_1_StopAuthorized,
+			TransactionEventRequest.ReasonEnumType_1_Local,
+		)
+	}()
+}
+
+// Stops charging and ends the transaction when the EV is unplugged, or right away if no EV is plugged in.
+// The events are not awaited, E04: the offline queue delivers them once the CSMS can be reached.
+func (cs *ChargingStation) finishTransaction(
+	evse *evsemanager.EVSE,
+	tx *transactions.Transaction,
+	triggerReason TransactionEventRequest.TriggerReasonEnumType_1,
+	stoppedReason TransactionEventRequest.ReasonEnumType_1,
+) {
+	evse.DisableCharging()
+
+	end := func(triggerReason TransactionEventRequest.TriggerReasonEnumType_1) {
+		tx.Lock()
+		tx.StoppedReason = &stoppedReason
+		tx.Unlock()
+		// ==> TXEventReq: Ended. Notify the CSMS that the Transaction has ended
+		if _, err := cs.sendTransactionEvent(
+			tx,
+			TransactionEventRequest.TransactionEventEnumType_1_Ended,
+			triggerReason,
+		); err != nil {
+			log.Error("TransactionEventReq NOT sent: ", err)
+		}
+		// The transaction is over locally, whether or not the CSMS has received the event yet
+		tx.Lock()
+		tx.IsInProgress = false
+		tx.Unlock()
+		cs.removeTransaction(evse.Id)
+		// ==> SendStatusNotificationReq. Notify the CSMS that the EVSE is available again
+		cs.SendStatusNotification(evse)
+		cs.onTransactionEnded(evse.Id)
+	}
+
+	if evse.IsEVConnected == 0 {
+		end(triggerReason)
+		return
+	}
+
+	// ==> TXEventReq: Updated
+	if _, err := cs.sendTransactionEvent(
+		tx,
+		TransactionEventRequest.TransactionEventEnumType_1_Updated,
+		triggerReason,
+	); err != nil {
+		log.Error("TransactionEventReq NOT sent: ", err)
+	}
+
+	// Set the callback to fire when the EV plug disconnected by the driver
+	evse.OnEVDisconnected_fire_once = func() {
+		go end(TransactionEventRequest.TriggerReasonEnumType_1_EVCommunicationLost)
+	}
 }
@@ -0,0 +1,160 @@
+package chargingstation
+
+import (
+	"context"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/evsemanager"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-messages-go/types/FirmwareStatusNotificationRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/LogStatusNotificationRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/MeterValuesRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/SignCertificateRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/TriggerMessageRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/TriggerMessageResponse"
+	log "github.com/sirupsen/logrus"
+)
+
+func rejectTrigger(reasonCode string) TriggerMessageResponse.TriggerMessageResponseJson {
+	return TriggerMessageResponse.TriggerMessageResponseJson{
+		Status:     TriggerMessageResponse.TriggerMessageStatusEnumType_1_Rejected,
+		StatusInfo: &TriggerMessageResponse.StatusInfoType{ReasonCode: reasonCode},
+	}
+}
+
+// F06: sends the requested message after the TriggerMessageResponse, for the given EVSE or for all of them
+func (cs *ChargingStation) handleTriggerMessage(req *TriggerMessageRequest.TriggerMessageRequestJson) (interface{}, error) {
+	evses := make([]*evsemanager.EVSE, 0)
+	if req.Evse != nil && req.Evse.Id != 0 {
+		evse, ok := cs.Evses[req.Evse.Id]
+		if !ok {
+			return rejectTrigger("UnknownEvse"), nil
+		}
+		evses = append(evses, evse)
+	} else {
+		for _, id := range cs.sortedEvseIds() {
+			evses = append(evses, cs.Evses[id])
+		}
+	}
+	ctx := context.Background()
+
+	var send func()
+	switch req.RequestedMessage {
+	case TriggerMessageRequest.MessageTriggerEnumType_1_BootNotification:
+		// F06.FR.17: there is no reason to boot again once accepted
+		if cs.isAccepted() {
+			return rejectTrigger("AlreadyAccepted"), nil
+		}
+		send = cs.triggerBoot
+	case TriggerMessageRequest.MessageTriggerEnumType_1_Heartbeat:
+		send = func() { cs.SendHeartbeat(ctx) }
+	case TriggerMessageRequest.MessageTriggerEnumType_1_StatusNotification:
+		send = func() {
+			for _, evse := range evses {
+				cs.sendStatusNotification(evse)
+			}
+		}
+	case TriggerMessageRequest.MessageTriggerEnumType_1_MeterValues:
+		send = func() {
+			for _, evse := range evses {
+				cs.sendMeterValues(ctx, evse, MeterValuesRequest.ReadingContextEnumTypeTrigger)
+			}
+		}
+	case TriggerMessageRequest.MessageTriggerEnumType_1_TransactionEvent:
+		txs := make([]func(), 0)
+		for _, evse := range evses {
+			if tx := cs.transactionOn(evse.Id); tx != nil {
+				txs = append(txs, func() {
+					// ==> TXEventReq: Updated, Trigger
+					if _, err := cs.sendTransactionEvent(
+						tx,
+						TransactionEventRequest.TransactionEventEnumType_1_Updated,
+						TransactionEventRequest.TriggerReasonEnumType_1_Trigger,
+					); err != nil {
+						log.Error("TransactionEventReq NOT sent: ", err)
+					}
+				})
+			}
+		}
+		if len(txs) == 0 {
+			return rejectTrigger("NoTransaction"), nil
+		}
+		send = func() {
+			for _, send_tx := range txs {
+				send_tx()
+			}
+		}
+	case TriggerMessageRequest.MessageTriggerEnumType_1_FirmwareStatusNotification:
+		send = func() { cs.sendFirmwareStatusNotification(ctx) }
+	case TriggerMessageRequest.MessageTriggerEnumType_1_LogStatusNotification:
+		send = func() { cs.sendLogStatusNotification(ctx) }
+	case TriggerMessageRequest.MessageTriggerEnumType_1_SignV2GCertificate:
+		send = func() {
+			if err := cs.sendSignCertificate(ctx, SignCertificateRequest.CertificateSigningUseEnumType_1_V2GCertificate); err != nil {
+				log.Error("SignCertificate failed: ", err)
+			}
+		}
+	default:
+		return TriggerMessageResponse.TriggerMessageResponseJson{
+			Status: TriggerMessageResponse.TriggerMessageStatusEnumType_1_NotImplemented,
+		}, nil
+	}
+
+	log.Info("TriggerMessage accepted for ", req.RequestedMessage)
+	return ocppclient.FollowUp{
+		Payload: TriggerMessageResponse.TriggerMessageResponseJson{
+			Status: TriggerMessageResponse.TriggerMessageStatusEnumType_1_Accepted,
+		},
+		Then: send,
+	}, nil
+}
+
+// Sends the current meter readings of the EVSE
+func (cs *ChargingStation) sendMeterValues(ctx context.Context, evse *evsemanager.EVSE, readingContext MeterValuesRequest.ReadingContextEnumType) {
+	energy_active_net_type := MeterValuesRequest.MeasurandEnumType_1_EnergyActiveNet
+	power_active_import_type := MeterValuesRequest.MeasurandEnumType_1_PowerActiveImport
+	meterValuesRequest := MeterValuesRequest.MeterValuesRequestJson{
+		EvseId: evse.Id,
+		MeterValue: []MeterValuesRequest.MeterValueType{
+			{
+				SampledValue: []MeterValuesRequest.SampledValueType{
+					{
+						Context:       &readingContext,
+						Measurand:     &energy_active_net_type,
+						UnitOfMeasure: &MeterValuesRequest.UnitOfMeasureType{Unit: "Wh"},
+						Value:         float64(evse.EnergyActiveNet_wh),
+					},
+					{
+						Context:       &readingContext,
+						Measurand:     &power_active_import_type,
+						UnitOfMeasure: &MeterValuesRequest.UnitOfMeasureType{Unit: "W"},
+						Value:         float64(evse.PowerActiveImport_w),
+					},
+				},
+				Timestamp: time.Now().Format(time.RFC3339),
+			},
+		},
+	}
+	if _, err := cs.OcppClient.Call(ctx, "MeterValues", meterValuesRequest); err != nil {
+		log.Error("MeterValues NOT received by CSMS: ", err)
+	}
+}
+
+// Firmware updates are not supported, the firmware status is always Idle
+func (cs *ChargingStation) sendFirmwareStatusNotification(ctx context.Context) {
+	if _, err := cs.OcppClient.Call(ctx, "FirmwareStatusNotification", FirmwareStatusNotificationRequest.FirmwareStatusNotificationRequestJson{
+		Status: FirmwareStatusNotificationRequest.FirmwareStatusEnumType_1_Idle,
+	}); err != nil {
+		log.Error("FirmwareStatusNotification NOT received by CSMS: ", err)
+	}
+}
+
+// Log uploads are not supported, the upload status is always Idle
+func (cs *ChargingStation) sendLogStatusNotification(ctx context.Context) {
+	if _, err := cs.OcppClient.Call(ctx, "LogStatusNotification", LogStatusNotificationRequest.LogStatusNotificationRequestJson{
+		Status: LogStatusNotificationRequest.UploadLogStatusEnumType_1_Idle,
+	}); err != nil {
+		log.Error("LogStatusNotification NOT received by CSMS: ", err)
+	}
+}
@@ -0,0 +1,218 @@
+package chargingstation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-messages-go/types/GetVariablesRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/GetVariablesResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/SetVariablesRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/SetVariablesResponse"
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Component as it appears in the OCPP messages. Every message package defines its own ComponentType,
+// they are converted to this one through their JSON form.
+type ocppComponent struct {
+	Name     string    `json:"name"`
+	Instance *string   `json:"instance,omitempty"`
+	Evse     *ocppEVSE `json:"evse,omitempty"`
+}
+
+type ocppEVSE struct {
+	Id          int  `json:"id"`
+	ConnectorId *int `json:"connectorId,omitempty"`
+}
+
+type ocppVariable struct {
+	Name     string  `json:"name"`
+	Instance *string `json:"instance,omitempty"`
+}
+
+// Converts between the identical types of different message packages, e.g. a request and a response ComponentType
+func convert(from interface{}, to interface{}) error {
+	bytes, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, to)
+}
+
+func toDeviceModel(from_component interface{}, from_variable interface{}) (devicemodel.Component, devicemodel.Variable, error) {
+	var component ocppComponent
+	var variable ocppVariable
+	if err := convert(from_component, &component); err != nil {
+		return devicemodel.Component{}, devicemodel.Variable{}, err
+	}
+	if err := convert(from_variable, &variable); err != nil {
+		return devicemodel.Component{}, devicemodel.Variable{}, err
+	}
+	result_component := devicemodel.Component{Name: component.Name}
+	if component.Instance != nil {
+		result_component.Instance = *component.Instance
+	}
+	if component.Evse != nil {
+		result_component.EvseId = component.Evse.Id
+		if component.Evse.ConnectorId != nil {
+			result_component.ConnectorId = *component.Evse.ConnectorId
+		}
+	}
+	result_variable := devicemodel.Variable{Name: variable.Name}
+	if variable.Instance != nil {
+		result_variable.Instance = *variable.Instance
+	}
+	return result_component, result_variable, nil
+}
+
+func fromDeviceModel(component devicemodel.Component, variable devicemodel.Variable) (ocppComponent, ocppVariable) {
+	result_component := ocppComponent{Name: component.Name}
+	if component.Instance != "" {
+		instance := component.Instance
+		result_component.Instance = &instance
+	}
+	if component.EvseId != 0 {
+		result_component.Evse = &ocppEVSE{Id: component.EvseId}
+		if component.ConnectorId != 0 {
+			connectorId := component.ConnectorId
+			result_component.Evse.ConnectorId = &connectorId
+		}
+	}
+	result_variable := ocppVariable{Name: variable.Name}
+	if variable.Instance != "" {
+		instance := variable.Instance
+		result_variable.Instance = &instance
+	}
+	return result_component, result_variable
+}
+
+// Rejects requests with more items than DeviceDataCtrlr.ItemsPerMessage allows for the action
+func (cs *ChargingStation) checkItemsPerMessage(action string, items int) error {
+	limit := cs.DeviceModel.GetInstanceInt("DeviceDataCtrlr", "ItemsPerMessage", action)
+	if limit > 0 && items > limit {
+		return &ocppclient.CallError{
+			ErrorCode:        string(wrappers.OccurrenceConstraintViolation),
+			ErrorDescription: fmt.Sprintf("%s contains %d items, at most %d are allowed", action, items, limit),
+		}
+	}
+	return nil
+}
+
+func (cs *ChargingStation) handleSetVariables(req *SetVariablesRequest.SetVariablesRequestJson) (interface{}, error) {
+	if err := cs.checkItemsPerMessage("SetVariables", len(req.SetVariableData)); err != nil {
+		return nil, err
+	}
+	results := make([]SetVariablesResponse.SetVariableResultType, 0, len(req.SetVariableData))
+	for _, data := range req.SetVariableData {
+		attribute_type := SetVariablesRequest.AttributeEnumType_1_Actual
+		if data.AttributeType != nil {
+			attribute_type = *data.AttributeType
+		}
+		result := SetVariablesResponse.SetVariableResultType{
+			AttributeType: (*SetVariablesResponse.AttributeEnumType_1)(&attribute_type),
+		}
+		convert(data.Component, &result.Component)
+		convert(data.Variable, &result.Variable)
+
+		component, variable, err := toDeviceModel(data.Component, data.Variable)
+		reboot_required := false
+		if err == nil {
+			reboot_required, err = cs.DeviceModel.SetValue(component, variable, devicemodel.AttributeEnumType(attribute_type), data.AttributeValue)
+		}
+		switch {
+		case errors.Is(err, devicemodel.ErrUnknownComponent):
+			result.AttributeStatus = SetVariablesResponse.SetVariableStatusEnumTypeUnknownComponent
+		case errors.Is(err, devicemodel.ErrUnknownVariable):
+			result.AttributeStatus = SetVariablesResponse.SetVariableStatusEnumTypeUnknownVariable
+		case errors.Is(err, devicemodel.ErrNotSupportedAttributeType):
+			result.AttributeStatus = SetVariablesResponse.SetVariableStatusEnumTypeNotSupportedAttributeType
+		case err != nil:
+			result.AttributeStatus = SetVariablesResponse.SetVariableStatusEnumTypeRejected
+			result.AttributeStatusInfo = setVariableStatusInfo(err)
+		case reboot_required:
+			result.AttributeStatus = SetVariablesResponse.SetVariableStatusEnumTypeRebootRequired
+		default:
+			result.AttributeStatus = SetVariablesResponse.SetVariableStatusEnumTypeAccepted
+		}
+		log.Info("SetVariables ", component, ".", variable.Name, " = ", data.AttributeValue, ": ", result.AttributeStatus)
+		results = append(results, result)
+	}
+	return SetVariablesResponse.SetVariablesResponseJson{SetVariableResult: results}, nil
+}
+
+func setVariableStatusInfo(err error) *SetVariablesResponse.StatusInfoType {
+	reason_code := "InvalidValue"
+	if errors.Is(err, devicemodel.ErrReadOnly) {
+		reason_code = "ReadOnly"
+	}
+	additional_info := err.Error()
+	return &SetVariablesResponse.StatusInfoType{ReasonCode: reason_code, AdditionalInfo: &additional_info}
+}
+
+func (cs *ChargingStation) handleGetVariables(req *GetVariablesRequest.GetVariablesRequestJson) (interface{}, error) {
+	if err := cs.checkItemsPerMessage("GetVariables", len(req.GetVariableData)); err != nil {
+		return nil, err
+	}
+	results := make([]GetVariablesResponse.GetVariableResultType, 0, len(req.GetVariableData))
+	for _, data := range req.GetVariableData {
+		attribute_type := GetVariablesRequest.AttributeEnumType_1_Actual
+		if data.AttributeType != nil {
+			attribute_type = *data.AttributeType
+		}
+		result := GetVariablesResponse.GetVariableResultType{
+			AttributeType: (*GetVariablesResponse.AttributeEnumType_1)(&attribute_type),
+		}
+		convert(data.Component, &result.Component)
+		convert(data.Variable, &result.Variable)
+
+		component, variable, err := toDeviceModel(data.Component, data.Variable)
+		value := ""
+		if err == nil {
+			value, err = cs.DeviceModel.GetValue(component, variable, devicemodel.AttributeEnumType(attribute_type))
+		}
+		switch {
+		case errors.Is(err, devicemodel.ErrUnknownComponent):
+			result.AttributeStatus = GetVariablesResponse.GetVariableStatusEnumTypeUnknownComponent
+		case errors.Is(err, devicemodel.ErrUnknownVariable):
+			result.AttributeStatus = GetVariablesResponse.GetVariableStatusEnumTypeUnknownVariable
+		case errors.Is(err, devicemodel.ErrNotSupportedAttributeType):
+			result.AttributeStatus = GetVariablesResponse.GetVariableStatusEnumTypeNotSupportedAttributeType
+		case err != nil:
+			additional_info := err.Error()
+			result.AttributeStatus = GetVariablesResponse.GetVariableStatusEnumTypeRejected
+			result.AttributeStatusInfo = &GetVariablesResponse.StatusInfoType{ReasonCode: "WriteOnly", AdditionalInfo: &additional_info}
+		default:
+			result.AttributeStatus = GetVariablesResponse.GetVariableStatusEnumTypeAccepted
+			result.AttributeValue = &value
+		}
+		results = append(results, result)
+	}
+	return GetVariablesResponse.GetVariablesResponseJson{GetVariableResult: results}, nil
+}
+
+// Applies the variables that take effect without a reboot when the CSMS changes them
+func (cs *ChargingStation) registerVariableListeners() {
+	cs.DeviceModel.OnChange(
+		devicemodel.Component{Name: "OCPPCommCtrlr"},
+		devicemodel.Variable{Name: "HeartbeatInterval"},
+		func(value string) {
+			cs.SetHeartbeatInterval(cs.DeviceModel.GetSeconds("OCPPCommCtrlr", "HeartbeatInterval"))
+		},
+	)
+	for _, name := range []string{"Enabled", "SiteLimit", "Strategy", "GroupPriorities"} {
+		cs.DeviceModel.OnChange(
+			devicemodel.Component{Name: "LoadManagementCtrlr"},
+			devicemodel.Variable{Name: name},
+			func(value string) { cs.chargingLimitsChanged() },
+		)
+	}
+}
+
+// Current TxUpdatedInterval, read on every tick so that changes apply to ongoing transactions as well
+func (cs *ChargingStation) txUpdatedInterval() time.Duration {
+	return cs.DeviceModel.GetSeconds("SampledDataCtrlr", "TxUpdatedInterval")
+}
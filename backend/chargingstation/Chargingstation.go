@@ -3,96 +3,213 @@ package chargingstation
 import (
 	"errors"
 	"net/url"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/gregszalay/ocpp-charging-station-go/authcache"
+	"github.com/gregszalay/ocpp-charging-station-go/devicemodel"
 	"github.com/gregszalay/ocpp-charging-station-go/displayserver"
 	"github.com/gregszalay/ocpp-charging-station-go/evsemanager"
+	"github.com/gregszalay/ocpp-charging-station-go/loadmanager"
+	"github.com/gregszalay/ocpp-charging-station-go/localauthlist"
 	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-charging-station-go/smartcharging"
 	"github.com/gregszalay/ocpp-charging-station-go/transactions"
 	"github.com/gregszalay/ocpp-messages-go/types/BootNotificationRequest"
-	"github.com/gregszalay/ocpp-messages-go/types/HeartbeatRequest"
-	"github.com/gregszalay/ocpp-messages-go/wrappers"
+	"github.com/gregszalay/ocpp-messages-go/types/BootNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventRequest"
 	log "github.com/sirupsen/logrus"
 )
 
 type ChargingStation struct {
-	Csms_url            url.URL
-	Evses               map[int]*evsemanager.EVSE
-	OcppClient          *ocppclient.OCPPClient
-	UI_callbacks        *displayserver.UICallbacks
-	SetVariablesHandler func(wrappers.CALL)
-	EVSEIdsToTxsMap     map[int]*transactions.Transaction
+	Csms_url        url.URL
+	Evses           map[int]*evsemanager.EVSE
+	OcppClient      *ocppclient.OCPPClient
+	UI_callbacks    *displayserver.UICallbacks
+	EVSEIdsToTxsMap map[int]*transactions.Transaction
+	DeviceModel     *devicemodel.DeviceModel
+	Store           persistence.Store
+	SmartCharging   *smartcharging.ProfileManager
+	LoadManager     *loadmanager.LoadManager
+	AuthCache       *authcache.AuthCache
+	LocalList       *localauthlist.LocalList
+
+	boot_reason         BootNotificationRequest.BootReasonEnumType_1
+	registration_status BootNotificationResponse.RegistrationStatusEnumType_1
+	heartbeat_interval  time.Duration
+	heartbeat_reset     chan time.Duration
+	// Wakes the boot loop up when the CSMS triggers a BootNotification
+	boot_now chan struct{}
+	// Wakes the charging limits job up when the limits may have changed
+	limits_changed chan struct{}
+	// Signalled after a Reset of the whole Charging Station has shut it down, the owner creates a new instance
+	Restart_requests      chan struct{}
+	scheduled_reset       bool
+	scheduled_evse_resets map[int]bool
+	// Operational status set by ChangeAvailability, everything not in the map is operative
+	inoperative            map[availabilityTarget]bool
+	scheduled_availability map[availabilityTarget]bool
+	driver_info            map[int]driverInfo
+	// EVSEs of accepted RequestStartTransactions whose transaction is not set up yet
+	remote_starts map[int]bool
+	stopped       chan struct{}
+	stop_once     sync.Once
+	mu            sync.Mutex
 }
 
-var cs_new *ChargingStation
+// State that is kept across restarts is saved to _store, nil keeps everything in memory
+func CreateAndRunChargingStation(_csms_url url.URL, evseIPs []string, _client_config ocppclient.ClientConfig, _store persistence.Store) (*ChargingStation, error) {
 
-func CreateAndRunChargingStation(_csms_url url.URL, evseIPs []string) (*ChargingStation, error) {
+	if _store == nil {
+		_store = persistence.NewMemoryStore()
+	}
 
 	// Create new Charging Station
-	cs_new = &ChargingStation{
-		Csms_url:            _csms_url, //TODO more than one csms?
-		Evses:               make(map[int]*evsemanager.EVSE),
-		OcppClient:          nil,
-		UI_callbacks:        nil,
-		SetVariablesHandler: func(call wrappers.CALL) {},
-		EVSEIdsToTxsMap:     make(map[int]*transactions.Transaction),
+	// The callbacks below capture this instance, a restart creates a new one with callbacks of its own
+	cs_new := &ChargingStation{
+		Csms_url:        _csms_url, //TODO more than one csms?
+		Evses:           make(map[int]*evsemanager.EVSE),
+		OcppClient:      nil,
+		UI_callbacks:    nil,
+		EVSEIdsToTxsMap: make(map[int]*transactions.Transaction),
+		Store:           _store,
+		LoadManager:     loadmanager.CreateLoadManager(),
+		boot_reason:     BootNotificationRequest.BootReasonEnumType_1_PowerUp,
+		heartbeat_reset: make(chan time.Duration, 1),
+		boot_now:        make(chan struct{}, 1),
+		limits_changed:  make(chan struct{}, 1),
+
+		Restart_requests:       make(chan struct{}, 1),
+		scheduled_evse_resets:  make(map[int]bool),
+		inoperative:            make(map[availabilityTarget]bool),
+		scheduled_availability: make(map[availabilityTarget]bool),
+		driver_info:            make(map[int]driverInfo),
+		remote_starts:          make(map[int]bool),
+		stopped:                make(chan struct{}),
 	}
+	cs_new.restoreBootReason()
 
 	// Connect EVSEs
 	if len(evseIPs) == 0 {
 		return nil, errors.New("failed to create CS, at least 1 EVSE must be provided")
 	}
+	evseIds := make([]int, 0)
 	for i, ip := range evseIPs {
-		// TODO check evse numbering standard
-		if evse, err := evsemanager.CreateAndRunEVSE(i, ip); err != nil {
+		// EVSEs are numbered from 1, EVSE id 0 refers to the whole Charging Station
+		evseId := i + 1
+		if evse, err := evsemanager.CreateAndRunEVSE(evseId, ip); err != nil {
 			log.Error("Unable to create EVSE instance", err)
 			return nil, err
 		} else {
-			cs_new.Evses[i] = evse
+			cs_new.Evses[evseId] = evse
+			evseIds = append(evseIds, evseId)
 		}
 	}
 
-	// Connect OCPP Client
-	if ocpp_cl, err := ocppclient.CreateAndRunOCPPClient(_csms_url); err != nil {
+	// Create the device model, the configuration variables of the Charging Station
+	cs_new.DeviceModel = devicemodel.CreateDeviceModel(evseIds)
+	cs_new.initSecurityCtrlr(_client_config)
+	// Values the CSMS set before the restart take precedence over the configuration
+	if err := cs_new.DeviceModel.Persist(_store); err != nil {
+		log.Error("unable to restore the device model: ", err)
+	}
+	cs_new.restoreAvailability()
+	// Charging profiles installed by the CSMS before the restart
+	cs_new.SmartCharging = smartcharging.CreateProfileManager(_store)
+	cs_new.updateProfileEntries()
+	// idTokens the CSMS authorized before the restart, for authorization while offline
+	cs_new.AuthCache = authcache.CreateAuthCache(_store)
+	cs_new.updateAuthCacheStorage()
+	cs_new.LocalList = localauthlist.CreateLocalList(_store)
+	cs_new.updateLocalListEntries()
+	cs_new.heartbeat_interval = cs_new.DeviceModel.GetSeconds("OCPPCommCtrlr", "HeartbeatInterval")
+	cs_new.registerVariableListeners()
+
+	// Connect OCPP Client. Queued messages are held until the CSMS accepts the BootNotification
+	client_config := cs_new.clientConfig(_client_config)
+	client_config.HoldQueuedCalls = true
+	if ocpp_cl, err := ocppclient.CreateAndRunOCPPClient(_csms_url, client_config); err != nil {
 		log.Error("failed to create OCPP client")
 		return nil, err
 	} else {
 		cs_new.OcppClient = ocpp_cl
 	}
 
-	cs_new.SendBootNotification()
-	time.Sleep(time.Millisecond * 3000)
+	// End the transactions that were interrupted by the restart
+	cs_new.recoverTransactions()
+
+	// Answer the requests of the CSMS, unknown actions are rejected with NotImplemented by the OCPP client
+	cs_new.registerHandlers()
+
+	// Register at the CSMS, StatusNotifications are sent once the BootNotification is accepted
+	go cs_new.boot()
 
 	for _, evse := range cs_new.Evses {
-		cs_new.SendStatusNotification(evse)
+		evse := evse
 		evse.OnEVConnected_repeat = func() {
+			cs_new.LoadManager.Connect(evse.Id)
+			cs_new.chargingLimitsChanged()
 			cs_new.SendStatusNotification(evse)
+			if !cs_new.isAccepted() {
+				log.Warning("EV connected to EVSE ", evse.Id, " but the CSMS has not accepted the charging station yet")
+				return
+			}
+			// A transaction that was started remotely before the EV was plugged in continues
+			if tx := cs_new.transactionOn(evse.Id); tx != nil {
+				cs_new.onEVConnectedToTransaction(tx)
+				return
+			}
+			if !cs_new.isOperative(evse.Id) {
+				log.Warning("EV connected to EVSE ", evse.Id, " but the EVSE is inoperative, no transaction is started")
+				return
+			}
 			new_tx, _ := cs_new.StartTransaction(evse)
-			cs_new.EVSEIdsToTxsMap[evse.Id] = new_tx
+			cs_new.setTransaction(evse.Id, new_tx)
 		}
 		evse.OnEVDisconnected_repeat = func() {
+			cs_new.LoadManager.Disconnect(evse.Id)
+			cs_new.chargingLimitsChanged()
 			cs_new.SendStatusNotification(evse)
 		}
 	}
 
 	// Set up the UI logic
 	cs_new.UI_callbacks = &displayserver.UICallbacks{
-		OnStartButtonPress: func(evseId int, rfid string) {
+		OnStartButtonPress: func(evseId int, idToken displayserver.IdTokenForUI) {
+			id_token, err := uiIdToken(idToken)
+			if err != nil {
+				log.Error("Invalid idToken: ", err)
+				return
+			}
 			evse := cs_new.Evses[evseId]
-			tx := cs_new.EVSEIdsToTxsMap[evse.Id]
+			tx := cs_new.transactionOn(evse.Id)
+			if tx == nil {
+				log.Error("No transaction on EVSE ", evseId)
+				return
+			}
 			if evse.IsEVConnected == 1 {
-				cs_new.AuthorizeTransaction(tx, evse, rfid)
+				cs_new.AuthorizeTransaction(tx, evse, id_token)
 			} else {
 				evse.OnEVConnected_fire_once = func() {
-					cs_new.AuthorizeTransaction(tx, evse, rfid)
+					cs_new.AuthorizeTransaction(tx, evse, id_token)
 				}
 			}
 		},
-		OnStopButtonPress: func(evseId int, rfid string) {
+		OnStopButtonPress: func(evseId int, idToken displayserver.IdTokenForUI) {
+			id_token, err := uiIdToken(idToken)
+			if err != nil {
+				log.Error("Invalid idToken: ", err)
+				return
+			}
 			evse := cs_new.Evses[evseId]
-			tx := cs_new.EVSEIdsToTxsMap[evse.Id]
-			cs_new.EndTransaction(evse, tx, rfid)
+			tx := cs_new.transactionOn(evse.Id)
+			if tx == nil {
+				log.Error("No transaction on EVSE ", evseId)
+				return
+			}
+			cs_new.EndTransaction(evse, tx, id_token)
 		},
 		OnGetChargeStatus: func(evseId int) displayserver.EVSEStatusDataForUI {
 			evse := cs_new.Evses[evseId]
@@ -104,8 +221,15 @@ func CreateAndRunChargingStation(_csms_url url.URL, evseIPs []string) (*Charging
 				EnergyActiveNet_kwh_float:  float64(evse.EnergyActiveNet_wh) / 1000,
 				PowerActiveImport_kw_float: float64(evse.PowerActiveImport_w) / 1000,
 			}
+			driver_info := cs_new.driverInfoOf(evseId)
+			data.TotalCost = driver_info.TotalCost
+			data.PersonalMessage = driver_info.PersonalMessage
+			if data.TotalCost != nil {
+				data.Currency = cs_new.DeviceModel.GetString("TariffCostCtrlr", "Currency")
+			}
 			return data
 		},
+		OnGetAuthCache: cs_new.authCacheForUI,
 		OnGetEVSEsActiveIds: func() []int {
 			evses := make([]int, 0)
 			evseNumber := 0
@@ -119,76 +243,43 @@ func CreateAndRunChargingStation(_csms_url url.URL, evseIPs []string) (*Charging
 
 	go displayserver.Start(*cs_new.UI_callbacks)
 
-	log.Info("got here ")
+	go cs_new.runHeartbeat()
 
-	//HEARTBEAT JOB
-	go func() {
-		ticker_status := time.NewTicker(time.Second * 60 * 5)
-		defer ticker_status.Stop()
-		for {
-			select {
-			case t := <-ticker_status.C:
-				_ = t
-				heartbeatRequest := &HeartbeatRequest.HeartbeatRequestJson{
-					CustomData: &HeartbeatRequest.CustomDataType{
-						VendorId: "example-station-vendor",
-					},
-				}
-				call_wrapper := &wrappers.CALL{
-					MessageTypeId: wrappers.CALL_TYPE,
-					MessageId:     uuid.New().String(),
-					Action:        "Heartbeat",
-					Payload:       *heartbeatRequest,
-				}
-				log.Info("Sending heartbeat")
-				cs_new.OcppClient.Send(ocppclient.AsyncOcppCall{
-					Message:         *call_wrapper,
-					SuccessCallback: func(result wrappers.CALLRESULT) { log.Info("Heartbeat message sent") },
-					ErrorCallback:   func(result wrappers.CALLERROR) { log.Info("Heartbeat message not sent") },
-				})
-			default:
-			}
-		}
-	}()
+	go cs_new.runChargingLimits()
 
+	// Resend StatusNotifications after the connection to the CSMS was restored
 	go func() {
-		for ocpp_call_from_CSMS := range cs_new.OcppClient.Calls_received {
-			switch ocpp_call_from_CSMS.Action {
-			case "SetVariables":
-				log.Info("handler for SetVariables called")
-				//cs_new.OcppClient.SetVariablesHandler(ocpp_call_from_CSMS) // TODO setvariableshandler type as param
-			default:
-				log.Warning("No handler found for this CSMS request")
+		has_been_connected := false
+		for state := range cs_new.OcppClient.Connection_state_changes {
+			if state != ocppclient.Connected {
+				continue
 			}
+			log.Info("Connected to CSMS using ", cs_new.OcppClient.NegotiatedProtocol())
+			if has_been_connected && cs_new.isAccepted() {
+				log.Info("Reconnected to CSMS")
+				for _, evse := range cs_new.Evses {
+					cs_new.SendStatusNotification(evse)
+				}
+			}
+			has_been_connected = true
 		}
 	}()
 
 	return cs_new, nil
 }
 
+// Stops the Charging Station: ends the ongoing transactions, delivers the queued messages if possible,
+// then closes the connections to the CSMS and the EVSEs
 func (cs *ChargingStation) ShutDown() {
-	//TODO
+	cs.shutDown(TransactionEventRequest.ReasonEnumType_1_Other, TransactionEventRequest.TriggerReasonEnumType_1_AbnormalCondition)
 }
 
-func (cs *ChargingStation) SendBootNotification() {
-
-	bootNotificationRequest := BootNotificationRequest.BootNotificationRequestJson{
-		Reason: "PowerUp",
-		ChargingStation: BootNotificationRequest.ChargingStationType{
-			Model:      "super-charger-6000",
-			VendorName: "WattsUp",
-		},
-	}
-	call_wrapper := &wrappers.CALL{
-		MessageTypeId: wrappers.CALL_TYPE,
-		MessageId:     uuid.New().String(),
-		Action:        "BootNotification",
-		Payload:       bootNotificationRequest,
+// Ids of the EVSEs in ascending order
+func (cs *ChargingStation) sortedEvseIds() []int {
+	ids := make([]int, 0, len(cs.Evses))
+	for id := range cs.Evses {
+		ids = append(ids, id)
 	}
-
-	cs.OcppClient.Send(ocppclient.AsyncOcppCall{
-		Message:         *call_wrapper,
-		SuccessCallback: func(result wrappers.CALLRESULT) {},
-		ErrorCallback:   func(result wrappers.CALLERROR) {},
-	})
+	sort.Ints(ids)
+	return ids
 }
@@ -0,0 +1,176 @@
+package devicemodel
+
+// Builds a variable with a single Actual attribute
+func newVariable(component Component, name string, dataType DataEnumType, mutability MutabilityEnumType, value string) *ComponentVariable {
+	return &ComponentVariable{
+		Component: component,
+		Variable:  Variable{Name: name},
+		Attributes: []VariableAttribute{
+			{
+				Type:       Actual,
+				Value:      value,
+				Mutability: mutability,
+				Persistent: mutability != ReadOnly,
+			},
+		},
+		Characteristics: VariableCharacteristics{
+			DataType: dataType,
+		},
+	}
+}
+
+func (cv *ComponentVariable) withInstance(instance string) *ComponentVariable {
+	cv.Variable.Instance = instance
+	return cv
+}
+
+func (cv *ComponentVariable) withUnit(unit string) *ComponentVariable {
+	cv.Characteristics.Unit = unit
+	return cv
+}
+
+func (cv *ComponentVariable) withLimits(minLimit float64, maxLimit float64) *ComponentVariable {
+	cv.Characteristics.MinLimit = &minLimit
+	cv.Characteristics.MaxLimit = &maxLimit
+	return cv
+}
+
+func (cv *ComponentVariable) withMaxLimit(maxLimit float64) *ComponentVariable {
+	cv.Characteristics.MaxLimit = &maxLimit
+	return cv
+}
+
+func (cv *ComponentVariable) withValues(valuesList string) *ComponentVariable {
+	cv.Characteristics.ValuesList = valuesList
+	return cv
+}
+
+func (cv *ComponentVariable) constant() *ComponentVariable {
+	for i := range cv.Attributes {
+		cv.Attributes[i].Constant = true
+		cv.Attributes[i].Persistent = true
+	}
+	return cv
+}
+
+func (cv *ComponentVariable) rebootRequired() *ComponentVariable {
+	cv.RebootRequired = true
+	return cv
+}
+
+const measurands = "Current.Import,Current.Offered,Energy.Active.Import.Register,Energy.Active.Net,Power.Active.Import,Power.Offered,SoC,Voltage"
+
+// The controllers of OCPP 2.0.1 Part 2 Appendices, with the variables used by this Charging Station
+func (dm *DeviceModel) addStandardControllers() {
+	station := Component{Name: "ChargingStation"}
+	dm.Add(newVariable(station, "AvailabilityState", OptionList, ReadOnly, "Available").withValues("Available,Occupied,Reserved,Unavailable,Faulted"))
+	dm.Add(newVariable(station, "Available", Boolean, ReadOnly, "true"))
+	dm.Add(newVariable(station, "Model", String, ReadOnly, "super-charger-6000").constant())
+	dm.Add(newVariable(station, "VendorName", String, ReadOnly, "WattsUp").constant())
+	dm.Add(newVariable(station, "SupplyPhases", Integer, ReadOnly, "3").withLimits(0, 3).constant())
+
+	comm := Component{Name: "OCPPCommCtrlr"}
+	dm.Add(newVariable(comm, "HeartbeatInterval", Integer, ReadWrite, "300").withUnit("s").withLimits(1, 86400))
+	dm.Add(newVariable(comm, "MessageTimeout", Integer, ReadWrite, "30").withInstance("Default").withUnit("s").withLimits(1, 600).rebootRequired())
+	dm.Add(newVariable(comm, "MessageAttempts", Integer, ReadWrite, "3").withInstance("TransactionEvent").withLimits(1, 10))
+	dm.Add(newVariable(comm, "MessageAttemptInterval", Integer, ReadWrite, "60").withInstance("TransactionEvent").withUnit("s").withLimits(1, 3600))
+	dm.Add(newVariable(comm, "OfflineThreshold", Integer, ReadWrite, "60").withUnit("s").withLimits(0, 86400))
+	dm.Add(newVariable(comm, "ResetRetries", Integer, ReadWrite, "2").withLimits(0, 10))
+	dm.Add(newVariable(comm, "RetryBackOffWaitMinimum", Integer, ReadWrite, "5").withUnit("s").withLimits(0, 3600).rebootRequired())
+	dm.Add(newVariable(comm, "RetryBackOffRandomRange", Integer, ReadWrite, "10").withUnit("s").withLimits(0, 3600).rebootRequired())
+	dm.Add(newVariable(comm, "RetryBackOffRepeatTimes", Integer, ReadWrite, "5").withLimits(0, 20).rebootRequired())
+	dm.Add(newVariable(comm, "NetworkProfileConnectionAttempts", Integer, ReadWrite, "3").withLimits(1, 10))
+	dm.Add(newVariable(comm, "NetworkConfigurationPriority", SequenceList, ReadWrite, "0").withValues("0"))
+
+	security := Component{Name: "SecurityCtrlr"}
+	dm.Add(newVariable(security, "SecurityProfile", Integer, ReadOnly, "2").withLimits(1, 3))
+	dm.Add(newVariable(security, "Identity", String, ReadOnly, "").withMaxLimit(48))
+	dm.Add(newVariable(security, "BasicAuthPassword", String, WriteOnly, "").withMaxLimit(40).rebootRequired())
+	dm.Add(newVariable(security, "OrganizationName", String, ReadWrite, "WattsUp"))
+
+	tx := Component{Name: "TxCtrlr"}
+	dm.Add(newVariable(tx, "EVConnectionTimeOut", Integer, ReadWrite, "60").withUnit("s").withLimits(0, 3600))
+	dm.Add(newVariable(tx, "StopTxOnEVSideDisconnect", Boolean, ReadOnly, "true"))
+	dm.Add(newVariable(tx, "StopTxOnInvalidId", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(tx, "MaxEnergyOnInvalidId", Integer, ReadWrite, "0").withUnit("Wh").withLimits(0, 1000000))
+	dm.Add(newVariable(tx, "TxStartPoint", MemberList, ReadOnly, "EVConnected").withValues("ParkingBayOccupancy,EVConnected,Authorized,DataSigned,PowerPathClosed,EnergyTransfer"))
+	dm.Add(newVariable(tx, "TxStopPoint", MemberList, ReadOnly, "EVConnected").withValues("ParkingBayOccupancy,EVConnected,Authorized,DataSigned,PowerPathClosed,EnergyTransfer"))
+
+	sampled := Component{Name: "SampledDataCtrlr"}
+	dm.Add(newVariable(sampled, "Enabled", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(sampled, "TxStartedMeasurands", MemberList, ReadWrite, "Energy.Active.Net,Power.Active.Import").withValues(measurands))
+	dm.Add(newVariable(sampled, "TxUpdatedMeasurands", MemberList, ReadWrite, "Energy.Active.Net,Power.Active.Import").withValues(measurands))
+	dm.Add(newVariable(sampled, "TxUpdatedInterval", Integer, ReadWrite, "5").withUnit("s").withLimits(0, 3600))
+	dm.Add(newVariable(sampled, "TxEndedMeasurands", MemberList, ReadWrite, "Energy.Active.Net,Power.Active.Import").withValues(measurands))
+	dm.Add(newVariable(sampled, "TxEndedInterval", Integer, ReadWrite, "0").withUnit("s").withLimits(0, 3600))
+
+	auth := Component{Name: "AuthCtrlr"}
+	dm.Add(newVariable(auth, "Enabled", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(auth, "AuthorizeRemoteStart", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(auth, "LocalAuthorizeOffline", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(auth, "LocalPreAuthorize", Boolean, ReadWrite, "false"))
+	dm.Add(newVariable(auth, "OfflineTxForUnknownIdEnabled", Boolean, ReadWrite, "false"))
+
+	auth_cache := Component{Name: "AuthCacheCtrlr"}
+	dm.Add(newVariable(auth_cache, "Enabled", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(auth_cache, "Available", Boolean, ReadOnly, "true"))
+	dm.Add(newVariable(auth_cache, "LifeTime", Integer, ReadWrite, "86400").withUnit("s").withLimits(0, 31536000))
+	dm.Add(newVariable(auth_cache, "Storage", Integer, ReadOnly, "0").withLimits(0, 65536))
+	dm.Add(newVariable(auth_cache, "Policy", OptionList, ReadOnly, "LRU").withValues("LRU,LFU,FIFO,CUSTOM"))
+
+	local_list := Component{Name: "LocalAuthListCtrlr"}
+	dm.Add(newVariable(local_list, "Enabled", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(local_list, "Available", Boolean, ReadOnly, "true"))
+	dm.Add(newVariable(local_list, "Entries", Integer, ReadOnly, "0").withLimits(0, 1000))
+	dm.Add(newVariable(local_list, "ItemsPerMessage", Integer, ReadOnly, "100").constant())
+	dm.Add(newVariable(local_list, "BytesPerMessage", Integer, ReadOnly, "65536").constant())
+
+	device_data := Component{Name: "DeviceDataCtrlr"}
+	dm.Add(newVariable(device_data, "ItemsPerMessage", Integer, ReadOnly, "20").withInstance("GetReport").constant())
+	dm.Add(newVariable(device_data, "ItemsPerMessage", Integer, ReadOnly, "50").withInstance("GetVariables").constant())
+	dm.Add(newVariable(device_data, "ItemsPerMessage", Integer, ReadOnly, "50").withInstance("SetVariables").constant())
+	dm.Add(newVariable(device_data, "BytesPerMessage", Integer, ReadOnly, "65536").withInstance("GetReport").constant())
+	dm.Add(newVariable(device_data, "BytesPerMessage", Integer, ReadOnly, "65536").withInstance("GetVariables").constant())
+	dm.Add(newVariable(device_data, "BytesPerMessage", Integer, ReadOnly, "65536").withInstance("SetVariables").constant())
+
+	smart_charging := Component{Name: "SmartChargingCtrlr"}
+	dm.Add(newVariable(smart_charging, "Enabled", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(smart_charging, "Available", Boolean, ReadOnly, "true"))
+	dm.Add(newVariable(smart_charging, "Entries", Integer, ReadOnly, "0").withInstance("ChargingProfiles").withLimits(0, 100))
+	dm.Add(newVariable(smart_charging, "LimitChangeSignificance", Decimal, ReadWrite, "0.1").withLimits(0, 1))
+	dm.Add(newVariable(smart_charging, "PeriodsPerSchedule", Integer, ReadOnly, "24").constant())
+	dm.Add(newVariable(smart_charging, "ProfileStackLevel", Integer, ReadOnly, "10").constant())
+	dm.Add(newVariable(smart_charging, "RateUnit", MemberList, ReadOnly, "A,W").withValues("A,W").constant())
+	dm.Add(newVariable(smart_charging, "Phases3to1", Boolean, ReadOnly, "false").constant())
+
+	tariff_cost := Component{Name: "TariffCostCtrlr"}
+	dm.Add(newVariable(tariff_cost, "Enabled", Boolean, ReadWrite, "true").withInstance("Cost"))
+	dm.Add(newVariable(tariff_cost, "Available", Boolean, ReadOnly, "true").withInstance("Cost"))
+	dm.Add(newVariable(tariff_cost, "Currency", String, ReadWrite, "EUR").withMaxLimit(3))
+
+	// Vendor specific: shares the current of the grid connection between the EVSEs
+	load_management := Component{Name: "LoadManagementCtrlr"}
+	dm.Add(newVariable(load_management, "Enabled", Boolean, ReadWrite, "false"))
+	dm.Add(newVariable(load_management, "SiteLimit", Decimal, ReadWrite, "32").withUnit("A").withLimits(0, 1000))
+	dm.Add(newVariable(load_management, "Strategy", OptionList, ReadWrite, "EqualShare").withValues("EqualShare,FirstCome,Priority"))
+	dm.Add(newVariable(load_management, "GroupPriorities", String, ReadWrite, "").withMaxLimit(1000))
+
+	clock := Component{Name: "ClockCtrlr"}
+	dm.Add(newVariable(clock, "DateTime", DateTime, ReadOnly, "2000-01-01T00:00:00Z"))
+	dm.Add(newVariable(clock, "TimeSource", SequenceList, ReadWrite, "Heartbeat").withValues("Heartbeat,NTP,GPS,RealTimeClock,MobileNetwork,RadioTimeTransmitter"))
+}
+
+// Every EVSE has a single connector with id 1
+func (dm *DeviceModel) addEVSE(evseId int) {
+	evse := Component{Name: "EVSE", EvseId: evseId}
+	dm.Add(newVariable(evse, "AvailabilityState", OptionList, ReadOnly, "Available").withValues("Available,Occupied,Reserved,Unavailable,Faulted"))
+	dm.Add(newVariable(evse, "Available", Boolean, ReadOnly, "true"))
+	dm.Add(newVariable(evse, "Power", Decimal, ReadOnly, "0").withUnit("W").withLimits(0, 22000))
+	dm.Add(newVariable(evse, "SupplyPhases", Integer, ReadOnly, "3").withLimits(0, 3).constant())
+
+	connector := Component{Name: "Connector", EvseId: evseId, ConnectorId: 1}
+	dm.Add(newVariable(connector, "AvailabilityState", OptionList, ReadOnly, "Available").withValues("Available,Occupied,Reserved,Unavailable,Faulted"))
+	dm.Add(newVariable(connector, "Available", Boolean, ReadOnly, "true"))
+	dm.Add(newVariable(connector, "ConnectorType", String, ReadOnly, "cType2").constant())
+	dm.Add(newVariable(connector, "SupplyPhases", Integer, ReadOnly, "3").withLimits(0, 3).constant())
+}
@@ -0,0 +1,425 @@
+package devicemodel
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	log "github.com/sirupsen/logrus"
+)
+
+type AttributeEnumType string
+
+// Only the Actual attribute is modelled, Target, MinSet and MaxSet are rejected with ErrNotSupportedAttributeType
+const Actual AttributeEnumType = "Actual"
+
+type MutabilityEnumType string
+
+const (
+	ReadOnly  MutabilityEnumType = "ReadOnly"
+	WriteOnly MutabilityEnumType = "WriteOnly"
+	ReadWrite MutabilityEnumType = "ReadWrite"
+)
+
+type DataEnumType string
+
+const (
+	String       DataEnumType = "string"
+	Decimal      DataEnumType = "decimal"
+	Integer      DataEnumType = "integer"
+	DateTime     DataEnumType = "dateTime"
+	Boolean      DataEnumType = "boolean"
+	OptionList   DataEnumType = "OptionList"
+	SequenceList DataEnumType = "SequenceList"
+	MemberList   DataEnumType = "MemberList"
+)
+
+var (
+	ErrUnknownComponent          = errors.New("unknown component")
+	ErrUnknownVariable           = errors.New("unknown variable")
+	ErrNotSupportedAttributeType = errors.New("attribute type not supported")
+	ErrReadOnly                  = errors.New("variable is read-only")
+	ErrWriteOnly                 = errors.New("variable is write-only")
+	ErrInvalidValue              = errors.New("invalid value")
+)
+
+// Physical or logical part of the Charging Station. EvseId and ConnectorId are 0 if the component is not EVSE/connector specific.
+type Component struct {
+	Name        string
+	Instance    string
+	EvseId      int
+	ConnectorId int
+}
+
+func (c Component) String() string {
+	result := c.Name
+	if c.Instance != "" {
+		result += "[" + c.Instance + "]"
+	}
+	if c.EvseId != 0 {
+		result += fmt.Sprintf(" EVSE %d", c.EvseId)
+	}
+	if c.ConnectorId != 0 {
+		result += fmt.Sprintf(" connector %d", c.ConnectorId)
+	}
+	return result
+}
+
+type Variable struct {
+	Name     string
+	Instance string
+}
+
+type VariableAttribute struct {
+	Type       AttributeEnumType
+	Value      string
+	Mutability MutabilityEnumType
+	Persistent bool // the value survives a reboot
+	Constant   bool // the value never changes at runtime
+}
+
+type VariableCharacteristics struct {
+	Unit               string
+	DataType           DataEnumType
+	MinLimit           *float64
+	MaxLimit           *float64
+	ValuesList         string // comma separated allowed values of OptionList, MemberList and SequenceList
+	SupportsMonitoring bool
+}
+
+// A variable of a component with all of its attributes
+type ComponentVariable struct {
+	Component       Component
+	Variable        Variable
+	Attributes      []VariableAttribute
+	Characteristics VariableCharacteristics
+	RebootRequired  bool // a new value only takes effect after a reboot
+}
+
+func (cv *ComponentVariable) attribute(attributeType AttributeEnumType) *VariableAttribute {
+	for i := range cv.Attributes {
+		if cv.Attributes[i].Type == attributeType {
+			return &cv.Attributes[i]
+		}
+	}
+	return nil
+}
+
+type DeviceModel struct {
+	variables  []*ComponentVariable // in definition order
+	components map[Component]bool
+	index      map[Component]map[Variable]*ComponentVariable
+	listeners  map[Component]map[Variable][]func(string)
+	store      persistence.Store
+	mu         sync.RWMutex
+}
+
+// Creates a device model with the standard controllers and a component for every EVSE and its connector
+func CreateDeviceModel(evseIds []int) *DeviceModel {
+	dm_new := &DeviceModel{
+		variables:  make([]*ComponentVariable, 0),
+		components: make(map[Component]bool),
+		index:      make(map[Component]map[Variable]*ComponentVariable),
+		listeners:  make(map[Component]map[Variable][]func(string)),
+	}
+	dm_new.addStandardControllers()
+	for _, evseId := range evseIds {
+		dm_new.addEVSE(evseId)
+	}
+	return dm_new
+}
+
+func (dm *DeviceModel) Add(variable *ComponentVariable) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, ok := dm.index[variable.Component]; !ok {
+		dm.index[variable.Component] = make(map[Variable]*ComponentVariable)
+	}
+	if _, exists := dm.index[variable.Component][variable.Variable]; exists {
+		log.Warning("device model: redefining ", variable.Component, ".", variable.Variable.Name)
+	} else {
+		dm.variables = append(dm.variables, variable)
+	}
+	dm.components[variable.Component] = true
+	dm.index[variable.Component][variable.Variable] = variable
+}
+
+// Returns a copy of every variable, in definition order
+func (dm *DeviceModel) Variables() []ComponentVariable {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	result := make([]ComponentVariable, 0, len(dm.variables))
+	for _, variable := range dm.variables {
+		variable_copy := *variable
+		variable_copy.Attributes = append([]VariableAttribute(nil), variable.Attributes...)
+		result = append(result, variable_copy)
+	}
+	return result
+}
+
+func (dm *DeviceModel) HasComponent(component Component) bool {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.components[component]
+}
+
+// Must be called with dm.mu held
+func (dm *DeviceModel) lookup(component Component, variable Variable, attributeType AttributeEnumType) (*ComponentVariable, *VariableAttribute, error) {
+	variables, ok := dm.index[component]
+	if !ok {
+		return nil, nil, ErrUnknownComponent
+	}
+	component_variable, ok := variables[variable]
+	if !ok {
+		return nil, nil, ErrUnknownVariable
+	}
+	if attributeType != Actual {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotSupportedAttributeType, attributeType)
+	}
+	attribute := component_variable.attribute(attributeType)
+	if attribute == nil {
+		return nil, nil, ErrNotSupportedAttributeType
+	}
+	return component_variable, attribute, nil
+}
+
+// Returns the value of an attribute as the CSMS would read it. Write-only values are not returned.
+func (dm *DeviceModel) GetValue(component Component, variable Variable, attributeType AttributeEnumType) (string, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	_, attribute, err := dm.lookup(component, variable, attributeType)
+	if err != nil {
+		return "", err
+	}
+	if attribute.Mutability == WriteOnly {
+		return "", ErrWriteOnly
+	}
+	return attribute.Value, nil
+}
+
+// Upper limit of the values of a variable, e.g. the maximum power of an EVSE
+func (dm *DeviceModel) GetMaxLimit(component Component, variable Variable) (float64, bool) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	component_variable, ok := dm.index[component][variable]
+	if !ok || component_variable.Characteristics.MaxLimit == nil {
+		return 0, false
+	}
+	return *component_variable.Characteristics.MaxLimit, true
+}
+
+// Registers a function that is called with the new Actual value whenever the CSMS changes the variable
+func (dm *DeviceModel) OnChange(component Component, variable Variable, listener func(value string)) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, ok := dm.listeners[component]; !ok {
+		dm.listeners[component] = make(map[Variable][]func(string))
+	}
+	dm.listeners[component][variable] = append(dm.listeners[component][variable], listener)
+}
+
+// Sets the value of an attribute on request of the CSMS, after checking its mutability and characteristics.
+// Returns whether the new value only takes effect after a reboot.
+func (dm *DeviceModel) SetValue(component Component, variable Variable, attributeType AttributeEnumType, value string) (bool, error) {
+	dm.mu.Lock()
+	component_variable, attribute, err := dm.lookup(component, variable, attributeType)
+	if err != nil {
+		dm.mu.Unlock()
+		return false, err
+	}
+	if attribute.Mutability == ReadOnly || attribute.Constant {
+		dm.mu.Unlock()
+		return false, ErrReadOnly
+	}
+	if err := validate(component_variable.Characteristics, value); err != nil {
+		dm.mu.Unlock()
+		return false, err
+	}
+	attribute.Value = value
+	reboot_required := component_variable.RebootRequired
+	listeners := append([]func(string){}, dm.listeners[component][variable]...)
+	store := dm.store
+	persistent := attribute.Persistent
+	dm.mu.Unlock()
+
+	if store != nil && persistent {
+		stored_value := storedValue{Component: component, Variable: variable, Attribute: attributeType, Value: value}
+		if err := store.Put(persistence.DeviceModelBucket, stored_value.key(), stored_value); err != nil {
+			log.Error("device model: unable to persist ", component, ".", variable.Name, ": ", err)
+		}
+	}
+
+	// Listeners apply the new value right away, so they are not called for values that need a reboot
+	if attributeType == Actual && !reboot_required {
+		for _, listener := range listeners {
+			listener(value)
+		}
+	}
+	return reboot_required, nil
+}
+
+// Value of a persistent attribute set by the CSMS
+type storedValue struct {
+	Component Component
+	Variable  Variable
+	Attribute AttributeEnumType
+	Value     string
+}
+
+func (v storedValue) key() string {
+	return fmt.Sprintf("%s/%s/%d/%d/%s/%s/%s", v.Component.Name, v.Component.Instance, v.Component.EvseId, v.Component.ConnectorId,
+		v.Variable.Name, v.Variable.Instance, v.Attribute)
+}
+
+// Restores the persistent values the CSMS set before the restart, and persists the ones it sets from now on
+func (dm *DeviceModel) Persist(store persistence.Store) error {
+	keys, err := store.Keys(persistence.DeviceModelBucket)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var stored_value storedValue
+		if _, err := store.Get(persistence.DeviceModelBucket, key, &stored_value); err != nil {
+			log.Warning("device model: skipping unreadable persisted value ", key, ": ", err)
+			continue
+		}
+		if err := dm.UpdateValue(stored_value.Component, stored_value.Variable, stored_value.Attribute, stored_value.Value); err != nil {
+			log.Warning("device model: unable to restore ", stored_value.Component, ".", stored_value.Variable.Name, ": ", err)
+			continue
+		}
+	}
+	if len(keys) > 0 {
+		log.Info("device model: restored ", len(keys), " persisted value(s)")
+	}
+	dm.mu.Lock()
+	dm.store = store
+	dm.mu.Unlock()
+	return nil
+}
+
+// Sets the value of an attribute on behalf of the Charging Station itself, mutability is not checked
+func (dm *DeviceModel) UpdateValue(component Component, variable Variable, attributeType AttributeEnumType, value string) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	component_variable, attribute, err := dm.lookup(component, variable, attributeType)
+	if err != nil {
+		return err
+	}
+	if err := validate(component_variable.Characteristics, value); err != nil {
+		return err
+	}
+	attribute.Value = value
+	return nil
+}
+
+// Checks a value against the data type, limits and allowed values of the variable
+func validate(characteristics VariableCharacteristics, value string) error {
+	switch characteristics.DataType {
+	case Integer, Decimal:
+		var number float64
+		if characteristics.DataType == Integer {
+			integer, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: %q is not an integer", ErrInvalidValue, value)
+			}
+			number = float64(integer)
+		} else {
+			decimal, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%w: %q is not a decimal", ErrInvalidValue, value)
+			}
+			number = decimal
+		}
+		if characteristics.MinLimit != nil && number < *characteristics.MinLimit {
+			return fmt.Errorf("%w: %s is less than %v", ErrInvalidValue, value, *characteristics.MinLimit)
+		}
+		if characteristics.MaxLimit != nil && number > *characteristics.MaxLimit {
+			return fmt.Errorf("%w: %s is greater than %v", ErrInvalidValue, value, *characteristics.MaxLimit)
+		}
+	case Boolean:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%w: %q is not a boolean", ErrInvalidValue, value)
+		}
+	case DateTime:
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("%w: %q is not a dateTime", ErrInvalidValue, value)
+		}
+	case OptionList:
+		if !contains(characteristics.ValuesList, value) {
+			return fmt.Errorf("%w: %q is not one of %s", ErrInvalidValue, value, characteristics.ValuesList)
+		}
+	case MemberList, SequenceList:
+		if value == "" {
+			return nil
+		}
+		for _, member := range strings.Split(value, ",") {
+			if !contains(characteristics.ValuesList, strings.TrimSpace(member)) {
+				return fmt.Errorf("%w: %q is not one of %s", ErrInvalidValue, member, characteristics.ValuesList)
+			}
+		}
+	case String:
+		if characteristics.MaxLimit != nil && float64(len(value)) > *characteristics.MaxLimit {
+			return fmt.Errorf("%w: longer than %v characters", ErrInvalidValue, *characteristics.MaxLimit)
+		}
+	}
+	return nil
+}
+
+func contains(valuesList string, value string) bool {
+	for _, allowed := range strings.Split(valuesList, ",") {
+		if strings.TrimSpace(allowed) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Actual value of a variable of a station level component, e.g. GetString("SecurityCtrlr", "Identity").
+// Write-only values are returned as well, these getters are for the Charging Station itself.
+func (dm *DeviceModel) GetString(componentName string, variableName string) string {
+	return dm.GetInstanceString(componentName, variableName, "")
+}
+
+func (dm *DeviceModel) GetInstanceString(componentName string, variableName string, variableInstance string) string {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	_, attribute, err := dm.lookup(Component{Name: componentName}, Variable{Name: variableName, Instance: variableInstance}, Actual)
+	if err != nil {
+		log.Error("device model: ", componentName, ".", variableName, ": ", err)
+		return ""
+	}
+	return attribute.Value
+}
+
+func (dm *DeviceModel) GetInt(componentName string, variableName string) int {
+	return dm.GetInstanceInt(componentName, variableName, "")
+}
+
+func (dm *DeviceModel) GetInstanceInt(componentName string, variableName string, variableInstance string) int {
+	value, err := strconv.Atoi(dm.GetInstanceString(componentName, variableName, variableInstance))
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+func (dm *DeviceModel) GetDecimal(componentName string, variableName string) float64 {
+	value, err := strconv.ParseFloat(dm.GetString(componentName, variableName), 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+func (dm *DeviceModel) GetBool(componentName string, variableName string) bool {
+	return dm.GetString(componentName, variableName) == "true"
+}
+
+// Integer variable in seconds as a duration, e.g. HeartbeatInterval
+func (dm *DeviceModel) GetSeconds(componentName string, variableName string) time.Duration {
+	return time.Duration(dm.GetInt(componentName, variableName)) * time.Second
+}
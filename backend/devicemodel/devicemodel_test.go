@@ -0,0 +1,173 @@
+package devicemodel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+)
+
+var testCtrlr = Component{Name: "TestCtrlr"}
+
+// Device model with one variable of every kind the tests need, on top of the standard controllers
+func testDeviceModel() *DeviceModel {
+	dm := CreateDeviceModel(nil)
+	dm.Add(newVariable(testCtrlr, "ReadWrite", String, ReadWrite, "value"))
+	dm.Add(newVariable(testCtrlr, "ReadOnly", String, ReadOnly, "value"))
+	dm.Add(newVariable(testCtrlr, "WriteOnly", String, WriteOnly, "secret"))
+	dm.Add(newVariable(testCtrlr, "Constant", String, ReadWrite, "value").constant())
+	dm.Add(newVariable(testCtrlr, "Integer", Integer, ReadWrite, "10").withLimits(0, 100))
+	dm.Add(newVariable(testCtrlr, "Decimal", Decimal, ReadWrite, "1.5").withMaxLimit(32))
+	dm.Add(newVariable(testCtrlr, "Boolean", Boolean, ReadWrite, "true"))
+	dm.Add(newVariable(testCtrlr, "DateTime", DateTime, ReadWrite, "2022-10-03T12:00:00Z"))
+	dm.Add(newVariable(testCtrlr, "String", String, ReadWrite, "").withMaxLimit(5))
+	dm.Add(newVariable(testCtrlr, "OptionList", OptionList, ReadWrite, "A").withValues("A,B"))
+	dm.Add(newVariable(testCtrlr, "MemberList", MemberList, ReadWrite, "").withValues("A,B,C"))
+	dm.Add(newVariable(testCtrlr, "Reboot", Integer, ReadWrite, "1").rebootRequired())
+	return dm
+}
+
+func TestSetValue(t *testing.T) {
+	tests := []struct {
+		name          string
+		component     Component
+		variable      string
+		attributeType AttributeEnumType
+		value         string
+		wantErr       error
+	}{
+		{"ReadWrite", testCtrlr, "ReadWrite", Actual, "new", nil},
+		{"ReadOnly", testCtrlr, "ReadOnly", Actual, "new", ErrReadOnly},
+		{"WriteOnly can be set", testCtrlr, "WriteOnly", Actual, "new", nil},
+		{"Constant", testCtrlr, "Constant", Actual, "new", ErrReadOnly},
+		{"Integer within the limits", testCtrlr, "Integer", Actual, "100", nil},
+		{"Integer below minLimit", testCtrlr, "Integer", Actual, "-1", ErrInvalidValue},
+		{"Integer above maxLimit", testCtrlr, "Integer", Actual, "101", ErrInvalidValue},
+		{"Integer that is not a number", testCtrlr, "Integer", Actual, "ten", ErrInvalidValue},
+		{"Integer with a fraction", testCtrlr, "Integer", Actual, "1.5", ErrInvalidValue},
+		{"Decimal within the limit", testCtrlr, "Decimal", Actual, "31.9", nil},
+		{"Decimal above maxLimit", testCtrlr, "Decimal", Actual, "32.1", ErrInvalidValue},
+		{"Boolean", testCtrlr, "Boolean", Actual, "false", nil},
+		{"Boolean that is not true or false", testCtrlr, "Boolean", Actual, "1", ErrInvalidValue},
+		{"DateTime", testCtrlr, "DateTime", Actual, "2022-10-04T08:30:00+02:00", nil},
+		{"DateTime that is not RFC 3339", testCtrlr, "DateTime", Actual, "2022-10-04", ErrInvalidValue},
+		{"String within maxLimit characters", testCtrlr, "String", Actual, "abcde", nil},
+		{"String longer than maxLimit characters", testCtrlr, "String", Actual, "abcdef", ErrInvalidValue},
+		{"OptionList value", testCtrlr, "OptionList", Actual, "B", nil},
+		{"OptionList value that is not allowed", testCtrlr, "OptionList", Actual, "C", ErrInvalidValue},
+		{"MemberList members", testCtrlr, "MemberList", Actual, "A, C", nil},
+		{"MemberList without members", testCtrlr, "MemberList", Actual, "", nil},
+		{"MemberList member that is not allowed", testCtrlr, "MemberList", Actual, "A,D", ErrInvalidValue},
+		{"unknown component", Component{Name: "UnknownCtrlr"}, "ReadWrite", Actual, "new", ErrUnknownComponent},
+		{"unknown variable", testCtrlr, "Unknown", Actual, "new", ErrUnknownVariable},
+		{"Target attribute", testCtrlr, "ReadWrite", "Target", "new", ErrNotSupportedAttributeType},
+		{"MinSet attribute", testCtrlr, "Integer", "MinSet", "1", ErrNotSupportedAttributeType},
+		{"MaxSet attribute", testCtrlr, "Integer", "MaxSet", "1", ErrNotSupportedAttributeType},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dm := testDeviceModel()
+			variable := Variable{Name: test.variable}
+			before := dm.index[testCtrlr][variable]
+			var old_value string
+			if before != nil {
+				old_value = before.Attributes[0].Value
+			}
+
+			_, err := dm.SetValue(test.component, variable, test.attributeType, test.value)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("SetValue(%q) error = %v, want %v", test.value, err, test.wantErr)
+			}
+			if before == nil {
+				return
+			}
+			want := test.value
+			if test.wantErr != nil {
+				want = old_value
+			}
+			if got := before.Attributes[0].Value; got != want {
+				t.Errorf("value after SetValue(%q) = %q, want %q", test.value, got, want)
+			}
+		})
+	}
+}
+
+func TestGetValue(t *testing.T) {
+	tests := []struct {
+		variable string
+		want     string
+		wantErr  error
+	}{
+		{"ReadWrite", "value", nil},
+		{"ReadOnly", "value", nil},
+		{"WriteOnly", "", ErrWriteOnly},
+		{"Unknown", "", ErrUnknownVariable},
+	}
+	for _, test := range tests {
+		t.Run(test.variable, func(t *testing.T) {
+			got, err := testDeviceModel().GetValue(testCtrlr, Variable{Name: test.variable}, Actual)
+			if !errors.Is(err, test.wantErr) || got != test.want {
+				t.Errorf("GetValue() = %q, %v, want %q, %v", got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+// The Charging Station may update its own read-only values, but only with valid ones
+func TestUpdateValue(t *testing.T) {
+	dm := testDeviceModel()
+	if err := dm.UpdateValue(testCtrlr, Variable{Name: "ReadOnly"}, Actual, "new"); err != nil {
+		t.Errorf("UpdateValue(ReadOnly) error = %v", err)
+	}
+	if got, _ := dm.GetValue(testCtrlr, Variable{Name: "ReadOnly"}, Actual); got != "new" {
+		t.Errorf("ReadOnly = %q, want %q", got, "new")
+	}
+	if err := dm.UpdateValue(testCtrlr, Variable{Name: "Integer"}, Actual, "101"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("UpdateValue(Integer, 101) error = %v, want %v", err, ErrInvalidValue)
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	tests := []struct {
+		variable    string
+		wantReboot  bool
+		wantChanges int
+	}{
+		{"Integer", false, 1},
+		// A value that needs a reboot is not applied right away
+		{"Reboot", true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.variable, func(t *testing.T) {
+			dm := testDeviceModel()
+			changes := 0
+			dm.OnChange(testCtrlr, Variable{Name: test.variable}, func(value string) { changes++ })
+			reboot, err := dm.SetValue(testCtrlr, Variable{Name: test.variable}, Actual, "2")
+			if err != nil {
+				t.Fatalf("SetValue() error = %v", err)
+			}
+			if reboot != test.wantReboot || changes != test.wantChanges {
+				t.Errorf("SetValue() reboot = %v with %d change(s), want %v with %d", reboot, changes, test.wantReboot, test.wantChanges)
+			}
+		})
+	}
+}
+
+func TestPersist(t *testing.T) {
+	store := persistence.NewMemoryStore()
+	dm := testDeviceModel()
+	if err := dm.Persist(store); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	if _, err := dm.SetValue(testCtrlr, Variable{Name: "Integer"}, Actual, "42"); err != nil {
+		t.Fatalf("SetValue() error = %v", err)
+	}
+
+	restored := testDeviceModel()
+	if err := restored.Persist(store); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	if got, _ := restored.GetValue(testCtrlr, Variable{Name: "Integer"}, Actual); got != "42" {
+		t.Errorf("restored Integer = %q, want %q", got, "42")
+	}
+}
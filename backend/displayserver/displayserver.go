@@ -1,6 +1,7 @@
 package displayserver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,19 +20,88 @@ type EVSEStatusDataForUI struct {
 	IsError                    int     `json:"isError" yaml:"isError"`
 	EnergyActiveNet_kwh_float  float64 `json:"energyActiveNet_kwh_float" yaml:"energyActiveNet_kwh_float"`
 	PowerActiveImport_kw_float float64 `json:"powerActiveImport_kw_float" yaml:"powerActiveImport_kw_float"`
+	// Sent by the CSMS in the TransactionEventResponses of the last transaction
+	TotalCost       *float64 `json:"totalCost,omitempty" yaml:"totalCost,omitempty"`
+	Currency        string   `json:"currency,omitempty" yaml:"currency,omitempty"`
+	PersonalMessage string   `json:"personalMessage,omitempty" yaml:"personalMessage,omitempty"`
+}
+
+type AuthCacheEntryForUI struct {
+	IdToken             string  `json:"idToken" yaml:"idToken"`
+	Type                string  `json:"type" yaml:"type"`
+	Status              string  `json:"status" yaml:"status"`
+	GroupIdToken        *string `json:"groupIdToken,omitempty" yaml:"groupIdToken,omitempty"`
+	CacheExpiryDateTime *string `json:"cacheExpiryDateTime,omitempty" yaml:"cacheExpiryDateTime,omitempty"`
+	LastUsed            string  `json:"lastUsed" yaml:"lastUsed"`
+}
+
+type AuthCacheDataForUI struct {
+	Enabled bool                  `json:"enabled" yaml:"enabled"`
+	Storage int                   `json:"storage" yaml:"storage"` // bytes
+	Entries []AuthCacheEntryForUI `json:"entries" yaml:"entries"`
+}
+
+// idToken presented at the display, Type is one of the IdTokenEnumType values of OCPP 2.0.1
+type IdTokenForUI struct {
+	IdToken        string                `json:"idToken" yaml:"idToken"`
+	Type           string                `json:"type" yaml:"type"`
+	AdditionalInfo []AdditionalInfoForUI `json:"additionalInfo,omitempty" yaml:"additionalInfo,omitempty"`
+}
+
+type AdditionalInfoForUI struct {
+	AdditionalIdToken string `json:"additionalIdToken" yaml:"additionalIdToken"`
+	Type              string `json:"type" yaml:"type"`
 }
 
 type UICallbacks struct {
-	OnStartButtonPress  func(int, string)
-	OnStopButtonPress   func(int, string)
+	OnStartButtonPress  func(int, IdTokenForUI)
+	OnStopButtonPress   func(int, IdTokenForUI)
 	OnGetChargeStatus   func(int) EVSEStatusDataForUI
 	OnGetEVSEsActiveIds func() []int
+	OnGetAuthCache      func() AuthCacheDataForUI
 }
 
 var callbacks UICallbacks
 
-type RFID_BODY struct {
-	Rfid string `json:"rfid" yaml:"rfid"`
+// Body of the start and stop requests. {"rfid": "..."} of older UIs is an ISO14443 idToken.
+type ID_TOKEN_BODY struct {
+	IdTokenForUI
+	Rfid string `json:"rfid,omitempty" yaml:"rfid,omitempty"`
+}
+
+var idTokenTypes = map[string]bool{
+	"Central":         true,
+	"eMAID":           true,
+	"ISO14443":        true,
+	"ISO15693":        true,
+	"KeyCode":         true,
+	"Local":           true,
+	"MacAddress":      true,
+	"NoAuthorization": true,
+}
+
+func getIdTokenFromReq(req *http.Request) (IdTokenForUI, error) {
+	var body ID_TOKEN_BODY
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return IdTokenForUI{}, err
+	}
+	id_token := body.IdTokenForUI
+	if id_token.IdToken == "" && id_token.Type == "" && body.Rfid != "" {
+		id_token = IdTokenForUI{IdToken: body.Rfid, Type: "ISO14443"}
+	}
+	if !idTokenTypes[id_token.Type] {
+		return IdTokenForUI{}, fmt.Errorf("unknown idToken type: %q", id_token.Type)
+	}
+	// A NoAuthorization idToken is empty, every other type needs a value
+	if id_token.IdToken == "" && id_token.Type != "NoAuthorization" {
+		return IdTokenForUI{}, errors.New("idToken is missing")
+	}
+	for _, info := range id_token.AdditionalInfo {
+		if info.AdditionalIdToken == "" || info.Type == "" {
+			return IdTokenForUI{}, errors.New("additionalInfo needs additionalIdToken and type")
+		}
+	}
+	return id_token, nil
 }
 
 func allowCORS(w http.ResponseWriter) {
@@ -48,14 +118,13 @@ func onStart(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "Received illegal value for EVSE Id!")
 		return
 	} else {
-		var rfid RFID_BODY
-		err := json.NewDecoder(req.Body).Decode(&rfid)
+		id_token, err := getIdTokenFromReq(req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		log.Info("Starting evse ", evseId, ". RFID: ", rfid.Rfid)
-		callbacks.OnStartButtonPress(evseId, rfid.Rfid)
+		log.Info("Starting evse ", evseId, ". idToken: ", id_token.IdToken, " (", id_token.Type, ")")
+		callbacks.OnStartButtonPress(evseId, id_token)
 		//w.WriteHeader(http.StatusOK)
 	}
 }
@@ -66,14 +135,13 @@ func onStop(w http.ResponseWriter, req *http.Request) {
 		log.Error("failed to retrieve evseId from URL path parameters")
 		fmt.Fprintf(w, "Received illegal value for EVSE Id!")
 	} else {
-		var rfid RFID_BODY
-		err := json.NewDecoder(req.Body).Decode(&rfid)
+		id_token, err := getIdTokenFromReq(req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		log.Info("Stopping evse ", evseId, ". RFID: ", rfid.Rfid)
-		callbacks.OnStopButtonPress(evseId, rfid.Rfid)
+		log.Info("Stopping evse ", evseId, ". idToken: ", id_token.IdToken, " (", id_token.Type, ")")
+		callbacks.OnStopButtonPress(evseId, id_token)
 		//w.WriteHeader(http.StatusOK)
 	}
 }
@@ -106,6 +174,17 @@ func onGetEVSEsActiveIds(w http.ResponseWriter, req *http.Request) {
 	w.Write(json_str)
 }
 
+func onGetAuthCache(w http.ResponseWriter, req *http.Request) {
+	allowCORS(w)
+	data := callbacks.OnGetAuthCache()
+	json_str, err := json.Marshal(data)
+	if err != nil {
+		log.Error("Failed to marshal authorization cache")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json_str)
+}
+
 func getEVSEIDFromReq(req *http.Request) (int, error) {
 	if evseId, ok := mux.Vars(req)["EVSEID"]; !ok {
 		return -1, errors.New("failed to retrieve RFID from URL path parameters")
@@ -125,17 +204,34 @@ func getRFIDFromReq(req *http.Request) (string, error) {
 	}
 }
 
+var server *http.Server
+
 func Start(_callbacks UICallbacks) {
 	callbacks = _callbacks
 
 	var waitgroup sync.WaitGroup
 
+	fmt.Println("Creating http server...")
+	router := NewRouter()
+	server = &http.Server{Addr: ":8090", Handler: router}
+
 	waitgroup.Add(1)
-	go func() {
-		fmt.Println("Creating http server...")
-		router := NewRouter()
-		log.Fatal(http.ListenAndServe(":8090", router))
+	go func(server *http.Server) {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 		waitgroup.Done()
-	}()
+	}(server)
+
+}
 
+// Stops the http server, e.g. before the Charging Station is restarted
+func Stop(ctx context.Context) {
+	if server == nil {
+		return
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("failed to stop http server: ", err)
+	}
+	server = nil
 }
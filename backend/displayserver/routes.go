@@ -74,4 +74,11 @@ var routes = Routes{
 		"/evses/active/ids",
 		onGetEVSEsActiveIds,
 	},
+
+	Route{
+		"authCache",
+		strings.ToUpper("Get"),
+		"/diagnostics/authcache",
+		onGetAuthCache,
+	},
 }
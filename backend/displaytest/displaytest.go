@@ -48,7 +48,7 @@ func RunDisplayTest() {
 
 	// Set up the UI logic
 	UI_callbacks := &displayserver.UICallbacks{
-		OnStartButtonPress: func(evseId int, rfid string) {
+		OnStartButtonPress: func(evseId int, idToken displayserver.IdTokenForUI) {
 			log.Info("Start button pressed for evse: ", evseId)
 			if evseId > len(evses)-1 {
 				log.Error("No such evse")
@@ -58,7 +58,7 @@ func RunDisplayTest() {
 			evses[evseId].IsChargingEnabled = 1
 			evses[evseId].IsCharging = 1
 		},
-		OnStopButtonPress: func(evseId int, rfid string) {
+		OnStopButtonPress: func(evseId int, idToken displayserver.IdTokenForUI) {
 			log.Info("Stop button pressed for evse: ", evseId)
 			if evseId > len(evses)-1 {
 				log.Error("No such evse")
@@ -81,6 +81,9 @@ func RunDisplayTest() {
 			}
 			return result
 		},
+		OnGetAuthCache: func() displayserver.AuthCacheDataForUI {
+			return displayserver.AuthCacheDataForUI{Entries: make([]displayserver.AuthCacheEntryForUI, 0)}
+		},
 	}
 
 	go displayserver.Start(*UI_callbacks)
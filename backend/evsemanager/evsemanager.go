@@ -1,17 +1,28 @@
 package evsemanager
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Replies of the EVSE controller to an unlock command
+type UnlockStatus string
+
+const (
+	Unlocked                     UnlockStatus = "Unlocked"
+	UnlockFailed                 UnlockStatus = "UnlockFailed"
+	OngoingAuthorizedTransaction UnlockStatus = "OngoingAuthorizedTransaction"
+	UnknownConnector             UnlockStatus = "UnknownConnector"
+)
+
 type AsyncEVSEMessage struct {
 	Message         string
 	SuccessCallback func(string)
@@ -25,6 +36,9 @@ type EVSE struct {
 	IsError                          int
 	EnergyActiveNet_wh               int64
 	PowerActiveImport_w              int64
+	ChargingLimit                    float64 // last limit sent to the EVSE controller, 0 if there is none
+	ChargingLimitUnit                string  // "A" per phase or "W", empty if the EVSE has no limit
+	ChargingLimitPhases              int
 	OnEVConnected_fire_once          func()
 	OnEVDisconnected_fire_once       func()
 	OnEVSEChargingEnabled_fire_once  func()
@@ -46,6 +60,10 @@ type EVSE struct {
 	out_channel                      chan string
 	lastMessageSentAt                time.Time
 	signal                           chan string
+	unlock_replies                   chan UnlockStatus
+	unlock_mu                        sync.Mutex
+	closed                           chan struct{}
+	close_once                       sync.Once
 }
 
 func CreateAndRunEVSE(id int, servAddr string) (*EVSE, error) {
@@ -78,6 +96,8 @@ func CreateAndRunEVSE(id int, servAddr string) (*EVSE, error) {
 		out_channel:                      make(chan string, 10),
 		lastMessageSentAt:                time.Now(),
 		signal:                           make(chan string),
+		unlock_replies:                   make(chan UnlockStatus, 1),
+		closed:                           make(chan struct{}),
 	}
 
 	// Connect to EVSE TCP server
@@ -100,18 +120,23 @@ func CreateAndRunEVSE(id int, servAddr string) (*EVSE, error) {
 	}
 	_, auth_err := evse_new.tcp_conn.Write([]byte(string(evse_pwd) + "\n"))
 	if auth_err != nil {
-		println("Write to server failed:", err.Error())
-		os.Exit(1)
+		println("Write to server failed:", auth_err.Error())
+		evse_new.tcp_conn.Close()
+		return nil, auth_err
 	}
 
 	// LISTEN
 	go func() { // listen for incoming messages and put them into a queue
+		defer close(evse_new.in_channel)
 		reply := make([]byte, 50)
 		for {
 			n, err := evse_new.tcp_conn.Read(reply)
 			if err != nil {
-				log.Error("TCP read failed:", err.Error())
-				os.Exit(1)
+				if !evse_new.isClosed() {
+					log.Error("TCP read failed:", err.Error())
+					evse_new.Disconnect()
+				}
+				return
 			}
 			if n != 0 {
 				reply_str_raw := string(reply[:n])
@@ -141,8 +166,7 @@ func CreateAndRunEVSE(id int, servAddr string) (*EVSE, error) {
 		defer ticker_status.Stop()
 		for {
 			select {
-			case t := <-ticker_status.C:
-				_ = t
+			case <-ticker_status.C:
 				if len(evse_new.out_channel) == 0 {
 					break
 				}
@@ -152,9 +176,11 @@ func CreateAndRunEVSE(id int, servAddr string) (*EVSE, error) {
 				_, err := evse_new.tcp_conn.Write([]byte(new_mess))
 				if err != nil {
 					println("Write to server failed:", err.Error())
-					os.Exit(1)
+					evse_new.Disconnect()
+					return
 				}
-			default:
+			case <-evse_new.closed:
+				return
 			}
 		}
 	}()
@@ -165,13 +191,13 @@ func CreateAndRunEVSE(id int, servAddr string) (*EVSE, error) {
 		defer ticker_status.Stop()
 		for {
 			select {
-			case t := <-ticker_status.C:
-				_ = t
+			case <-ticker_status.C:
 				if len(evse_new.out_channel) == 0 { // TODO implement proper limit
 					evse_new.out_channel <- "status?\n"
 					evse_new.out_channel <- "metervalues?\n"
 				}
-			default:
+			case <-evse_new.closed:
+				return
 			}
 		}
 	}()
@@ -180,11 +206,56 @@ func CreateAndRunEVSE(id int, servAddr string) (*EVSE, error) {
 }
 
 func (evse *EVSE) EnableCharging() {
-	evse.out_channel <- "start\n"
+	evse.sendCommand("start\n")
 }
 
 func (evse *EVSE) DisableCharging() {
-	evse.out_channel <- "stop\n"
+	evse.sendCommand("stop\n")
+}
+
+// Asks the EVSE controller to release the cable of the connector and waits for the reply
+func (evse *EVSE) Unlock(ctx context.Context, connectorId int) (UnlockStatus, error) {
+	evse.unlock_mu.Lock()
+	defer evse.unlock_mu.Unlock()
+
+	// Drop a late reply to a previous command
+	select {
+	case <-evse.unlock_replies:
+	default:
+	}
+	evse.sendCommand(fmt.Sprintf("unlock %d\n", connectorId))
+	select {
+	case status := <-evse.unlock_replies:
+		return status, nil
+	case <-ctx.Done():
+		return UnlockFailed, ctx.Err()
+	case <-evse.closed:
+		return UnlockFailed, fmt.Errorf("EVSE %d is disconnected", evse.Id)
+	}
+}
+
+// Limits the current (A, per phase) or power (W) the EVSE offers to the EV
+func (evse *EVSE) SetChargingLimit(limit float64, unit string, phases int) {
+	evse.ChargingLimit = limit
+	evse.ChargingLimitUnit = unit
+	evse.ChargingLimitPhases = phases
+	evse.sendCommand(fmt.Sprintf("limit %.1f %s %d\n", limit, unit, phases))
+}
+
+// The EVSE may deliver its maximum again
+func (evse *EVSE) ClearChargingLimit() {
+	evse.ChargingLimit = 0
+	evse.ChargingLimitUnit = ""
+	evse.ChargingLimitPhases = 0
+	evse.sendCommand("limit none\n")
+}
+
+func (evse *EVSE) sendCommand(command string) {
+	select {
+	case evse.out_channel <- command:
+	case <-evse.closed:
+		log.Warning("EVSE ", evse.Id, " is disconnected, command not sent: ", strings.TrimSpace(command))
+	}
 }
 
 func (evse *EVSE) processEVSEMessage(evse_reply string) {
@@ -205,13 +276,28 @@ func (evse *EVSE) processEVSEMessage(evse_reply string) {
 		evse.updateStatus(message_body)
 	case "metervalues":
 		evse.updateMeterValues(message_body)
+	case "unlock":
+		evse.processUnlockReply(message_body)
 	default:
 		log.Warning("Received unknown message type from EVSE")
 	}
 }
 
+// Stops the goroutines of the EVSE and closes its TCP connection
 func (evse *EVSE) Disconnect() {
-	evse.tcp_conn.Close()
+	evse.close_once.Do(func() {
+		close(evse.closed)
+		evse.tcp_conn.Close()
+	})
+}
+
+func (evse *EVSE) isClosed() bool {
+	select {
+	case <-evse.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 func (evse *EVSE) updateStatus(statusString string) {
@@ -303,6 +389,21 @@ func (evse *EVSE) updateStatus(statusString string) {
 
 }
 
+func (evse *EVSE) processUnlockReply(replyString string) {
+	status := UnlockStatus(strings.TrimSpace(replyString))
+	switch status {
+	case Unlocked, UnlockFailed, OngoingAuthorizedTransaction, UnknownConnector:
+	default:
+		log.Error("unknown unlock reply from EVSE ", evse.Id, ": ", replyString)
+		status = UnlockFailed
+	}
+	select {
+	case evse.unlock_replies <- status:
+	default:
+		log.Warning("Dropping unexpected unlock reply from EVSE ", evse.Id, ": ", status)
+	}
+}
+
 func (evse *EVSE) updateMeterValues(meterValuesString string) {
 	log.Trace("Original meterValues string: ", meterValuesString)
 	split_result := strings.Split(meterValuesString, ",")
@@ -0,0 +1,201 @@
+package loadmanager
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How the site limit is shared between the EVSEs an EV is connected to
+type Strategy string
+
+const (
+	// Every EV gets the same current, what an EV does not use is shared by the others
+	EqualShare Strategy = "EqualShare"
+	// EVs get as much as they can take in the order they were plugged in
+	FirstCome Strategy = "FirstCome"
+	// EVs of a higher priority idToken group are served first, EVs of the same priority share equally
+	Priority Strategy = "Priority"
+)
+
+// IEC 61851: an EV cannot charge with less current than this
+const MinimumCurrent = 6.0
+
+// A charging EV is guaranteed this much more current than it draws, so it can ramp up even if the site is busy
+const rampUp = 2.0
+
+// EVSE with an EV connected, currents are in A per phase
+type consumer struct {
+	evseId      int
+	connectedAt time.Time
+	priority    int
+	demand      float64
+	limit       float64
+}
+
+// Tracks which EVSEs have an EV connected and shares the site limit between them.
+// Every EVSE is assumed to draw the same current on all of its phases.
+type LoadManager struct {
+	connected  map[int]time.Time
+	priorities map[int]int
+	mu         sync.Mutex
+}
+
+func CreateLoadManager() *LoadManager {
+	return &LoadManager{
+		connected:  make(map[int]time.Time),
+		priorities: make(map[int]int),
+	}
+}
+
+// Called when an EV is plugged in to the EVSE
+func (lm *LoadManager) Connect(evseId int) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if _, ok := lm.connected[evseId]; !ok {
+		lm.connected[evseId] = time.Now()
+	}
+}
+
+// Called when the EV is unplugged from the EVSE
+func (lm *LoadManager) Disconnect(evseId int) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	delete(lm.connected, evseId)
+}
+
+// Priority of the EVSE for the Priority strategy, 0 is the lowest
+func (lm *LoadManager) SetPriority(evseId int, priority int) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if priority == 0 {
+		delete(lm.priorities, evseId)
+		return
+	}
+	lm.priorities[evseId] = priority
+}
+
+// Shares siteLimit between the EVSEs with an EV connected. limits are the most the EVSEs may draw according to
+// their charging profiles, measured is what they draw now, nil if the EV is not charging. The result has an
+// allocation for every connected EVSE, EVSEs that get less than MinimumCurrent get 0.
+func (lm *LoadManager) Distribute(siteLimit float64, strategy Strategy, limits map[int]float64, measured map[int]*float64) map[int]float64 {
+	lm.mu.Lock()
+	consumers := make([]consumer, 0, len(lm.connected))
+	for evseId, connected_at := range lm.connected {
+		limit, ok := limits[evseId]
+		if !ok {
+			continue
+		}
+		consumers = append(consumers, consumer{
+			evseId:      evseId,
+			connectedAt: connected_at,
+			priority:    lm.priorities[evseId],
+			demand:      demand(limit, measured[evseId]),
+			limit:       limit,
+		})
+	}
+	lm.mu.Unlock()
+
+	// FirstCome order, it also decides who goes without if there is not enough for everyone
+	sort.Slice(consumers, func(i, j int) bool {
+		if strategy == Priority && consumers[i].priority != consumers[j].priority {
+			return consumers[i].priority > consumers[j].priority
+		}
+		if !consumers[i].connectedAt.Equal(consumers[j].connectedAt) {
+			return consumers[i].connectedAt.Before(consumers[j].connectedAt)
+		}
+		return consumers[i].evseId < consumers[j].evseId
+	})
+
+	dropped := make([]int, 0)
+	for {
+		allocations := allocateWithSpare(siteLimit, strategy, consumers)
+		// Drop the last EV that would get less than the minimum, the others may get enough without it
+		last := -1
+		for i := len(consumers) - 1; i >= 0 && last < 0; i-- {
+			if allocation := allocations[consumers[i].evseId]; allocation > 0 && allocation < MinimumCurrent {
+				last = i
+			}
+		}
+		if last < 0 {
+			for _, evseId := range dropped {
+				allocations[evseId] = 0
+			}
+			return allocations
+		}
+		dropped = append(dropped, consumers[last].evseId)
+		consumers = append(consumers[:last], consumers[last+1:]...)
+	}
+}
+
+// An EV that is not charging yet reserves the minimum, a charging EV may take a bit more than it draws now
+func demand(limit float64, measured *float64) float64 {
+	wanted := MinimumCurrent
+	if measured != nil {
+		wanted = math.Max(*measured+rampUp, MinimumCurrent)
+	}
+	return math.Min(wanted, limit)
+}
+
+// Allocates the demands first, then shares what is left up to the limits of the EVs
+func allocateWithSpare(siteLimit float64, strategy Strategy, consumers []consumer) map[int]float64 {
+	allocations := allocate(siteLimit, strategy, consumers)
+	spare := siteLimit
+	for _, allocation := range allocations {
+		spare -= allocation
+	}
+	wanting_more := make([]consumer, 0, len(consumers))
+	for _, c := range consumers {
+		c.demand = c.limit - allocations[c.evseId]
+		wanting_more = append(wanting_more, c)
+	}
+	for evseId, extra := range allocate(spare, strategy, wanting_more) {
+		allocations[evseId] += extra
+	}
+	return allocations
+}
+
+// Allocations of the consumers, which are in FirstCome order
+func allocate(siteLimit float64, strategy Strategy, consumers []consumer) map[int]float64 {
+	allocations := make(map[int]float64, len(consumers))
+	remaining := math.Max(siteLimit, 0)
+	switch strategy {
+	case FirstCome:
+		for _, c := range consumers {
+			allocations[c.evseId] = round(math.Min(c.demand, remaining))
+			remaining -= allocations[c.evseId]
+		}
+	case Priority:
+		for start := 0; start < len(consumers); {
+			end := start
+			for end < len(consumers) && consumers[end].priority == consumers[start].priority {
+				end++
+			}
+			remaining -= shareEqually(remaining, consumers[start:end], allocations)
+			start = end
+		}
+	default:
+		shareEqually(remaining, consumers, allocations)
+	}
+	return allocations
+}
+
+// Water-filling: EVs that want less than an equal share get what they want, the rest is shared by the others.
+// Returns the total allocated.
+func shareEqually(available float64, consumers []consumer, allocations map[int]float64) float64 {
+	unsatisfied := append([]consumer{}, consumers...)
+	sort.SliceStable(unsatisfied, func(i, j int) bool { return unsatisfied[i].demand < unsatisfied[j].demand })
+	total := 0.0
+	for i, c := range unsatisfied {
+		share := (available - total) / float64(len(unsatisfied)-i)
+		allocations[c.evseId] = round(math.Min(c.demand, share))
+		total += allocations[c.evseId]
+	}
+	return total
+}
+
+// Allocations are rounded down to 0.1 A so they never add up to more than the site limit
+func round(current float64) float64 {
+	return math.Max(math.Floor(current*10)/10, 0)
+}
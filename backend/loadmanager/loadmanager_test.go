@@ -0,0 +1,146 @@
+package loadmanager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2022, 10, 3, 12, 0, 0, 0, time.UTC)
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
+
+// EV of the test, plugged in minutesAfterStart after testStart
+type testEV struct {
+	evseId            int
+	minutesAfterStart int
+	priority          int
+	limit             float64
+	measured          *float64
+}
+
+func TestDistribute(t *testing.T) {
+	tests := []struct {
+		name      string
+		siteLimit float64
+		strategy  Strategy
+		evs       []testEV
+		want      map[int]float64
+	}{
+		{
+			name:      "EqualShare shares the spare current equally",
+			siteLimit: 30,
+			strategy:  EqualShare,
+			evs:       []testEV{{1, 0, 0, 32, nil}, {2, 1, 0, 32, nil}, {3, 2, 0, 32, nil}},
+			want:      map[int]float64{1: 10, 2: 10, 3: 10},
+		},
+		{
+			name:      "EqualShare gives what an EV cannot use to the others",
+			siteLimit: 30,
+			strategy:  EqualShare,
+			evs:       []testEV{{1, 0, 0, 8, floatPtr(3)}, {2, 1, 0, 32, nil}, {3, 2, 0, 32, nil}},
+			want:      map[int]float64{1: 8, 2: 11, 3: 11},
+		},
+		{
+			name:      "EqualShare rounds down to 0.1 A and shares the remainder",
+			siteLimit: 20,
+			strategy:  EqualShare,
+			evs:       []testEV{{1, 0, 0, 32, nil}, {2, 1, 0, 32, nil}, {3, 2, 0, 32, nil}},
+			want:      map[int]float64{1: 6.6, 2: 6.7, 3: 6.7},
+		},
+		{
+			name:      "FirstCome serves the EVs in the order they were plugged in",
+			siteLimit: 30,
+			strategy:  FirstCome,
+			evs:       []testEV{{1, 2, 0, 16, nil}, {2, 0, 0, 16, nil}, {3, 1, 0, 16, nil}},
+			want:      map[int]float64{1: 6, 2: 16, 3: 8},
+		},
+		{
+			name:      "FirstCome gives the spare current of the first EV to the next one",
+			siteLimit: 30,
+			strategy:  FirstCome,
+			evs:       []testEV{{1, 0, 0, 10, floatPtr(4)}, {2, 1, 0, 32, nil}},
+			want:      map[int]float64{1: 10, 2: 20},
+		},
+		{
+			name:      "Priority serves the higher priority first and shares equally within it",
+			siteLimit: 30,
+			strategy:  Priority,
+			evs:       []testEV{{1, 0, 0, 16, nil}, {2, 1, 1, 16, nil}, {3, 2, 1, 16, nil}},
+			want:      map[int]float64{1: 6, 2: 12, 3: 12},
+		},
+		{
+			name:      "Priority gives the lower priority what the higher one cannot use",
+			siteLimit: 30,
+			strategy:  Priority,
+			evs:       []testEV{{1, 0, 0, 32, nil}, {2, 1, 2, 10, nil}},
+			want:      map[int]float64{1: 20, 2: 10},
+		},
+		{
+			name:      "The EV plugged in last goes without if not everyone can get the minimum",
+			siteLimit: 15,
+			strategy:  EqualShare,
+			evs:       []testEV{{1, 0, 0, 32, nil}, {2, 1, 0, 32, nil}, {3, 2, 0, 32, nil}},
+			want:      map[int]float64{1: 7.5, 2: 7.5, 3: 0},
+		},
+		{
+			name:      "The lowest priority goes without if not everyone can get the minimum",
+			siteLimit: 13,
+			strategy:  Priority,
+			evs:       []testEV{{1, 0, 0, 32, nil}, {2, 1, 1, 32, nil}, {3, 2, 0, 32, nil}},
+			want:      map[int]float64{1: 6, 2: 7, 3: 0},
+		},
+		{
+			name:      "Nobody charges below the minimum",
+			siteLimit: 4,
+			strategy:  EqualShare,
+			evs:       []testEV{{1, 0, 0, 32, nil}, {2, 1, 0, 32, nil}},
+			want:      map[int]float64{1: 0, 2: 0},
+		},
+		{
+			name:      "Nobody charges without a site limit",
+			siteLimit: 0,
+			strategy:  FirstCome,
+			evs:       []testEV{{1, 0, 0, 32, nil}},
+			want:      map[int]float64{1: 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lm := CreateLoadManager()
+			limits := make(map[int]float64)
+			measured := make(map[int]*float64)
+			for _, ev := range test.evs {
+				lm.connected[ev.evseId] = testStart.Add(time.Duration(ev.minutesAfterStart) * time.Minute)
+				lm.SetPriority(ev.evseId, ev.priority)
+				limits[ev.evseId] = ev.limit
+				measured[ev.evseId] = ev.measured
+			}
+			got := lm.Distribute(test.siteLimit, test.strategy, limits, measured)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			total := 0.0
+			for _, allocation := range got {
+				total += allocation
+			}
+			if total > test.siteLimit {
+				t.Errorf("allocated %v A, more than the site limit of %v A", total, test.siteLimit)
+			}
+		})
+	}
+}
+
+// EVSEs the limits do not cover get no allocation
+func TestDistributeSkipsEvsesWithoutLimit(t *testing.T) {
+	lm := CreateLoadManager()
+	lm.Connect(1)
+	lm.Connect(2)
+	got := lm.Distribute(32, EqualShare, map[int]float64{1: 16}, map[int]*float64{})
+	want := map[int]float64{1: 16}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
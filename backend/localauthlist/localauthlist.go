@@ -0,0 +1,160 @@
+package localauthlist
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/SendLocalListRequest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Entries are kept in the representation of SendLocalList
+type AuthorizationData = SendLocalListRequest.AuthorizationData
+
+// A Differential update whose version is not newer than the version of the list
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// The update could not be stored, the list is left unchanged
+var ErrNotPersisted = errors.New("unable to persist the local authorization list")
+
+// The version is kept in the bucket of the entries, so both are replaced at once.
+// Entry keys always contain a colon, the version key does not.
+const versionKey = "version"
+
+// D01: idTokens the CSMS sent to authorize without asking it, e.g. while offline
+type LocalList struct {
+	version int
+	entries map[string]AuthorizationData
+	store   persistence.Store
+	mu      sync.Mutex
+}
+
+// idTokens of different types may have the same value
+func key(idTokenType string, idToken string) string {
+	return idTokenType + ":" + idToken
+}
+
+func dataKey(data AuthorizationData) string {
+	return key(string(data.IdToken.Type), data.IdToken.IdToken)
+}
+
+// Creates the list with the entries that were installed before the restart
+func CreateLocalList(store persistence.Store) *LocalList {
+	list_new := &LocalList{
+		entries: make(map[string]AuthorizationData),
+		store:   store,
+	}
+	if _, err := store.Get(persistence.LocalListBucket, versionKey, &list_new.version); err != nil {
+		log.Error("unable to read the version of the local authorization list: ", err)
+	}
+	keys, err := store.Keys(persistence.LocalListBucket)
+	if err != nil {
+		log.Error("unable to read the persisted local authorization list: ", err)
+		return list_new
+	}
+	for _, k := range keys {
+		if k == versionKey {
+			continue
+		}
+		var data AuthorizationData
+		if _, err := store.Get(persistence.LocalListBucket, k, &data); err != nil {
+			log.Error("skipping unreadable local authorization list entry ", k, ": ", err)
+			continue
+		}
+		list_new.entries[k] = data
+	}
+	return list_new
+}
+
+// Version of the list, 0 if the CSMS has not sent a list yet
+func (l *LocalList) Version() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.version
+}
+
+func (l *LocalList) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// IdTokenInfo of the idToken, false if it is not in the list
+func (l *LocalList) Lookup(idTokenType string, idToken string) (SendLocalListRequest.IdTokenInfoType, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, ok := l.entries[key(idTokenType, idToken)]
+	if !ok || data.IdTokenInfo == nil {
+		return SendLocalListRequest.IdTokenInfoType{}, false
+	}
+	return *data.IdTokenInfo, true
+}
+
+// D01: a Full update replaces the list. A Differential update adds or replaces the entries with an
+// idTokenInfo and removes the ones without. The list is left unchanged if the update is rejected or cannot be stored.
+func (l *LocalList) Update(req *SendLocalListRequest.SendLocalListRequestJson, maxEntries int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := req.UpdateType == SendLocalListRequest.UpdateEnumType_1_Full
+	if req.VersionNumber <= 0 {
+		return fmt.Errorf("versionNumber %d is not positive", req.VersionNumber)
+	}
+	if !full && req.VersionNumber <= l.version {
+		return ErrVersionMismatch
+	}
+
+	updated := make(map[string]AuthorizationData)
+	if !full {
+		for k, data := range l.entries {
+			updated[k] = data
+		}
+	}
+	seen := make(map[string]bool, len(req.LocalAuthorizationList))
+	for _, data := range req.LocalAuthorizationList {
+		k := dataKey(data)
+		if seen[k] {
+			return fmt.Errorf("idToken %s is in the list more than once", data.IdToken.IdToken)
+		}
+		seen[k] = true
+		if data.IdTokenInfo == nil {
+			if full {
+				return fmt.Errorf("idToken %s has no idTokenInfo", data.IdToken.IdToken)
+			}
+			delete(updated, k)
+			continue
+		}
+		updated[k] = data
+	}
+	if len(updated) > maxEntries {
+		return fmt.Errorf("the list would have %d entries, at most %d are supported", len(updated), maxEntries)
+	}
+
+	// The entries and the version are written at once, a crash cannot leave a mix of two versions behind
+	values := make(map[string]interface{}, len(updated)+1)
+	for k, data := range updated {
+		values[k] = data
+	}
+	values[versionKey] = req.VersionNumber
+	if err := l.store.ReplaceBucket(persistence.LocalListBucket, values); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotPersisted, err)
+	}
+	l.entries = updated
+	l.version = req.VersionNumber
+	return nil
+}
+
+// Entries of the list ordered by idToken
+func (l *LocalList) Entries() []AuthorizationData {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]AuthorizationData, 0, len(l.entries))
+	for _, data := range l.entries {
+		result = append(result, data)
+	}
+	sort.Slice(result, func(i, j int) bool { return dataKey(result[i]) < dataKey(result[j]) })
+	return result
+}
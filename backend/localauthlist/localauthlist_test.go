@@ -0,0 +1,217 @@
+package localauthlist
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/SendLocalListRequest"
+)
+
+const (
+	full         = SendLocalListRequest.UpdateEnumType_1_Full
+	differential = SendLocalListRequest.UpdateEnumType_1_Differential
+	accepted     = SendLocalListRequest.AuthorizationStatusEnumType_1_Accepted
+	blocked      = SendLocalListRequest.AuthorizationStatusEnumType_1_Blocked
+	iso14443     = string(SendLocalListRequest.IdTokenEnumType_1_ISO14443)
+)
+
+// ocpp-messages-go does not unmarshal an idToken without additionalInfo or an idTokenInfo without evseId,
+// both are set so that the entries can be restored after reopening
+func entry(idToken string, status SendLocalListRequest.AuthorizationStatusEnumType_1) AuthorizationData {
+	return AuthorizationData{
+		IdToken: SendLocalListRequest.IdTokenType{
+			IdToken:        idToken,
+			Type:           SendLocalListRequest.IdTokenEnumType(iso14443),
+			AdditionalInfo: []SendLocalListRequest.AdditionalInfoType{{AdditionalIdToken: idToken, Type: "test"}},
+		},
+		IdTokenInfo: &SendLocalListRequest.IdTokenInfoType{
+			Status: SendLocalListRequest.AuthorizationStatusEnumType(status),
+			EvseId: []int{1},
+		},
+	}
+}
+
+// Entry of a Differential update that removes the idToken
+func removal(idToken string) AuthorizationData {
+	data := entry(idToken, accepted)
+	data.IdTokenInfo = nil
+	return data
+}
+
+func request(updateType SendLocalListRequest.UpdateEnumType_1, version int, entries ...AuthorizationData) *SendLocalListRequest.SendLocalListRequestJson {
+	return &SendLocalListRequest.SendLocalListRequestJson{
+		UpdateType:             updateType,
+		VersionNumber:          version,
+		LocalAuthorizationList: entries,
+	}
+}
+
+// Status of every idToken of the list
+func statuses(l *LocalList) map[string]SendLocalListRequest.AuthorizationStatusEnumType {
+	result := make(map[string]SendLocalListRequest.AuthorizationStatusEnumType)
+	for _, data := range l.Entries() {
+		result[data.IdToken.IdToken] = data.IdTokenInfo.Status
+	}
+	return result
+}
+
+func TestUpdate(t *testing.T) {
+	// The list of every test before the update, at version 2
+	installed := request(full, 2, entry("A", accepted), entry("B", accepted))
+	tests := []struct {
+		name        string
+		update      *SendLocalListRequest.SendLocalListRequestJson
+		maxEntries  int
+		wantErr     bool
+		wantVersion int
+		want        map[string]SendLocalListRequest.AuthorizationStatusEnumType
+	}{
+		{
+			name:        "Full replaces the list",
+			update:      request(full, 3, entry("C", accepted)),
+			maxEntries:  10,
+			wantVersion: 3,
+			want:        map[string]SendLocalListRequest.AuthorizationStatusEnumType{"C": "Accepted"},
+		},
+		{
+			name:        "Full may install an older version",
+			update:      request(full, 1, entry("A", blocked)),
+			maxEntries:  10,
+			wantVersion: 1,
+			want:        map[string]SendLocalListRequest.AuthorizationStatusEnumType{"A": "Blocked"},
+		},
+		{
+			name:        "Full without entries empties the list",
+			update:      request(full, 3),
+			maxEntries:  10,
+			wantVersion: 3,
+			want:        map[string]SendLocalListRequest.AuthorizationStatusEnumType{},
+		},
+		{
+			name:        "Differential adds, replaces and removes entries",
+			update:      request(differential, 3, entry("A", blocked), removal("B"), entry("C", accepted)),
+			maxEntries:  10,
+			wantVersion: 3,
+			want:        map[string]SendLocalListRequest.AuthorizationStatusEnumType{"A": "Blocked", "C": "Accepted"},
+		},
+		{
+			name:        "Differential removal of an unknown idToken is ignored",
+			update:      request(differential, 3, removal("C")),
+			maxEntries:  10,
+			wantVersion: 3,
+			want:        map[string]SendLocalListRequest.AuthorizationStatusEnumType{"A": "Accepted", "B": "Accepted"},
+		},
+		{
+			name:       "Full entries need an idTokenInfo",
+			update:     request(full, 3, removal("C")),
+			maxEntries: 10,
+			wantErr:    true,
+		},
+		{
+			name:       "an idToken may be in the update only once",
+			update:     request(differential, 3, entry("C", accepted), entry("C", blocked)),
+			maxEntries: 10,
+			wantErr:    true,
+		},
+		{
+			name:       "the version must be positive",
+			update:     request(full, 0, entry("C", accepted)),
+			maxEntries: 10,
+			wantErr:    true,
+		},
+		{
+			name:       "Full larger than maxEntries",
+			update:     request(full, 3, entry("A", accepted), entry("B", accepted), entry("C", accepted)),
+			maxEntries: 2,
+			wantErr:    true,
+		},
+		{
+			name:       "Differential growing the list beyond maxEntries",
+			update:     request(differential, 3, entry("C", accepted)),
+			maxEntries: 2,
+			wantErr:    true,
+		},
+		{
+			name:        "Differential that removes as many entries as it adds fits maxEntries",
+			update:      request(differential, 3, removal("A"), entry("C", accepted)),
+			maxEntries:  2,
+			wantVersion: 3,
+			want:        map[string]SendLocalListRequest.AuthorizationStatusEnumType{"B": "Accepted", "C": "Accepted"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := CreateLocalList(persistence.NewMemoryStore())
+			if err := l.Update(installed, 10); err != nil {
+				t.Fatalf("installing the list: %v", err)
+			}
+			err := l.Update(test.update, test.maxEntries)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Update() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				// A rejected update leaves the list unchanged
+				test.wantVersion = 2
+				test.want = map[string]SendLocalListRequest.AuthorizationStatusEnumType{"A": "Accepted", "B": "Accepted"}
+			}
+			if l.Version() != test.wantVersion {
+				t.Errorf("Version() = %d, want %d", l.Version(), test.wantVersion)
+			}
+			if got := statuses(l); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("list = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDifferentialVersionMismatch(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		l := CreateLocalList(persistence.NewMemoryStore())
+		if err := l.Update(request(full, 2, entry("A", accepted)), 10); err != nil {
+			t.Fatalf("installing the list: %v", err)
+		}
+		err := l.Update(request(differential, version, entry("B", accepted)), 10)
+		if !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("Differential version %d on version 2: error = %v, want %v", version, err, ErrVersionMismatch)
+		}
+		if l.Len() != 1 {
+			t.Errorf("Differential version %d on version 2: Len() = %d, want 1", version, l.Len())
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	l := CreateLocalList(persistence.NewMemoryStore())
+	if err := l.Update(request(full, 1, entry("A", blocked)), 10); err != nil {
+		t.Fatalf("installing the list: %v", err)
+	}
+	if info, found := l.Lookup(iso14443, "A"); !found || info.Status != "Blocked" {
+		t.Errorf("Lookup(A) = %v, %v, want Blocked, true", info.Status, found)
+	}
+	// idTokens of different types may have the same value
+	if _, found := l.Lookup("Central", "A"); found {
+		t.Error("Lookup(A) of another idToken type found the entry")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	store := persistence.NewMemoryStore()
+	l := CreateLocalList(store)
+	if err := l.Update(request(full, 1, entry("A", accepted), entry("B", accepted)), 10); err != nil {
+		t.Fatalf("installing the list: %v", err)
+	}
+	if err := l.Update(request(differential, 2, removal("A"), entry("C", blocked)), 10); err != nil {
+		t.Fatalf("Differential update: %v", err)
+	}
+
+	reopened := CreateLocalList(store)
+	if reopened.Version() != 2 {
+		t.Errorf("restored Version() = %d, want 2", reopened.Version())
+	}
+	want := map[string]SendLocalListRequest.AuthorizationStatusEnumType{"B": "Accepted", "C": "Blocked"}
+	if got := statuses(reopened); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored list = %v, want %v", got, want)
+	}
+}
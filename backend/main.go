@@ -3,11 +3,17 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gregszalay/ocpp-charging-station-go/chargingstation"
+	"github.com/gregszalay/ocpp-charging-station-go/ocppclient"
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,6 +21,14 @@ var debug_level = flag.String("debugl", "Info", "Debug log level")
 var ocpp_host = flag.String("host", "localhost:3000", "ocpp websocket server host")
 var ocpp_url = flag.String("url", "/ocpp", "ocpp URL")
 var ocpp_station_id = flag.String("id", "CS001", "id of the charging station")
+var security_profile = flag.Int("profile", 2, "OCPP security profile: 1 (basic auth over ws), 2 (basic auth over TLS), 3 (TLS client certificate)")
+var ca_cert_file = flag.String("ca", "", "CA bundle to verify the CSMS certificate, system roots are used if empty")
+var subprotocols = flag.String("subprotocols", "ocpp2.0.1", "comma separated list of websocket subprotocols offered to the CSMS, in order of preference")
+var basic_auth_pwd_file = flag.String("pwdfile", "basic_auth.pwd", "file containing the BasicAuthPassword for security profiles 1 and 2")
+var state_dir = flag.String("statedir", "state", "directory where the state of the charging station is kept across restarts")
+
+// How long a restart waits for the previous instance to release the offline queue
+const restartTimeout = time.Minute
 
 func main() {
 	setLogLevel(*debug_level)
@@ -24,30 +38,63 @@ func main() {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
-	csms_url := url.URL{Scheme: "wss", Host: *ocpp_host, Path: *ocpp_url + "/" + *ocpp_station_id}
+	scheme := "wss"
+	if *security_profile == ocppclient.SecurityProfileBasicAuth {
+		scheme = "ws"
+	}
+	csms_url := url.URL{Scheme: scheme, Host: *ocpp_host, Path: *ocpp_url + "/" + *ocpp_station_id}
 	fmt.Printf("connecting to CSMS through URL: %s\n", csms_url.String())
 
-	evseIPs := flag.Args() // e.g. "192.168.1.71:80"
+	client_config := ocppclient.DefaultClientConfig()
+	client_config.SecurityProfile = *security_profile
+	client_config.Identity = *ocpp_station_id
+	client_config.CACertFile = *ca_cert_file
+	client_config.Subprotocols = strings.Split(*subprotocols, ",")
+	if *security_profile != ocppclient.SecurityProfileTLSClientCert {
+		basic_auth_pwd, err := ioutil.ReadFile(*basic_auth_pwd_file)
+		if err != nil {
+			log.Error("Unable to read BasicAuthPassword from file: ", err)
+			return
+		}
+		client_config.BasicAuthPassword = strings.TrimSpace(string(basic_auth_pwd))
+	}
 
-	_, err := chargingstation.CreateAndRunChargingStation(csms_url, evseIPs)
+	store, err := persistence.OpenFileStore(*state_dir)
 	if err != nil {
-		log.Error("failed to create charging station: ", err)
+		log.Error("Unable to open the state directory: ", err)
 		return
 	}
+	defer store.Close()
+	client_config.OfflineQueueFile = filepath.Join(store.Dir(), client_config.OfflineQueueFile)
+
+	evseIPs := flag.Args() // e.g. "192.168.1.71:80"
 
 	// FOR TESTING ONLY
 	//displaytest.RunDisplayTest()
 
-	func() {
-		for {
-			select {
-			case <-interrupt:
-				os.Exit(1)
-			default:
-			}
+	// A Reset by the CSMS shuts the charging station down, then it is created again
+	for {
+		cs, err := chargingstation.CreateAndRunChargingStation(csms_url, evseIPs, client_config, store)
+		if err != nil {
+			log.Error("failed to create charging station: ", err)
+			return
 		}
-	}()
 
+		select {
+		case <-interrupt:
+			cs.ShutDown()
+			return
+		case <-cs.Restart_requests:
+			log.Info("Restarting the charging station")
+		}
+		// The new instance reopens the offline queue file, the old client must have closed it
+		select {
+		case <-cs.OcppClient.Done():
+		case <-time.After(restartTimeout):
+			log.Error("the OCPP client did not release the offline queue within ", restartTimeout, ", not restarting")
+			return
+		}
+	}
 }
 
 func setLogLevel(levelName string) {
@@ -0,0 +1,175 @@
+package ocppclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gregszalay/ocpp-messages-go/types/AuthorizeResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/BootNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/ClearedChargingLimitResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/DataTransferResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/FirmwareStatusNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/Get15118EVCertificateResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/GetCertificateStatusResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/HeartbeatResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/LogStatusNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/MeterValuesResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyChargingLimitResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyCustomerInformationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyDisplayMessagesResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyEVChargingNeedsResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyEVChargingScheduleResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyEventResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyMonitoringReportResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/NotifyReportResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/PublishFirmwareStatusNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/ReportChargingProfilesResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/ReservationStatusUpdateResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/SecurityEventNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/SignCertificateResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/StatusNotificationResponse"
+	"github.com/gregszalay/ocpp-messages-go/types/TransactionEventResponse"
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+)
+
+// Response payload types of the messages the Charging Station can send to the CSMS
+var response_types = map[string]func() interface{}{
+	"Authorize":            func() interface{} { return &AuthorizeResponse.AuthorizeResponseJson{} },
+	"BootNotification":     func() interface{} { return &BootNotificationResponse.BootNotificationResponseJson{} },
+	"ClearedChargingLimit": func() interface{} { return &ClearedChargingLimitResponse.ClearedChargingLimitResponseJson{} },
+	"DataTransfer":         func() interface{} { return &DataTransferResponse.DataTransferResponseJson{} },
+	"FirmwareStatusNotification": func() interface{} {
+		return &FirmwareStatusNotificationResponse.FirmwareStatusNotificationResponseJson{}
+	},
+	"Get15118EVCertificate":     func() interface{} { return &Get15118EVCertificateResponse.Get15118EVCertificateResponseJson{} },
+	"GetCertificateStatus":      func() interface{} { return &GetCertificateStatusResponse.GetCertificateStatusResponseJson{} },
+	"Heartbeat":                 func() interface{} { return &HeartbeatResponse.HeartbeatResponseJson{} },
+	"LogStatusNotification":     func() interface{} { return &LogStatusNotificationResponse.LogStatusNotificationResponseJson{} },
+	"MeterValues":               func() interface{} { return &MeterValuesResponse.MeterValuesResponseJson{} },
+	"NotifyChargingLimit":       func() interface{} { return &NotifyChargingLimitResponse.NotifyChargingLimitResponseJson{} },
+	"NotifyCustomerInformation": func() interface{} { return &NotifyCustomerInformationResponse.NotifyCustomerInformationResponseJson{} },
+	"NotifyDisplayMessages":     func() interface{} { return &NotifyDisplayMessagesResponse.NotifyDisplayMessagesResponseJson{} },
+	"NotifyEVChargingNeeds":     func() interface{} { return &NotifyEVChargingNeedsResponse.NotifyEVChargingNeedsResponseJson{} },
+	"NotifyEVChargingSchedule":  func() interface{} { return &NotifyEVChargingScheduleResponse.NotifyEVChargingScheduleResponseJson{} },
+	"NotifyEvent":               func() interface{} { return &NotifyEventResponse.NotifyEventResponseJson{} },
+	"NotifyMonitoringReport":    func() interface{} { return &NotifyMonitoringReportResponse.NotifyMonitoringReportResponseJson{} },
+	"NotifyReport":              func() interface{} { return &NotifyReportResponse.NotifyReportResponseJson{} },
+	"PublishFirmwareStatusNotification": func() interface{} {
+		return &PublishFirmwareStatusNotificationResponse.PublishFirmwareStatusNotificationResponseJson{}
+	},
+	"ReportChargingProfiles":    func() interface{} { return &ReportChargingProfilesResponse.ReportChargingProfilesResponseJson{} },
+	"ReservationStatusUpdate":   func() interface{} { return &ReservationStatusUpdateResponse.ReservationStatusUpdateResponseJson{} },
+	"SecurityEventNotification": func() interface{} { return &SecurityEventNotificationResponse.SecurityEventNotificationResponseJson{} },
+	"SignCertificate":           func() interface{} { return &SignCertificateResponse.SignCertificateResponseJson{} },
+	"StatusNotification":        func() interface{} { return &StatusNotificationResponse.StatusNotificationResponseJson{} },
+	"TransactionEvent":          func() interface{} { return &TransactionEventResponse.TransactionEventResponseJson{} },
+}
+
+// CALLERROR received from the CSMS or generated locally (MessageTimeoutError, ConnectionLostError)
+type CallError struct {
+	ErrorCode        string
+	ErrorDescription string
+	ErrorDetails     string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ErrorCode, e.ErrorDescription)
+}
+
+// True if the request failed because the CSMS could not be reached: no response within the timeout,
+// the connection was lost or ctx ended. Any other error is an answer of the CSMS, e.g. a CALLERROR.
+func IsUnreachable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var call_err *CallError
+	if errors.As(err, &call_err) {
+		return call_err.ErrorCode == MessageTimeoutError || call_err.ErrorCode == ConnectionLostError
+	}
+	return false
+}
+
+type callOutcome struct {
+	callresult *wrappers.CALLRESULT
+	callerror  *wrappers.CALLERROR
+}
+
+// Request handed over to the OCPPClient, whose response can be awaited with Wait, by more than one goroutine if needed
+type PendingCall struct {
+	Action    string
+	outcome   callOutcome
+	done      chan struct{}
+	done_once sync.Once
+}
+
+func (pending *PendingCall) resolve(outcome callOutcome) {
+	pending.done_once.Do(func() {
+		pending.outcome = outcome
+		close(pending.done)
+	})
+}
+
+// Sends a request to the CSMS and blocks until the response arrives or ctx is done.
+// The response is a pointer to the matching ocpp-messages-go type, e.g. *BootNotificationResponse.BootNotificationResponseJson.
+// A CALLERROR is returned as *CallError.
+func (cl *OCPPClient) Call(ctx context.Context, action string, request interface{}) (interface{}, error) {
+	pending, err := cl.CallAsync(action, request)
+	if err != nil {
+		return nil, err
+	}
+	return pending.Wait(ctx)
+}
+
+// Queues a request for sending without waiting for the response.
+// Requests queued one after the other from the same goroutine are sent in the same order.
+func (cl *OCPPClient) CallAsync(action string, request interface{}) (*PendingCall, error) {
+	if _, ok := response_types[action]; !ok {
+		return nil, fmt.Errorf("unsupported action: %s", action)
+	}
+
+	pending := &PendingCall{
+		Action: action,
+		done:   make(chan struct{}),
+	}
+	cl.Send(AsyncOcppCall{
+		Message: wrappers.CALL{
+			MessageTypeId: wrappers.CALL_TYPE,
+			MessageId:     uuid.New().String(),
+			Action:        action,
+			Payload:       request,
+		},
+		SuccessCallback: func(callresult wrappers.CALLRESULT) {
+			pending.resolve(callOutcome{callresult: &callresult})
+		},
+		ErrorCallback: func(callerror wrappers.CALLERROR) {
+			pending.resolve(callOutcome{callerror: &callerror})
+		},
+	})
+	return pending, nil
+}
+
+// Blocks until the response of the request arrives or ctx is done
+func (pending *PendingCall) Wait(ctx context.Context) (interface{}, error) {
+	select {
+	case <-pending.done:
+		result := pending.outcome
+		if result.callerror != nil {
+			return nil, &CallError{
+				ErrorCode:        result.callerror.ErrorCode,
+				ErrorDescription: result.callerror.ErrorDescription,
+				ErrorDetails:     result.callerror.ErrorDetails,
+			}
+		}
+		response := response_types[pending.Action]()
+		if err := json.Unmarshal(result.callresult.GetPayloadAsJSON(), response); err != nil {
+			return nil, fmt.Errorf("invalid %s response: %w", pending.Action, err)
+		}
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
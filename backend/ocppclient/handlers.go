@@ -0,0 +1,158 @@
+package ocppclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Processes a CALL received from the CSMS and returns the payload of the CALLRESULT.
+// Returning a *CallError answers with its ErrorCode, any other error is answered with InternalError.
+type CallHandler func(call wrappers.CALL) (interface{}, error)
+
+// Payload of a CALLRESULT together with a function that is started once the CALLRESULT was written,
+// for requests that make the Charging Station send messages of its own, e.g. GetBaseReport
+type FollowUp struct {
+	Payload interface{}
+	Then    func()
+}
+
+// Adapts a handler of a typed request payload, e.g. *ResetRequest.ResetRequestJson.
+// Payloads that do not match the schema of the request are answered with the matching CALLERROR.
+func TypedHandler[Request any](handler func(request *Request) (interface{}, error)) CallHandler {
+	return func(call wrappers.CALL) (interface{}, error) {
+		request := new(Request)
+		if err := json.Unmarshal(call.GetPayloadAsJSON(), request); err != nil {
+			return nil, payloadError(err)
+		}
+		return handler(request)
+	}
+}
+
+// Maps the errors of the generated UnmarshalJSON functions to OCPP-J error codes
+func payloadError(err error) *CallError {
+	var type_err *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &type_err):
+		return &CallError{ErrorCode: string(wrappers.TypeConstraintViolation), ErrorDescription: err.Error()}
+	case strings.HasSuffix(err.Error(), ": required"):
+		return &CallError{ErrorCode: string(wrappers.OccurrenceConstraintViolation), ErrorDescription: err.Error()}
+	case strings.HasPrefix(err.Error(), "invalid value"), strings.HasPrefix(err.Error(), "field "):
+		return &CallError{ErrorCode: string(wrappers.PropertyConstraintViolation), ErrorDescription: err.Error()}
+	default:
+		return &CallError{ErrorCode: string(wrappers.FormatViolation), ErrorDescription: err.Error()}
+	}
+}
+
+func (cl *OCPPClient) RegisterHandler(action string, handler CallHandler) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.handlers[action] = handler
+}
+
+// Answers the CALLs of the CSMS one by one, in the order they were received
+func (cl *OCPPClient) dispatchCalls() {
+	for {
+		var call wrappers.CALL
+		select {
+		case call = <-cl.calls_received:
+		case <-cl.closed:
+			return
+		}
+		payload, err := cl.handleCall(call)
+		if err != nil {
+			var call_err *CallError
+			if !errors.As(err, &call_err) {
+				call_err = &CallError{ErrorCode: string(wrappers.InternalError), ErrorDescription: err.Error()}
+			}
+			log.Error("==> Answering ", call.Action, " with CALLERROR: ", call_err)
+			cl.sendCallError(call.MessageId, call_err)
+			continue
+		}
+		var then func()
+		if follow_up, ok := payload.(FollowUp); ok {
+			payload, then = follow_up.Payload, follow_up.Then
+		}
+		callresult := wrappers.CALLRESULT{
+			MessageTypeId: wrappers.CALLRESULT_TYPE,
+			MessageId:     call.MessageId,
+			Payload:       payload,
+		}
+		log.Info("==> Sending CALLRESULT message to CSMS")
+		log.Info(string(callresult.Marshal()))
+		cl.writeResponse(callresult.Marshal())
+		if then != nil {
+			go runFollowUp(call.Action, then)
+		}
+	}
+}
+
+// A panicking follow-up must not take the client down, like a panicking handler
+func runFollowUp(action string, then func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("follow-up of ", action, " panicked: ", r)
+		}
+	}()
+	then()
+}
+
+func (cl *OCPPClient) handleCall(call wrappers.CALL) (payload interface{}, err error) {
+	cl.mu.Lock()
+	handler, ok := cl.handlers[call.Action]
+	cl.mu.Unlock()
+	if !ok {
+		log.Warning("No handler found for this CSMS request: ", call.Action)
+		return nil, &CallError{ErrorCode: string(wrappers.NotImplemented), ErrorDescription: "unknown action " + call.Action}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("handler of ", call.Action, " panicked: ", r)
+			payload = nil
+			err = &CallError{ErrorCode: string(wrappers.InternalError), ErrorDescription: fmt.Sprint(r)}
+		}
+	}()
+	return handler(call)
+}
+
+func (cl *OCPPClient) sendCallError(messageId string, call_err *CallError) {
+	error_details := json.RawMessage("{}")
+	if call_err.ErrorDetails != "" && json.Valid([]byte(call_err.ErrorDetails)) {
+		error_details = json.RawMessage(call_err.ErrorDetails)
+	}
+	// ErrorDetails has to be a JSON object, wrappers.CALLERROR would marshal it as a string
+	message, err := json.Marshal([]interface{}{wrappers.CALLERROR_TYPE, messageId, call_err.ErrorCode, call_err.ErrorDescription, error_details})
+	if err != nil {
+		log.Error("Could not marshal CALLERROR message: ", err)
+		return
+	}
+	cl.writeResponse(message)
+}
+
+// Responses are not subject to the single outstanding CALL rule, they are written right away
+func (cl *OCPPClient) writeResponse(message []byte) {
+	cl.mu.Lock()
+	ws_conn := cl.ws_conn
+	connected := cl.state == Connected
+	cl.mu.Unlock()
+	if !connected || ws_conn == nil {
+		log.Error("unable to send response, not connected to CSMS")
+		return
+	}
+	if err := cl.writeMessage(ws_conn, message); err != nil {
+		log.Error("write: ", err)
+	}
+}
+
+// The websocket connection supports one concurrent writer only
+func (cl *OCPPClient) writeMessage(ws_conn *websocket.Conn, message []byte) error {
+	cl.write_mu.Lock()
+	defer cl.write_mu.Unlock()
+	return ws_conn.WriteMessage(websocket.TextMessage, message)
+}
@@ -1,16 +1,18 @@
 package ocppclient
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"net/url"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/gregszalay/ocpp-charging-station-go/offlinequeue"
 	"github.com/gregszalay/ocpp-messages-go/wrappers"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,124 +24,599 @@ type AsyncOcppCall struct {
 	SentAt          time.Time
 }
 
+// Error codes of CALLERRORs generated locally, when no response arrives from the CSMS
+const (
+	MessageTimeoutError = "MessageTimeout"
+	ConnectionLostError = "ConnectionLost"
+)
+
+// Returned when the CSMS accepted the websocket connection without selecting any of the offered subprotocols
+type SubprotocolError struct {
+	Offered  []string
+	Selected string
+}
+
+func (e *SubprotocolError) Error() string {
+	if e.Selected == "" {
+		return fmt.Sprintf("CSMS did not select any of the offered subprotocols %v", e.Offered)
+	}
+	return fmt.Sprintf("CSMS selected subprotocol %q which was not offered (offered: %v)", e.Selected, e.Offered)
+}
+
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connected
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case Connected:
+		return "Connected"
+	default:
+		return "Disconnected"
+	}
+}
+
+// Settings of the OCPP client, see the OCPPCommCtrlr variables in OCPP 2.0.1
+type ClientConfig struct {
+	RetryBackOffWaitMinimum    time.Duration
+	RetryBackOffRandomRange    time.Duration
+	RetryBackOffRepeatTimes    int
+	OfflineQueueFile           string
+	MessageTimeout             time.Duration
+	TransactionMessageAttempts int
+	// A TransactionEvent without response is sent again after attempts * TransactionMessageRetryInterval
+	TransactionMessageRetryInterval time.Duration
+	SecurityProfile                 int
+	Identity                        string // username of HTTP Basic Authentication
+	BasicAuthPassword               string
+	CACertFile                      string // CA bundle to verify the CSMS certificate, system roots if empty
+	ClientCertFile                  string // only used by security profile 3
+	ClientKeyFile                   string
+	Subprotocols                    []string // offered in order of preference
+	HoldQueuedCalls                 bool     // keep queued messages until released with SetQueuedCallsHeld
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		RetryBackOffWaitMinimum:         time.Second * 5,
+		RetryBackOffRandomRange:         time.Second * 10,
+		RetryBackOffRepeatTimes:         5,
+		OfflineQueueFile:                "offline_queue.log",
+		MessageTimeout:                  time.Second * 30,
+		TransactionMessageAttempts:      3,
+		TransactionMessageRetryInterval: time.Second * 60,
+		SecurityProfile:                 SecurityProfileTLSBasicAuth,
+		ClientCertFile:                  "client_cert.pem",
+		ClientKeyFile:                   "key.pem",
+		Subprotocols:                    []string{"ocpp2.0.1"},
+	}
+}
+
 type OCPPClient struct {
-	calls_to_send           chan AsyncOcppCall
-	calls_awaiting_response map[string]AsyncOcppCall
-	Calls_received          chan wrappers.CALL
-	ws_conn                 *websocket.Conn
-	mu                      sync.Mutex
+	csms_url                 url.URL
+	config                   ClientConfig
+	dialer                   websocket.Dialer
+	dial_header              http.Header
+	calls_to_send            chan AsyncOcppCall
+	call_in_flight           *AsyncOcppCall
+	response_received        chan struct{}
+	calls_received           chan wrappers.CALL
+	handlers                 map[string]CallHandler
+	Connection_state_changes chan ConnectionState
+	ws_conn                  *websocket.Conn
+	state                    ConnectionState
+	negotiated_protocol      string
+	last_connection_error    error
+	unsent_call              *AsyncOcppCall
+	offline_queue            *offlinequeue.OfflineQueue
+	queued_calls             map[string]AsyncOcppCall
+	queued_call_attempts     map[string]int
+	queue_signal             chan struct{}
+	queue_held               bool
+	// The queued message at the head is not sent again before this time after a timeout
+	queue_retry_at time.Time
+	closed         chan struct{}
+	close_once     sync.Once
+	done           chan struct{}
+	mu             sync.Mutex
+	write_mu       sync.Mutex
 }
 
-func CreateAndRunOCPPClient(_csms_url url.URL) (*OCPPClient, error) {
+func CreateAndRunOCPPClient(_csms_url url.URL, _config ClientConfig) (*OCPPClient, error) {
 	// Create new OCPPClient
 	ocpp_client_new := &OCPPClient{
-		calls_to_send:           make(chan AsyncOcppCall, 100),  // Initialize the outbound message channel
-		calls_awaiting_response: make(map[string]AsyncOcppCall), // Initialize sent call message storage
-		Calls_received:          make(chan wrappers.CALL, 100),
-		ws_conn:                 nil,
+		csms_url:                 _csms_url,
+		config:                   _config,
+		calls_to_send:            make(chan AsyncOcppCall, 100), // Initialize the outbound message channel
+		call_in_flight:           nil,
+		response_received:        make(chan struct{}, 1),
+		calls_received:           make(chan wrappers.CALL, 100),
+		handlers:                 make(map[string]CallHandler),
+		Connection_state_changes: make(chan ConnectionState, 10),
+		ws_conn:                  nil,
+		state:                    Disconnected,
+		queued_calls:             make(map[string]AsyncOcppCall),
+		queued_call_attempts:     make(map[string]int),
+		queue_signal:             make(chan struct{}, 1),
+		queue_held:               _config.HoldQueuedCalls,
+		closed:                   make(chan struct{}),
+		done:                     make(chan struct{}),
 	}
 
-	// Read the key pair to create certificate
-	cert, err := tls.LoadX509KeyPair("client_cert.pem", "key.pem")
-	if err != nil {
-		log.Fatal(err)
+	// Set up the connection according to the security profile
+	if err := validateSecurityConfig(_config); err != nil {
+		return nil, err
+	}
+	if dialer, header, err := newDialer(_csms_url.Scheme, _config); err != nil {
+		log.Error("invalid security configuration: ", err)
+		return nil, err
+	} else {
+		ocpp_client_new.dialer = dialer
+		ocpp_client_new.dial_header = header
 	}
 
-	// Create a CA certificate pool and add cert.pem to it
-	caCert, err := ioutil.ReadFile("client_cert.pem")
-	if err != nil {
-		log.Fatal(err)
-	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	
-	dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			ClientCAs:    caCertPool,
-			Certificates: []tls.Certificate{cert},
-		},
+	// Open the durable queue of messages that must survive connection loss and restarts
+	if queue, err := offlinequeue.OpenOfflineQueue(_config.OfflineQueueFile); err != nil {
+		log.Error("failed to open offline queue: ", err)
+		return nil, err
+	} else {
+		ocpp_client_new.offline_queue = queue
 	}
 
-	ws_conn_new, _, err := dialer.Dial(_csms_url.String(), nil)
+	rand.Seed(time.Now().UnixNano())
+
+	// PROCESS, answer the CALLs received from the CSMS
+	go ocpp_client_new.dispatchCalls()
+
+	// CONNECT, keep the connection alive and reconnect with backoff when it is lost
+	go ocpp_client_new.run()
+
+	return ocpp_client_new, nil
+}
+
+func (cl *OCPPClient) run() {
+	defer cl.release()
+	attempt := 0
+	for {
+		select {
+		case <-cl.closed:
+			return
+		default:
+		}
+
+		ws_conn_new, err := cl.dial()
+		cl.mu.Lock()
+		cl.last_connection_error = err
+		cl.mu.Unlock()
+		if err != nil {
+			wait := cl.backOffDelay(attempt)
+			attempt++
+			log.Error("dial: ", err, ". Reconnecting in ", wait)
+			select {
+			case <-time.After(wait):
+				continue
+			case <-cl.closed:
+				return
+			}
+		}
+		attempt = 0
+
+		cl.mu.Lock()
+		cl.ws_conn = ws_conn_new
+		cl.negotiated_protocol = ws_conn_new.Subprotocol()
+		cl.mu.Unlock()
+		cl.setState(Connected)
+
+		cl.serve(ws_conn_new)
+
+		cl.setState(Disconnected)
+	}
+}
+
+// Opens the websocket connection and checks that the CSMS selected one of the offered subprotocols
+func (cl *OCPPClient) dial() (*websocket.Conn, error) {
+	ws_conn, _, err := cl.dialer.Dial(cl.csms_url.String(), cl.dial_header)
 	if err != nil {
-		log.Fatal("dial:", err)
 		return nil, err
 	}
+	selected := ws_conn.Subprotocol()
+	for _, offered := range cl.config.Subprotocols {
+		if selected == offered {
+			log.Info("negotiated websocket subprotocol: ", selected)
+			return ws_conn, nil
+		}
+	}
+	ws_conn.Close()
+	return nil, &SubprotocolError{Offered: cl.config.Subprotocols, Selected: selected}
+}
 
-	ocpp_client_new.ws_conn = ws_conn_new
+// Reads and writes messages on the given connection until it is lost or the client is closed
+func (cl *OCPPClient) serve(ws_conn *websocket.Conn) {
+	conn_lost := make(chan struct{})
 
 	// LISTEN
 	go func() { // listen for incoming messages and put them into a queue
+		defer close(conn_lost)
 		for {
-			_, message, err := ocpp_client_new.ws_conn.ReadMessage()
+			_, message, err := ws_conn.ReadMessage()
 			if err != nil {
 				log.Println("read:", err)
 				return
 			}
-			fmt.Printf("\nReceived message: \n%s\n", message)
-			ocpp_client_new.mu.Lock()
-			ocpp_client_new.processIncomingMessage(message)
-			ocpp_client_new.mu.Unlock()
+			log.Debug("Received message: ", string(message))
+			cl.processIncomingMessage(message)
 		}
 	}()
 
-	// PROCESS
-	// go func() { // keep looking through incoming message queue and process the messages
-	// 	for incoming_message := range ocpp_client_new.Calls_received {
-	// 		ocpp_client_new.processIncomingMessage(incoming_message)
-	// 	}
-	// 	log.Info("PROCESS goroutine has finished")
-	// }()
-
 	// SEND
-	go func() { // keep looking for messages to send, send message
-		for {
-			for message := range ocpp_client_new.calls_to_send {
-				fmt.Println("Current time: ", time.Now())
-				log.Info("==> Sending CALL message to CSMS")
-				log.Info(string(message.Message.Marshal()))
-				err := ocpp_client_new.ws_conn.WriteMessage(websocket.TextMessage, message.Message.Marshal())
-				if err != nil {
-					log.Println("write:", err)
-					return
-				}
-				message.SentAt = time.Now()
-				ocpp_client_new.mu.Lock()
-				ocpp_client_new.calls_awaiting_response[message.Message.MessageId] = message
-				ocpp_client_new.mu.Unlock()
-				//time.Sleep(time.Millisecond * 10)
+	for { // keep looking for messages to send, send message
+		var message AsyncOcppCall
+		if cl.unsent_call != nil {
+			message = *cl.unsent_call
+			cl.unsent_call = nil
+		} else if queued_call, ok := cl.nextQueuedCall(); ok {
+			message = queued_call
+		} else {
+			select {
+			case message = <-cl.calls_to_send:
+			case <-cl.queue_signal:
+				continue
+			case <-conn_lost:
+				return
+			case <-cl.closed:
+				closeConnection(ws_conn)
+				<-conn_lost
+				return
 			}
 		}
-	}()
+		is_queued := isQueuedAction(message.Message.Action)
 
-	go func() {
-		for {
-			ocpp_client_new.mu.Lock()
-			for messageId, sent_ocpp_call := range ocpp_client_new.calls_awaiting_response {
-				if time.Since(sent_ocpp_call.SentAt) > time.Millisecond*10000 {
-					delete(ocpp_client_new.calls_awaiting_response, messageId) // delete the timed out message
-				}
+		// Drop a late response signal of the previous CALL
+		select {
+		case <-cl.response_received:
+		default:
+		}
+
+		log.Info("==> Sending CALL message to CSMS")
+		log.Info(string(message.Message.Marshal()))
+		message.SentAt = time.Now()
+		cl.mu.Lock()
+		cl.call_in_flight = &message
+		cl.mu.Unlock()
+		err := cl.writeMessage(ws_conn, message.Message.Marshal())
+		if err != nil {
+			log.Println("write:", err)
+			cl.takeCallInFlight(message.Message.MessageId)
+			if !is_queued { // queued messages are sent again from the queue anyway
+				cl.unsent_call = &message // send it again after reconnecting
 			}
-			ocpp_client_new.mu.Unlock()
-			//time.Sleep(time.Millisecond * 50)
+			ws_conn.Close()
+			<-conn_lost
+			return
 		}
-	}()
 
-	return ocpp_client_new, nil
+		// Only one CALL may be outstanding, wait for the CALLRESULT/CALLERROR before sending the next one
+		select {
+		case <-cl.response_received:
+		case <-time.After(cl.config.MessageTimeout):
+			if timed_out, ok := cl.takeCallInFlight(message.Message.MessageId); ok {
+				cl.onCallTimeout(timed_out)
+			}
+		case <-conn_lost:
+			if lost, ok := cl.takeCallInFlight(message.Message.MessageId); ok && !is_queued {
+				go lost.fail(ConnectionLostError, "connection lost before a response was received")
+			}
+			return
+		case <-cl.closed:
+			closeConnection(ws_conn)
+			<-conn_lost
+			if lost, ok := cl.takeCallInFlight(message.Message.MessageId); ok && !is_queued {
+				go lost.fail(ConnectionLostError, "client closed before a response was received")
+			}
+			return
+		}
+	}
+}
+
+// Tells the CSMS that the connection is closed on purpose, then closes it
+func closeConnection(ws_conn *websocket.Conn) {
+	close_message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := ws_conn.WriteControl(websocket.CloseMessage, close_message, time.Now().Add(time.Second)); err != nil {
+		log.Warning("unable to send close message: ", err)
+	}
+	ws_conn.Close()
+}
+
+// Runs after the client was closed: fails the requests that will never be sent and closes the offline queue.
+// Undelivered queued messages stay in the offline queue file and are sent by the next client.
+func (cl *OCPPClient) release() {
+	if cl.unsent_call != nil && !isQueuedAction(cl.unsent_call.Message.Action) {
+		go cl.unsent_call.fail(ConnectionLostError, "client closed before the message was sent")
+		cl.unsent_call = nil
+	}
+	// Send checks for closed under cl.mu, nothing is added to calls_to_send after it was drained
+	cl.mu.Lock()
+drain:
+	for {
+		select {
+		case call := <-cl.calls_to_send:
+			go call.fail(ConnectionLostError, "client closed before the message was sent")
+		default:
+			break drain
+		}
+	}
+	queued_calls := cl.queued_calls
+	cl.queued_calls = make(map[string]AsyncOcppCall)
+	cl.mu.Unlock()
+	for _, call := range queued_calls {
+		go call.fail(ConnectionLostError, "client closed before the message was delivered")
+	}
+	if err := cl.offline_queue.Close(); err != nil {
+		log.Error("failed to close offline queue: ", err)
+	}
+	close(cl.Connection_state_changes)
+	close(cl.done)
+}
+
+// Removes the CALL waiting for a response if its id matches. Only the caller that gets it may invoke its callbacks.
+func (cl *OCPPClient) takeCallInFlight(messageId string) (AsyncOcppCall, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.call_in_flight == nil || cl.call_in_flight.Message.MessageId != messageId {
+		return AsyncOcppCall{}, false
+	}
+	call := *cl.call_in_flight
+	cl.call_in_flight = nil
+	return call, true
+}
+
+func (cl *OCPPClient) onCallTimeout(call AsyncOcppCall) {
+	log.Error("no response from CSMS within ", cl.config.MessageTimeout, " for ", call.Message.Action, " ", call.Message.MessageId)
+	if isQueuedAction(call.Message.Action) {
+		// Queued messages stay at the head of the queue until they run out of attempts
+		cl.mu.Lock()
+		cl.queued_call_attempts[call.Message.MessageId]++
+		attempts := cl.queued_call_attempts[call.Message.MessageId]
+		retry_delay := time.Duration(attempts) * cl.config.TransactionMessageRetryInterval
+		if attempts < cl.config.TransactionMessageAttempts {
+			// E04: wait attempts * MessageAttemptInterval before the next attempt, the messages behind it wait too
+			cl.queue_retry_at = time.Now().Add(retry_delay)
+			cl.mu.Unlock()
+			log.Info("sending ", call.Message.MessageId, " again in ", retry_delay)
+			time.AfterFunc(retry_delay, cl.signalQueue)
+			return
+		}
+		cl.mu.Unlock()
+		log.Error("giving up on ", call.Message.MessageId, " after ", attempts, " attempts")
+	}
+	go call.fail(MessageTimeoutError, "no response received within MessageTimeout")
+}
+
+// Invokes the ErrorCallback with a locally generated CALLERROR
+func (call AsyncOcppCall) fail(errorCode string, errorDescription string) {
+	if call.ErrorCallback == nil {
+		return
+	}
+	call.ErrorCallback(wrappers.CALLERROR{
+		MessageTypeId:    wrappers.CALLERROR_TYPE,
+		MessageId:        call.Message.MessageId,
+		ErrorCode:        errorCode,
+		ErrorDescription: errorDescription,
+		ErrorDetails:     "{}",
+	})
+}
+
+// OCPP 2.0.1 reconnection backoff: wait RetryBackOffWaitMinimum plus a random part of RetryBackOffRandomRange,
+// doubling the wait on every attempt up to RetryBackOffRepeatTimes times
+func (cl *OCPPClient) backOffDelay(attempt int) time.Duration {
+	if attempt > cl.config.RetryBackOffRepeatTimes {
+		attempt = cl.config.RetryBackOffRepeatTimes
+	}
+	wait := cl.config.RetryBackOffWaitMinimum << attempt
+	if cl.config.RetryBackOffRandomRange > 0 {
+		wait += time.Duration(rand.Int63n(int64(cl.config.RetryBackOffRandomRange)))
+	}
+	return wait
+}
+
+func (cl *OCPPClient) setState(state ConnectionState) {
+	cl.mu.Lock()
+	cl.state = state
+	cl.mu.Unlock()
+	log.Info("OCPP connection state: ", state)
+	select {
+	case cl.Connection_state_changes <- state:
+	default:
+		log.Warning("connection state change dropped, nobody is listening")
+	}
+}
+
+// OCPP version selected by the CSMS during the websocket handshake, e.g. "ocpp2.0.1"
+func (cl *OCPPClient) NegotiatedProtocol() string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.negotiated_protocol
 }
 
-func (cl *OCPPClient) Disconnect() {
-	cl.ws_conn.Close()
+// Error of the last connection attempt, nil if it succeeded
+func (cl *OCPPClient) LastConnectionError() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.last_connection_error
+}
+
+func (cl *OCPPClient) IsConnected() bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.state == Connected
+}
+
+// Closes the connection to the CSMS and waits until the client has stopped, at most for the given timeout
+func (cl *OCPPClient) Disconnect(timeout time.Duration) {
+	cl.close_once.Do(func() { close(cl.closed) })
+	select {
+	case <-cl.done:
+	case <-time.After(timeout):
+		log.Warning("OCPP client did not stop within ", timeout)
+	}
+}
+
+// Closed once the client has stopped and closed the offline queue, the file may be opened by another client then
+func (cl *OCPPClient) Done() <-chan struct{} {
+	return cl.done
+}
+
+func (cl *OCPPClient) isClosed() bool {
+	select {
+	case <-cl.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits until every message handed over to the client has been answered by the CSMS, or ctx is done
+func (cl *OCPPClient) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for {
+		cl.mu.Lock()
+		idle := cl.call_in_flight == nil && len(cl.calls_to_send) == 0 && len(cl.queued_calls) == 0
+		cl.mu.Unlock()
+		if idle && cl.offline_queue.Len() == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (cl *OCPPClient) Send(call AsyncOcppCall) {
-	cl.calls_to_send <- call
+	if cl.isClosed() {
+		go call.fail(ConnectionLostError, "client closed")
+		return
+	}
+	if isQueuedAction(call.Message.Action) {
+		if !cl.IsConnected() {
+			markOffline(&call.Message)
+		}
+		if err := cl.offline_queue.Push(call.Message); err != nil {
+			log.Error("failed to persist message, sending it without queueing: ", err)
+		} else {
+			cl.mu.Lock()
+			cl.queued_calls[call.Message.MessageId] = call
+			cl.mu.Unlock()
+			cl.signalQueue()
+			return
+		}
+	}
+	// Never blocks the caller, e.g. an EVSE callback: if the outage lasts so long that the
+	// messages waiting for the connection fill the channel, the new one fails right away
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.isClosed() {
+		go call.fail(ConnectionLostError, "client closed")
+		return
+	}
+	select {
+	case cl.calls_to_send <- call:
+	default:
+		go call.fail(ConnectionLostError, "too many messages waiting for the connection to the CSMS")
+	}
+}
+
+// Messages that are persisted and delivered in order even if they were created while offline (OCPP 2.0.1 E04)
+func isQueuedAction(action string) bool {
+	return action == "TransactionEvent"
+}
+
+// Sets the offline flag in the payload of a CALL that is created while the CSMS is unreachable
+func markOffline(call *wrappers.CALL) {
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(call.GetPayloadAsJSON(), &payload); err != nil {
+		log.Error("failed to set offline flag: ", err)
+		return
+	}
+	payload["offline"] = true
+	call.Payload = payload
+}
+
+// Queued messages can be held back e.g. until the CSMS has accepted the BootNotification
+func (cl *OCPPClient) SetQueuedCallsHeld(held bool) {
+	cl.mu.Lock()
+	cl.queue_held = held
+	cl.mu.Unlock()
+	cl.signalQueue()
+}
+
+func (cl *OCPPClient) signalQueue() {
+	select {
+	case cl.queue_signal <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the oldest queued message. Queued messages are removed only after they have been answered.
+func (cl *OCPPClient) nextQueuedCall() (AsyncOcppCall, bool) {
+	cl.mu.Lock()
+	held := cl.queue_held
+	retry_at := cl.queue_retry_at
+	cl.mu.Unlock()
+	if held || time.Now().Before(retry_at) {
+		return AsyncOcppCall{}, false
+	}
+	call, ok := cl.offline_queue.Peek()
+	if !ok {
+		return AsyncOcppCall{}, false
+	}
+
+	// Messages restored after a restart have no callbacks
+	cl.mu.Lock()
+	original := cl.queued_calls[call.MessageId]
+	cl.mu.Unlock()
+	return AsyncOcppCall{
+		Message: call,
+		SuccessCallback: func(result wrappers.CALLRESULT) {
+			cl.completeQueuedCall(call.MessageId)
+			if original.SuccessCallback != nil {
+				original.SuccessCallback(result)
+			}
+		},
+		ErrorCallback: func(callerror wrappers.CALLERROR) {
+			cl.completeQueuedCall(call.MessageId)
+			if original.ErrorCallback != nil {
+				original.ErrorCallback(callerror)
+			}
+		},
+	}, true
+}
+
+// Removes an answered message from the queue
+func (cl *OCPPClient) completeQueuedCall(messageId string) {
+	if err := cl.offline_queue.Remove(messageId); err != nil {
+		log.Error("failed to remove delivered message from offline queue: ", err)
+	}
+	cl.mu.Lock()
+	delete(cl.queued_calls, messageId)
+	delete(cl.queued_call_attempts, messageId)
+	cl.mu.Unlock()
+	cl.signalQueue()
 }
 
 func (cl *OCPPClient) processIncomingMessage(message []byte) {
 	messageTypeId, err := parseMessageTypeId(message)
 	if err != nil {
-		log.Error("could not parse message type id")
+		// Without a message id there is nothing to answer to, the message is dropped
+		log.Error("invalid message from CSMS: ", err)
+		if messageId, id_err := parseMessageId(message); id_err == nil {
+			cl.sendCallError(messageId, &CallError{ErrorCode: string(wrappers.FormatViolation), ErrorDescription: err.Error()})
+		}
 		return
 	}
 
@@ -148,32 +625,28 @@ func (cl *OCPPClient) processIncomingMessage(message []byte) {
 		var call wrappers.CALL
 		call_unmarshal_err := call.UnmarshalJSON(message)
 		if call_unmarshal_err != nil {
-			fmt.Printf("Failed to unmarshal OCPP CALL message. Error: %s", call_unmarshal_err)
-		} else {
-			// fmt.Println("OCPP CALL message as an OBJECT:")
-			// fmt.Println("*******************************")
-			// litter.Dump(call)
+			log.Error("Failed to unmarshal OCPP CALL message: ", call_unmarshal_err)
+			if messageId, err := parseMessageId(message); err == nil {
+				cl.sendCallError(messageId, &CallError{ErrorCode: string(wrappers.FormatViolation), ErrorDescription: call_unmarshal_err.Error()})
+			}
+			return
 		}
-		cl.Calls_received <- call
+		cl.calls_received <- call
 		log.Info("<== Received CALL message from CSMS")
 		log.Info(string(call.Marshal()))
 	case wrappers.CALLRESULT_TYPE:
 		var callresult wrappers.CALLRESULT
 		call_result_unmarshal_err := callresult.UnmarshalJSON(message)
 		if call_result_unmarshal_err != nil {
-			fmt.Printf("Failed to unmarshal OCPP CALLRESULT message. Error: %s", call_result_unmarshal_err)
-		} else {
-			// fmt.Println("OCPP CALLRESULT message as an OBJECT:")
-			// fmt.Println("*******************************")
-			// litter.Dump(callresult)
+			log.Error("Failed to unmarshal OCPP CALLRESULT message: ", call_result_unmarshal_err)
 		}
 		// invoke callback
-		if val, ok := cl.calls_awaiting_response[callresult.MessageId]; ok {
+		if val, ok := cl.takeCallInFlight(callresult.MessageId); ok {
+			cl.response_received <- struct{}{}
 			if val.SuccessCallback == nil {
 				log.Error("callresult successcallback is nil")
 				return
 			}
-			//do something here
 			val.SuccessCallback(callresult)
 			log.Info("<== Received CALLRESULT message from CSMS")
 			log.Info(string(callresult.Marshal()))
@@ -182,18 +655,13 @@ func (cl *OCPPClient) processIncomingMessage(message []byte) {
 			return
 		}
 	case wrappers.CALLERROR_TYPE:
-		var callerror wrappers.CALLERROR
-		callerror_result_unmarshal_err := callerror.UnmarshalJSON(message)
+		callerror, callerror_result_unmarshal_err := unmarshalCallError(message)
 		if callerror_result_unmarshal_err != nil {
-			fmt.Printf("Failed to unmarshal OCPP CALLERROR message. Error: %s", callerror_result_unmarshal_err)
-		} else {
-			// fmt.Println("OCPP CALLERROR message as an OBJECT:")
-			// fmt.Println("*******************************")
-			// litter.Dump(callerror)
+			log.Error("Failed to unmarshal OCPP CALLERROR message: ", callerror_result_unmarshal_err)
 		}
 		// invoke callback
-		if val, ok := cl.calls_awaiting_response[callerror.MessageId]; ok {
-			//do something here
+		if val, ok := cl.takeCallInFlight(callerror.MessageId); ok {
+			cl.response_received <- struct{}{}
 			if val.ErrorCallback == nil {
 				log.Error("callerror errorcallback is nil")
 				return
@@ -202,24 +670,66 @@ func (cl *OCPPClient) processIncomingMessage(message []byte) {
 			log.Info("<== Received CALLERROR message from CSMS")
 			log.Info(string(callerror.Marshal()))
 		} else {
-
 			log.Error("callerror errorcallback does not exist")
 		}
+	default:
+		if messageId, err := parseMessageId(message); err == nil {
+			cl.sendCallError(messageId, &CallError{ErrorCode: string(wrappers.MessageTypeNotSupported), ErrorDescription: fmt.Sprint("unknown message type id ", messageTypeId)})
+		}
+	}
+}
+
+// wrappers.CALLERROR.UnmarshalJSON rejects valid messages, so CALLERRORs are parsed here
+func unmarshalCallError(message []byte) (wrappers.CALLERROR, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(message, &raw); err != nil {
+		return wrappers.CALLERROR{}, err
+	}
+	if len(raw) != 5 {
+		return wrappers.CALLERROR{}, errors.New("invalid CALLERROR message length")
+	}
+	var callerror wrappers.CALLERROR
+	callerror.MessageTypeId = wrappers.CALLERROR_TYPE
+	if err := json.Unmarshal(raw[1], &callerror.MessageId); err != nil {
+		return wrappers.CALLERROR{}, fmt.Errorf("CALLERROR data[1] is not a string")
+	}
+	if err := json.Unmarshal(raw[2], &callerror.ErrorCode); err != nil {
+		return wrappers.CALLERROR{}, fmt.Errorf("CALLERROR data[2] is not a string")
+	}
+	if err := json.Unmarshal(raw[3], &callerror.ErrorDescription); err != nil {
+		return wrappers.CALLERROR{}, fmt.Errorf("CALLERROR data[3] is not a string")
 	}
+	callerror.ErrorDetails = string(raw[4])
+	return callerror, nil
 }
 
+func parseMessageId(message []byte) (string, error) {
+	var data []interface{}
+	if err := json.Unmarshal(message, &data); err != nil {
+		return "", err
+	}
+	if len(data) < 2 {
+		return "", errors.New("message has no message id")
+	}
+	messageId, ok := data[1].(string)
+	if !ok || messageId == "" {
+		return "", errors.New("message id is not a string")
+	}
+	return messageId, nil
+}
+
+// Every OCPP-J message is an array of the message type id, the message id and at least one more element
 func parseMessageTypeId(message []byte) (int, error) {
 	var data []interface{}
-	err := json.Unmarshal([]byte(message), &data)
-	if err != nil {
-		log.Error("could not unmarshal json", err)
+	if err := json.Unmarshal(message, &data); err != nil {
 		return 0, err
 	}
+	if len(data) < 3 {
+		return 0, errors.New("message has less than 3 elements")
+	}
 	messageTypeId, ok := data[0].(float64)
 	if !ok {
-		log.Error("data[0] is not a uint8", err)
-		return 0, err
+		return 0, errors.New("message type id is not a number")
 	}
-
 	return int(messageTypeId), nil
 }
@@ -0,0 +1,280 @@
+package ocppclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gregszalay/ocpp-messages-go/types/ResetRequest"
+	"github.com/gregszalay/ocpp-messages-go/types/ResetResponse"
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+)
+
+func testCall(action string, payload string) wrappers.CALL {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+		panic(err)
+	}
+	return wrappers.CALL{MessageTypeId: wrappers.CALL_TYPE, MessageId: "1", Action: action, Payload: decoded}
+}
+
+func errorCode(err error) string {
+	var call_err *CallError
+	if !errors.As(err, &call_err) {
+		return ""
+	}
+	return call_err.ErrorCode
+}
+
+func TestHandleCall(t *testing.T) {
+	reset := TypedHandler(func(request *ResetRequest.ResetRequestJson) (interface{}, error) {
+		return ResetResponse.ResetResponseJson{Status: ResetResponse.ResetStatusEnumType_1_Accepted}, nil
+	})
+	tests := []struct {
+		name     string
+		action   string
+		payload  string
+		handler  CallHandler
+		wantCode string // empty if a CALLRESULT is expected
+	}{
+		{"valid request", "Reset", `{"type":"Immediate"}`, reset, ""},
+		{"missing required field", "Reset", `{}`, reset, string(wrappers.OccurrenceConstraintViolation)},
+		{"value outside the enumeration", "Reset", `{"type":"Never"}`, reset, string(wrappers.PropertyConstraintViolation)},
+		{"field of the wrong type", "Reset", `{"type":"Immediate","evseId":"one"}`, reset, string(wrappers.TypeConstraintViolation)},
+		{"action without a handler", "Unknown", `{}`, nil, string(wrappers.NotImplemented)},
+		{
+			name:    "handler returning a CallError",
+			action:  "Reset",
+			payload: `{}`,
+			handler: func(call wrappers.CALL) (interface{}, error) {
+				return nil, &CallError{ErrorCode: string(wrappers.SecurityError)}
+			},
+			wantCode: string(wrappers.SecurityError),
+		},
+		{
+			name:    "panicking handler",
+			action:  "Reset",
+			payload: `{}`,
+			handler: func(call wrappers.CALL) (interface{}, error) {
+				panic("nil map")
+			},
+			wantCode: string(wrappers.InternalError),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cl := &OCPPClient{handlers: make(map[string]CallHandler)}
+			if test.handler != nil {
+				cl.RegisterHandler(test.action, test.handler)
+			}
+			payload, err := cl.handleCall(testCall(test.action, test.payload))
+			if got := errorCode(err); got != test.wantCode {
+				t.Errorf("handleCall() error = %v, want error code %q", err, test.wantCode)
+			}
+			if test.wantCode == "" && err == nil && payload == nil {
+				t.Error("handleCall() returned no payload")
+			}
+		})
+	}
+}
+
+func TestWaitReturnsCallError(t *testing.T) {
+	pending := &PendingCall{Action: "Heartbeat", done: make(chan struct{})}
+	pending.resolve(callOutcome{callerror: &wrappers.CALLERROR{
+		MessageTypeId:    wrappers.CALLERROR_TYPE,
+		MessageId:        "1",
+		ErrorCode:        string(wrappers.NotSupported),
+		ErrorDescription: "not supported",
+		ErrorDetails:     `{"reason":"test"}`,
+	}})
+	_, err := pending.Wait(context.Background())
+	var call_err *CallError
+	if !errors.As(err, &call_err) {
+		t.Fatalf("Wait() error = %v, want a *CallError", err)
+	}
+	want := CallError{ErrorCode: string(wrappers.NotSupported), ErrorDescription: "not supported", ErrorDetails: `{"reason":"test"}`}
+	if *call_err != want {
+		t.Errorf("Wait() error = %+v, want %+v", *call_err, want)
+	}
+}
+
+func TestIsUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"message timeout", &CallError{ErrorCode: MessageTimeoutError}, true},
+		{"connection lost", &CallError{ErrorCode: ConnectionLostError}, true},
+		{"context deadline", context.DeadlineExceeded, true},
+		{"context canceled", fmt.Errorf("waiting: %w", context.Canceled), true},
+		{"CALLERROR of the CSMS", &CallError{ErrorCode: string(wrappers.InternalError)}, false},
+		{"invalid response", errors.New("invalid Authorize response"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsUnreachable(test.err); got != test.want {
+				t.Errorf("IsUnreachable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCallError(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    wrappers.CALLERROR
+		wantErr bool
+	}{
+		{
+			name:    "details object",
+			message: `[4,"1","NotSupported","not supported",{"reason":"test"}]`,
+			want: wrappers.CALLERROR{MessageTypeId: wrappers.CALLERROR_TYPE, MessageId: "1", ErrorCode: "NotSupported",
+				ErrorDescription: "not supported", ErrorDetails: `{"reason":"test"}`},
+		},
+		{
+			name:    "empty details and description",
+			message: `[4,"1","InternalError","",{}]`,
+			want: wrappers.CALLERROR{MessageTypeId: wrappers.CALLERROR_TYPE, MessageId: "1", ErrorCode: "InternalError",
+				ErrorDescription: "", ErrorDetails: `{}`},
+		},
+		{name: "too few elements", message: `[4,"1","InternalError",""]`, wantErr: true},
+		{name: "message id is not a string", message: `[4,1,"InternalError","",{}]`, wantErr: true},
+		{name: "not an array", message: `{}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := unmarshalCallError([]byte(test.message))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("unmarshalCallError() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && got != test.want {
+				t.Errorf("unmarshalCallError() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMessageTypeId(t *testing.T) {
+	tests := []struct {
+		message string
+		want    int
+		wantErr bool
+	}{
+		{`[2,"1","Reset",{}]`, wrappers.CALL_TYPE, false},
+		{`[3,"1",{}]`, wrappers.CALLRESULT_TYPE, false},
+		{`[2,"1"]`, 0, true},
+		{`[]`, 0, true},
+		{`["2","1","Reset",{}]`, 0, true},
+		{`[null,"1","Reset",{}]`, 0, true},
+		{`{"messageTypeId":2}`, 0, true},
+		{`not json`, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.message, func(t *testing.T) {
+			got, err := parseMessageTypeId([]byte(test.message))
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Errorf("parseMessageTypeId() = %d, %v, want %d, wantErr %v", got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+// Client connected to a test CSMS, which hands over every message it receives
+func connectTestClient(t *testing.T) (*OCPPClient, <-chan []byte) {
+	t.Helper()
+	received := make(chan []byte, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws_conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws_conn.Close()
+		for {
+			_, message, err := ws_conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- message
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	ws_conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("unable to connect to the test CSMS: %v", err)
+	}
+	t.Cleanup(func() { ws_conn.Close() })
+	return &OCPPClient{ws_conn: ws_conn, state: Connected, handlers: make(map[string]CallHandler)}, received
+}
+
+// Invalid messages are answered with a CALLERROR if they have a message id, and dropped otherwise
+func TestInvalidMessagesAreAnswered(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		wantCode string // empty if the message is dropped
+	}{
+		{"message type id is not a number", `["2","1","Reset",{}]`, string(wrappers.FormatViolation)},
+		{"too few elements", `[2,"1"]`, string(wrappers.FormatViolation)},
+		{"CALL without a payload object", `[2,"1","Reset","payload"]`, string(wrappers.FormatViolation)},
+		{"unknown message type id", `[7,"1","Reset",{}]`, string(wrappers.MessageTypeNotSupported)},
+		{"no message id", `[2]`, ""},
+		{"not json", `[2,"1"`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cl, received := connectTestClient(t)
+			cl.processIncomingMessage([]byte(test.message))
+			select {
+			case message := <-received:
+				callerror, err := unmarshalCallError(message)
+				if err != nil {
+					t.Fatalf("answer %s is not a CALLERROR: %v", message, err)
+				}
+				if callerror.MessageId != "1" || callerror.ErrorCode != test.wantCode {
+					t.Errorf("answer = %s, want a %s CALLERROR for message 1", message, test.wantCode)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.wantCode != "" {
+					t.Errorf("no answer, want a %s CALLERROR", test.wantCode)
+				}
+			}
+		})
+	}
+}
+
+// Handler errors that are not a CallError are answered with InternalError
+func TestDispatchCalls(t *testing.T) {
+	cl, received := connectTestClient(t)
+	cl.calls_received = make(chan wrappers.CALL, 1)
+	cl.closed = make(chan struct{})
+	defer close(cl.closed)
+	cl.RegisterHandler("Reset", func(call wrappers.CALL) (interface{}, error) {
+		return nil, errors.New("disk full")
+	})
+	go cl.dispatchCalls()
+
+	cl.calls_received <- testCall("Reset", `{"type":"Immediate"}`)
+	select {
+	case message := <-received:
+		callerror, err := unmarshalCallError(message)
+		if err != nil {
+			t.Fatalf("answer %s is not a CALLERROR: %v", message, err)
+		}
+		if callerror.ErrorCode != string(wrappers.InternalError) || callerror.ErrorDescription != "disk full" {
+			t.Errorf("answer = %s, want an InternalError CALLERROR", message)
+		}
+	case <-time.After(time.Second):
+		t.Error("the CALL was not answered")
+	}
+}
@@ -0,0 +1,100 @@
+package ocppclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// OCPP 2.0.1 security profiles (Part 2 - A00.FR)
+const (
+	SecurityProfileBasicAuth     = 1 // HTTP Basic Authentication over ws
+	SecurityProfileTLSBasicAuth  = 2 // HTTP Basic Authentication over TLS, CSMS certificate verified
+	SecurityProfileTLSClientCert = 3 // TLS with client side certificate, CSMS certificate verified
+)
+
+// Creates the websocket dialer and the handshake headers for the configured security profile
+func newDialer(csms_scheme string, config ClientConfig) (websocket.Dialer, http.Header, error) {
+	header := http.Header{}
+
+	switch config.SecurityProfile {
+	case SecurityProfileBasicAuth:
+		if csms_scheme != "ws" {
+			return websocket.Dialer{}, nil, fmt.Errorf("security profile 1 requires a ws:// CSMS URL, got %s://", csms_scheme)
+		}
+		header.Set("Authorization", basicAuth(config.Identity, config.BasicAuthPassword))
+		return websocket.Dialer{Subprotocols: config.Subprotocols}, header, nil
+
+	case SecurityProfileTLSBasicAuth, SecurityProfileTLSClientCert:
+		if csms_scheme != "wss" {
+			return websocket.Dialer{}, nil, fmt.Errorf("security profile %d requires a wss:// CSMS URL, got %s://", config.SecurityProfile, csms_scheme)
+		}
+		tls_config, err := newTLSConfig(config)
+		if err != nil {
+			return websocket.Dialer{}, nil, err
+		}
+		if config.SecurityProfile == SecurityProfileTLSBasicAuth {
+			header.Set("Authorization", basicAuth(config.Identity, config.BasicAuthPassword))
+		}
+		return websocket.Dialer{TLSClientConfig: tls_config, Subprotocols: config.Subprotocols}, header, nil
+
+	default:
+		return websocket.Dialer{}, nil, fmt.Errorf("unsupported security profile: %d", config.SecurityProfile)
+	}
+}
+
+func newTLSConfig(config ClientConfig) (*tls.Config, error) {
+	tls_config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// Verify the CSMS certificate against the configured CA bundle, or the system roots if there is none
+	if config.CACertFile != "" {
+		ca_cert, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		ca_cert_pool := x509.NewCertPool()
+		if !ca_cert_pool.AppendCertsFromPEM(ca_cert) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CACertFile)
+		}
+		tls_config.RootCAs = ca_cert_pool
+	}
+
+	// Profile 3 authenticates with a client certificate instead of a password
+	if config.SecurityProfile == SecurityProfileTLSClientCert {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tls_config.Certificates = []tls.Certificate{cert}
+	}
+
+	return tls_config, nil
+}
+
+func basicAuth(identity string, password string) string {
+	if identity == "" {
+		log.Warning("basic auth: charging station identity is empty")
+	}
+	if len(password) < 16 || len(password) > 40 {
+		log.Warning("basic auth: BasicAuthPassword should be 16 to 40 characters long")
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(identity+":"+password))
+}
+
+var errEmptyPassword = errors.New("BasicAuthPassword is required for security profiles 1 and 2")
+
+func validateSecurityConfig(config ClientConfig) error {
+	if (config.SecurityProfile == SecurityProfileBasicAuth || config.SecurityProfile == SecurityProfileTLSBasicAuth) && config.BasicAuthPassword == "" {
+		return errEmptyPassword
+	}
+	return nil
+}
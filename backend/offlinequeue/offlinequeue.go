@@ -0,0 +1,201 @@
+package offlinequeue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	opPush = "push"
+	opAck  = "ack"
+)
+
+// The log is rewritten after this many acks, also if the queue never drains completely
+const compactAfterAcks = 1000
+
+// One line of the append-only log file
+type logRecord struct {
+	Op        string          `json:"op"`
+	MessageId string          `json:"messageId"`
+	Call      json.RawMessage `json:"call,omitempty"`
+}
+
+// Durable FIFO queue of outbound OCPP CALLs, backed by an append-only log file.
+// Every pushed CALL stays in the queue until it is removed after delivery, also across restarts.
+type OfflineQueue struct {
+	path    string
+	file    *os.File
+	entries []wrappers.CALL
+	// Ack records in the log since it was last rewritten
+	acks int
+	mu   sync.Mutex
+}
+
+func OpenOfflineQueue(path string) (*OfflineQueue, error) {
+	queue_new := &OfflineQueue{
+		path:    path,
+		entries: make([]wrappers.CALL, 0),
+	}
+
+	// Replay the log to restore the undelivered CALLs
+	if err := queue_new.load(); err != nil {
+		return nil, err
+	}
+
+	// Rewrite the log so that it only contains the undelivered CALLs
+	if err := queue_new.compact(); err != nil {
+		return nil, err
+	}
+
+	if len(queue_new.entries) > 0 {
+		log.Info("offline queue restored ", len(queue_new.entries), " undelivered message(s) from ", path)
+	}
+	return queue_new, nil
+}
+
+func (q *OfflineQueue) load() error {
+	file, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash while appending can leave a truncated last line behind
+			log.Warning("offline queue: skipping corrupt record: ", err)
+			continue
+		}
+		switch record.Op {
+		case opPush:
+			var call wrappers.CALL
+			if err := call.UnmarshalJSON(record.Call); err != nil {
+				log.Warning("offline queue: skipping unreadable CALL: ", err)
+				continue
+			}
+			q.entries = append(q.entries, call)
+		case opAck:
+			q.removeEntry(record.MessageId)
+		}
+	}
+	return scanner.Err()
+}
+
+// Rewrites the log so that it only contains the undelivered CALLs. The new log is written next to the
+// current one and swapped in only when it is complete, on failure the current log stays in use.
+func (q *OfflineQueue) compact() error {
+	tmp_path := q.path + ".tmp"
+	tmp_file, err := os.OpenFile(tmp_path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	discard := func(err error) error {
+		tmp_file.Close()
+		os.Remove(tmp_path)
+		return err
+	}
+	for _, call := range q.entries {
+		if err := writeRecord(tmp_file, logRecord{Op: opPush, MessageId: call.MessageId, Call: call.Marshal()}); err != nil {
+			return discard(err)
+		}
+	}
+	if err := tmp_file.Sync(); err != nil {
+		return discard(err)
+	}
+	if err := os.Rename(tmp_path, q.path); err != nil {
+		return discard(err)
+	}
+
+	// The file stays open across the rename, it is the new log
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = tmp_file
+	q.acks = 0
+	return nil
+}
+
+func writeRecord(file *os.File, record logRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Appends the CALL to the end of the queue and persists it before returning
+func (q *OfflineQueue) Push(call wrappers.CALL) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := writeRecord(q.file, logRecord{Op: opPush, MessageId: call.MessageId, Call: call.Marshal()}); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.entries = append(q.entries, call)
+	return nil
+}
+
+// Returns the oldest undelivered CALL without removing it
+func (q *OfflineQueue) Peek() (wrappers.CALL, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return wrappers.CALL{}, false
+	}
+	return q.entries[0], true
+}
+
+// Removes a delivered CALL from the queue
+func (q *OfflineQueue) Remove(messageId string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.removeEntry(messageId) {
+		return nil
+	}
+	if err := writeRecord(q.file, logRecord{Op: opAck, MessageId: messageId}); err != nil {
+		return err
+	}
+	q.acks++
+	// Start a fresh log once everything has been delivered, or before the acks pile up
+	if len(q.entries) == 0 || q.acks >= compactAfterAcks {
+		return q.compact()
+	}
+	return nil
+}
+
+func (q *OfflineQueue) removeEntry(messageId string) bool {
+	for i, call := range q.entries {
+		if call.MessageId == messageId {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *OfflineQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func (q *OfflineQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
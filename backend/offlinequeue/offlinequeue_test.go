@@ -0,0 +1,166 @@
+package offlinequeue
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gregszalay/ocpp-messages-go/wrappers"
+)
+
+func testCall(messageId string) wrappers.CALL {
+	return wrappers.CALL{
+		MessageTypeId: wrappers.CALL_TYPE,
+		MessageId:     messageId,
+		Action:        "TransactionEvent",
+		Payload:       map[string]interface{}{"seqNo": 0},
+	}
+}
+
+func openTestQueue(t *testing.T, path string) *OfflineQueue {
+	t.Helper()
+	q, err := OpenOfflineQueue(path)
+	if err != nil {
+		t.Fatalf("OpenOfflineQueue() error = %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// Message ids of the queue from the oldest, the queue is emptied
+func drain(t *testing.T, q *OfflineQueue) []string {
+	t.Helper()
+	result := make([]string, 0)
+	for {
+		call, ok := q.Peek()
+		if !ok {
+			return result
+		}
+		result = append(result, call.MessageId)
+		if err := q.Remove(call.MessageId); err != nil {
+			t.Fatalf("Remove(%s) error = %v", call.MessageId, err)
+		}
+	}
+}
+
+func logLines(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open the log: %v", err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestOfflineQueue(t *testing.T) {
+	tests := []struct {
+		name   string
+		push   []string
+		remove []string
+		want   []string
+	}{
+		{"first in, first out", []string{"1", "2", "3"}, nil, []string{"1", "2", "3"}},
+		{"acked CALLs are removed", []string{"1", "2", "3"}, []string{"2"}, []string{"1", "3"}},
+		{"ack of an unknown CALL is ignored", []string{"1"}, []string{"9"}, []string{"1"}},
+		{"empty after every CALL was acked", []string{"1", "2"}, []string{"1", "2"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.log"))
+			for _, id := range test.push {
+				if err := q.Push(testCall(id)); err != nil {
+					t.Fatalf("Push(%s) error = %v", id, err)
+				}
+			}
+			for _, id := range test.remove {
+				if err := q.Remove(id); err != nil {
+					t.Fatalf("Remove(%s) error = %v", id, err)
+				}
+			}
+			if q.Len() != len(test.want) {
+				t.Errorf("Len() = %d, want %d", q.Len(), len(test.want))
+			}
+			if got := drain(t, q); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("queue = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOfflineQueueReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q, err := OpenOfflineQueue(path)
+	if err != nil {
+		t.Fatalf("OpenOfflineQueue() error = %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if err := q.Push(testCall(id)); err != nil {
+			t.Fatalf("Push(%s) error = %v", id, err)
+		}
+	}
+	if err := q.Remove("1"); err != nil {
+		t.Fatalf("Remove(1) error = %v", err)
+	}
+	q.Close()
+
+	// A crash while appending leaves a truncated record behind
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("unable to open the log: %v", err)
+	}
+	file.WriteString(`{"op":"push","messageId":"4","ca`)
+	file.Close()
+
+	reopened := openTestQueue(t, path)
+	// Reopening rewrites the log with the undelivered CALLs only
+	if lines := logLines(t, path); lines != 2 {
+		t.Errorf("log has %d records after reopening, want 2", lines)
+	}
+	if got, want := drain(t, reopened), []string{"2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queue = %v, want %v", got, want)
+	}
+}
+
+func TestOfflineQueueCompaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		push      int
+		remove    int
+		wantLines int
+	}{
+		{"the log is emptied once everything is delivered", 3, 3, 0},
+		{"acks are kept until compactAfterAcks", 3, 2, 5},
+		{"the log is rewritten after compactAfterAcks acks", compactAfterAcks + 1, compactAfterAcks, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "queue.log")
+			q := openTestQueue(t, path)
+			for i := 0; i < test.push; i++ {
+				if err := q.Push(testCall(fmt.Sprint(i))); err != nil {
+					t.Fatalf("Push(%d) error = %v", i, err)
+				}
+			}
+			for i := 0; i < test.remove; i++ {
+				if err := q.Remove(fmt.Sprint(i)); err != nil {
+					t.Fatalf("Remove(%d) error = %v", i, err)
+				}
+			}
+			if lines := logLines(t, path); lines != test.wantLines {
+				t.Errorf("log has %d records, want %d", lines, test.wantLines)
+			}
+			if q.Len() != test.push-test.remove {
+				t.Errorf("Len() = %d, want %d", q.Len(), test.push-test.remove)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package persistence
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Buckets of the state the Charging Station keeps across restarts
+const (
+	DeviceModelBucket  = "devicemodel"
+	TransactionsBucket = "transactions"
+	StationBucket      = "station"
+	AuthCacheBucket    = "authcache"
+	AvailabilityBucket = "availability"
+	ProfilesBucket     = "chargingprofiles"
+	LocalListBucket    = "localauthlist"
+)
+
+// Key-value store of JSON encoded values, grouped into buckets
+type Store interface {
+	// Decodes the stored value into value, returns false if the key does not exist
+	Get(bucket string, key string, value interface{}) (bool, error)
+	Put(bucket string, key string, value interface{}) error
+	Delete(bucket string, key string) error
+	// Keys of the bucket in ascending order
+	Keys(bucket string) ([]string, error)
+	// Replaces the whole content of the bucket in one step, a crash leaves either the old or the new content behind
+	ReplaceBucket(bucket string, values map[string]interface{}) error
+	// Keeps a secret, e.g. a private key, apart from the buckets where only the owner can read it
+	PutSecret(name string, content []byte) error
+	Close() error
+}
+
+// Store that keeps every bucket in a JSON file of a directory.
+// Files are rewritten atomically, a crash leaves either the old or the new content behind.
+type FileStore struct {
+	dir     string
+	buckets map[string]map[string]json.RawMessage
+	mu      sync.Mutex
+}
+
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	log.Info("persistence: state is stored in ", dir)
+	return &FileStore{
+		dir:     dir,
+		buckets: make(map[string]map[string]json.RawMessage),
+	}, nil
+}
+
+func (s *FileStore) Dir() string {
+	return s.dir
+}
+
+func (s *FileStore) path(bucket string) string {
+	return filepath.Join(s.dir, bucket+".json")
+}
+
+// Must be called with s.mu held
+func (s *FileStore) bucket(name string) (map[string]json.RawMessage, error) {
+	if bucket, ok := s.buckets[name]; ok {
+		return bucket, nil
+	}
+	bucket := make(map[string]json.RawMessage)
+	content, err := os.ReadFile(s.path(name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &bucket); err != nil {
+			return nil, err
+		}
+	}
+	s.buckets[name] = bucket
+	return bucket, nil
+}
+
+// Must be called with s.mu held
+func (s *FileStore) save(name string, bucket map[string]json.RawMessage) error {
+	content, err := json.MarshalIndent(bucket, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.path(name), content)
+}
+
+// Replaces the file atomically, the new file is readable only by the owner
+func writeFile(path string, content []byte) error {
+	tmp_path := path + ".tmp"
+	file, err := os.OpenFile(tmp_path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, path)
+}
+
+func (s *FileStore) Get(bucket_name string, key string, value interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, err := s.bucket(bucket_name)
+	if err != nil {
+		return false, err
+	}
+	raw, ok := bucket[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, value)
+}
+
+func (s *FileStore) Put(bucket_name string, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, err := s.bucket(bucket_name)
+	if err != nil {
+		return err
+	}
+	bucket[key] = raw
+	return s.save(bucket_name, bucket)
+}
+
+func (s *FileStore) Delete(bucket_name string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, err := s.bucket(bucket_name)
+	if err != nil {
+		return err
+	}
+	if _, ok := bucket[key]; !ok {
+		return nil
+	}
+	delete(bucket, key)
+	return s.save(bucket_name, bucket)
+}
+
+func (s *FileStore) Keys(bucket_name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, err := s.bucket(bucket_name)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(bucket))
+	for key := range bucket {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *FileStore) ReplaceBucket(bucket_name string, values map[string]interface{}) error {
+	bucket, err := marshalValues(values)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(bucket_name, bucket); err != nil {
+		return err
+	}
+	s.buckets[bucket_name] = bucket
+	return nil
+}
+
+func marshalValues(values map[string]interface{}) (map[string]json.RawMessage, error) {
+	bucket := make(map[string]json.RawMessage, len(values))
+	for key, value := range values {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		bucket[key] = raw
+	}
+	return bucket, nil
+}
+
+// Secrets are kept in files of their own in the keys subdirectory
+func (s *FileStore) PutSecret(name string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.dir, "keys")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, name), content)
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// Store that keeps nothing across restarts
+type MemoryStore struct {
+	buckets map[string]map[string]json.RawMessage
+	secrets map[string][]byte
+	mu      sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]map[string]json.RawMessage),
+		secrets: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryStore) Get(bucket string, key string, value interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, ok := s.buckets[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, value)
+}
+
+func (s *MemoryStore) Put(bucket string, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	s.buckets[bucket][key] = raw
+	return nil
+}
+
+func (s *MemoryStore) Delete(bucket string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *MemoryStore) Keys(bucket string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *MemoryStore) ReplaceBucket(bucket string, values map[string]interface{}) error {
+	raw, err := marshalValues(values)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket] = raw
+	return nil
+}
+
+func (s *MemoryStore) PutSecret(name string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[name] = append([]byte(nil), content...)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,285 @@
+package smartcharging
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/SetChargingProfileRequest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Profiles are kept in the representation of SetChargingProfile, other messages are converted from and to it
+type ChargingProfile = SetChargingProfileRequest.ChargingProfileType
+
+// A charging profile installed on an EVSE, or on the whole Charging Station if EvseId is 0
+type Profile struct {
+	EvseId          int
+	ChargingProfile ChargingProfile
+}
+
+// Limits of the SmartChargingCtrlr the profiles are validated against
+type Limits struct {
+	MaxStackLevel      int
+	PeriodsPerSchedule int
+	MaxEntries         int
+	RateUnits          string // comma separated, e.g. "A,W"
+}
+
+// Reason of a rejected charging profile, reported to the CSMS in the statusInfo
+type ValidationError struct {
+	ReasonCode  string
+	Description string
+}
+
+func (e *ValidationError) Error() string {
+	return e.ReasonCode + ": " + e.Description
+}
+
+func invalid(reasonCode string, format string, args ...interface{}) error {
+	return &ValidationError{ReasonCode: reasonCode, Description: fmt.Sprintf(format, args...)}
+}
+
+// Installed charging profiles by id. TxProfiles are not persisted, they end with their transaction.
+type ProfileManager struct {
+	profiles map[int]Profile
+	store    persistence.Store
+	mu       sync.Mutex
+}
+
+// Creates a profile manager with the profiles that were installed before the restart
+func CreateProfileManager(store persistence.Store) *ProfileManager {
+	pm_new := &ProfileManager{
+		profiles: make(map[int]Profile),
+		store:    store,
+	}
+	keys, err := store.Keys(persistence.ProfilesBucket)
+	if err != nil {
+		log.Error("unable to read the persisted charging profiles: ", err)
+		return pm_new
+	}
+	for _, key := range keys {
+		var profile Profile
+		if _, err := store.Get(persistence.ProfilesBucket, key, &profile); err != nil {
+			log.Error("skipping unreadable persisted charging profile ", key, ": ", err)
+			continue
+		}
+		pm_new.profiles[profile.ChargingProfile.Id] = profile
+	}
+	return pm_new
+}
+
+// K01: checks a profile the CSMS wants to install. transactionId is the ongoing transaction on the EVSE, empty if there is none.
+func (pm *ProfileManager) Validate(evseId int, profile *ChargingProfile, limits Limits, transactionId string) error {
+	if profile.StackLevel < 0 || profile.StackLevel > limits.MaxStackLevel {
+		return invalid("InvalidStackLevel", "stack level %d is not between 0 and %d", profile.StackLevel, limits.MaxStackLevel)
+	}
+
+	switch profile.ChargingProfilePurpose {
+	case SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_ChargingStationExternalConstraints:
+		return invalid("InvalidProfile", "ChargingStationExternalConstraints cannot be set by the CSMS")
+	case SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_ChargingStationMaxProfile:
+		if evseId != 0 {
+			return invalid("InvalidProfile", "ChargingStationMaxProfile must be set for EVSE 0")
+		}
+		if profile.ChargingProfileKind == SetChargingProfileRequest.ChargingProfileKindEnumType_1_Relative {
+			return invalid("InvalidProfile", "ChargingStationMaxProfile cannot be Relative")
+		}
+	case SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxProfile:
+		if evseId == 0 {
+			return invalid("InvalidProfile", "TxProfile must be set for an EVSE")
+		}
+		if profile.TransactionId == nil || *profile.TransactionId != transactionId || transactionId == "" {
+			return invalid("TxNotFound", "TxProfile does not belong to the ongoing transaction of EVSE %d", evseId)
+		}
+	}
+
+	valid_from, valid_to, err := validity(profile)
+	if err != nil {
+		return invalid("InvalidProfile", "%v", err)
+	}
+	if err := validateSchedules(profile, limits); err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if _, replaced := pm.profiles[profile.Id]; !replaced && len(pm.profiles) >= limits.MaxEntries {
+		return invalid("TooManyProfiles", "no more than %d charging profiles can be installed", limits.MaxEntries)
+	}
+	// K01.FR.39: profiles of the same purpose and stack level must not be valid at the same time
+	for id, installed := range pm.profiles {
+		other := installed.ChargingProfile
+		if id == profile.Id || installed.EvseId != evseId ||
+			other.ChargingProfilePurpose != profile.ChargingProfilePurpose || other.StackLevel != profile.StackLevel {
+			continue
+		}
+		if profile.ChargingProfilePurpose == SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxProfile &&
+			*other.TransactionId != *profile.TransactionId {
+			continue
+		}
+		other_from, other_to, _ := validity(&other)
+		if valid_from.Before(other_to) && other_from.Before(valid_to) {
+			return invalid("DuplicateProfile", "charging profile %d has the same purpose and stack level", id)
+		}
+	}
+	return nil
+}
+
+// End of the validity of profiles without validTo
+var farFuture = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Validity period of the profile, unbounded ends are the zero time and farFuture
+func validity(profile *ChargingProfile) (time.Time, time.Time, error) {
+	valid_from := time.Time{}
+	valid_to := farFuture
+	if profile.ValidFrom != nil {
+		parsed, err := time.Parse(time.RFC3339, *profile.ValidFrom)
+		if err != nil {
+			return valid_from, valid_to, fmt.Errorf("invalid validFrom: %w", err)
+		}
+		valid_from = parsed
+	}
+	if profile.ValidTo != nil {
+		parsed, err := time.Parse(time.RFC3339, *profile.ValidTo)
+		if err != nil {
+			return valid_from, valid_to, fmt.Errorf("invalid validTo: %w", err)
+		}
+		valid_to = parsed
+	}
+	if !valid_from.Before(valid_to) {
+		return valid_from, valid_to, fmt.Errorf("validFrom is not before validTo")
+	}
+	return valid_from, valid_to, nil
+}
+
+func validateSchedules(profile *ChargingProfile, limits Limits) error {
+	// Only ISO 15118 offers more than one schedule to the EV, which is not supported, so only a single schedule is evaluated
+	if len(profile.ChargingSchedule) != 1 {
+		return invalid("InvalidSchedule", "a profile has exactly 1 charging schedule, %d were sent", len(profile.ChargingSchedule))
+	}
+	for _, schedule := range profile.ChargingSchedule {
+		switch profile.ChargingProfileKind {
+		case SetChargingProfileRequest.ChargingProfileKindEnumType_1_Absolute, SetChargingProfileRequest.ChargingProfileKindEnumType_1_Recurring:
+			if schedule.StartSchedule == nil {
+				return invalid("InvalidSchedule", "%s schedule %d has no startSchedule", profile.ChargingProfileKind, schedule.Id)
+			}
+			if _, err := time.Parse(time.RFC3339, *schedule.StartSchedule); err != nil {
+				return invalid("InvalidSchedule", "invalid startSchedule: %v", err)
+			}
+		case SetChargingProfileRequest.ChargingProfileKindEnumType_1_Relative:
+			if schedule.StartSchedule != nil {
+				return invalid("InvalidSchedule", "Relative schedule %d has a startSchedule", schedule.Id)
+			}
+		}
+		if profile.ChargingProfileKind == SetChargingProfileRequest.ChargingProfileKindEnumType_1_Recurring && profile.RecurrencyKind == nil {
+			return invalid("InvalidSchedule", "Recurring profile has no recurrencyKind")
+		}
+		if !limits.SupportsUnit(schedule.ChargingRateUnit) {
+			return invalid("UnsupportedRateUnit", "charging rate unit %s is not supported", schedule.ChargingRateUnit)
+		}
+
+		periods := schedule.ChargingSchedulePeriod
+		if len(periods) == 0 || len(periods) > limits.PeriodsPerSchedule {
+			return invalid("InvalidSchedule", "schedule %d has %d periods, 1 to %d are supported", schedule.Id, len(periods), limits.PeriodsPerSchedule)
+		}
+		if periods[0].StartPeriod != 0 {
+			return invalid("InvalidSchedule", "the first period of schedule %d does not start at 0", schedule.Id)
+		}
+		for i, period := range periods {
+			if i > 0 && period.StartPeriod <= periods[i-1].StartPeriod {
+				return invalid("InvalidSchedule", "the periods of schedule %d are not in ascending order", schedule.Id)
+			}
+			if period.Limit < 0 {
+				return invalid("InvalidSchedule", "negative limit in schedule %d", schedule.Id)
+			}
+		}
+	}
+	return nil
+}
+
+func (l Limits) SupportsUnit(unit RateUnit) bool {
+	for _, supported := range strings.Split(l.RateUnits, ",") {
+		if strings.TrimSpace(supported) == string(unit) {
+			return true
+		}
+	}
+	return false
+}
+
+// Installs a validated profile, replacing the profile with the same id
+func (pm *ProfileManager) Install(evseId int, profile ChargingProfile) {
+	installed := Profile{EvseId: evseId, ChargingProfile: profile}
+	pm.mu.Lock()
+	pm.profiles[profile.Id] = installed
+	pm.mu.Unlock()
+
+	if profile.ChargingProfilePurpose == SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxProfile {
+		return
+	}
+	if err := pm.store.Put(persistence.ProfilesBucket, strconv.Itoa(profile.Id), installed); err != nil {
+		log.Error("unable to persist charging profile ", profile.Id, ": ", err)
+	}
+}
+
+// Removes the profiles the filter matches and returns them
+func (pm *ProfileManager) Clear(filter func(Profile) bool) []Profile {
+	pm.mu.Lock()
+	cleared := make([]Profile, 0)
+	for id, profile := range pm.profiles {
+		if filter(profile) {
+			cleared = append(cleared, profile)
+			delete(pm.profiles, id)
+		}
+	}
+	pm.mu.Unlock()
+
+	for _, profile := range cleared {
+		if err := pm.store.Delete(persistence.ProfilesBucket, strconv.Itoa(profile.ChargingProfile.Id)); err != nil {
+			log.Error("unable to delete persisted charging profile ", profile.ChargingProfile.Id, ": ", err)
+		}
+	}
+	sortProfiles(cleared)
+	return cleared
+}
+
+// Removes the TxProfiles of a transaction that has ended
+func (pm *ProfileManager) ClearTransaction(transactionId string) []Profile {
+	return pm.Clear(func(profile Profile) bool {
+		return profile.ChargingProfile.ChargingProfilePurpose == SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxProfile &&
+			profile.ChargingProfile.TransactionId != nil && *profile.ChargingProfile.TransactionId == transactionId
+	})
+}
+
+// Installed profiles the filter matches, ordered by EVSE and id
+func (pm *ProfileManager) Profiles(filter func(Profile) bool) []Profile {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	result := make([]Profile, 0)
+	for _, profile := range pm.profiles {
+		if filter(profile) {
+			result = append(result, profile)
+		}
+	}
+	sortProfiles(result)
+	return result
+}
+
+func (pm *ProfileManager) Count() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return len(pm.profiles)
+}
+
+func sortProfiles(profiles []Profile) {
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].EvseId != profiles[j].EvseId {
+			return profiles[i].EvseId < profiles[j].EvseId
+		}
+		return profiles[i].ChargingProfile.Id < profiles[j].ChargingProfile.Id
+	})
+}
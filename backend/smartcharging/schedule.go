@@ -0,0 +1,315 @@
+package smartcharging
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gregszalay/ocpp-messages-go/types/SetChargingProfileRequest"
+)
+
+type RateUnit = SetChargingProfileRequest.ChargingRateUnitEnumType
+
+const (
+	Amperes RateUnit = SetChargingProfileRequest.ChargingRateUnitEnumTypeA
+	Watts   RateUnit = SetChargingProfileRequest.ChargingRateUnitEnumTypeW
+)
+
+// Used to convert between A and W limits
+const (
+	NominalVoltage = 230.0
+	DefaultPhases  = 3
+)
+
+// Transaction of the EVSE the limits are calculated for. Relative profiles start with the transaction.
+type Transaction struct {
+	Id        string
+	StartedAt time.Time
+}
+
+// Limit of the composite schedule from StartPeriod seconds after the start of the schedule
+type Period struct {
+	StartPeriod  int
+	Limit        float64
+	NumberPhases *int
+}
+
+// K08: the limits that result from every profile of an EVSE, in ascending order of StartPeriod
+type CompositeSchedule struct {
+	EvseId        int
+	ScheduleStart time.Time
+	Duration      int
+	RateUnit      RateUnit
+	Periods       []Period
+}
+
+// Limit a profile sets at a point of time, unit is the unit of the schedule
+type limit struct {
+	value  float64
+	unit   RateUnit
+	phases *int
+}
+
+func (l limit) in(unit RateUnit) float64 {
+	if l.unit == unit {
+		return l.value
+	}
+	phases := DefaultPhases
+	if l.phases != nil && *l.phases > 0 {
+		phases = *l.phases
+	}
+	if unit == Watts {
+		return l.value * NominalVoltage * float64(phases)
+	}
+	return l.value / NominalVoltage / float64(phases)
+}
+
+// Start of the schedule of the profile that is in effect at t
+func (p Profile) scheduleStart(t time.Time, relativeStart time.Time) (time.Time, bool) {
+	profile := p.ChargingProfile
+	schedule := profile.ChargingSchedule[0]
+	switch profile.ChargingProfileKind {
+	case SetChargingProfileRequest.ChargingProfileKindEnumType_1_Relative:
+		return relativeStart, true
+	case SetChargingProfileRequest.ChargingProfileKindEnumType_1_Recurring:
+		start, _ := time.Parse(time.RFC3339, *schedule.StartSchedule)
+		if t.Before(start) {
+			return start, false
+		}
+		recurrence := recurrencePeriod(profile)
+		return start.Add(t.Sub(start) / recurrence * recurrence), true
+	default:
+		start, _ := time.Parse(time.RFC3339, *schedule.StartSchedule)
+		return start, true
+	}
+}
+
+func recurrencePeriod(profile ChargingProfile) time.Duration {
+	if profile.RecurrencyKind != nil && *profile.RecurrencyKind == SetChargingProfileRequest.RecurrencyKindEnumTypeWeekly {
+		return time.Hour * 24 * 7
+	}
+	return time.Hour * 24
+}
+
+// Limit of the profile at t, false if the profile does not limit at t
+func (p Profile) limitAt(t time.Time, relativeStart time.Time) (limit, bool) {
+	valid_from, valid_to, err := validity(&p.ChargingProfile)
+	if err != nil || t.Before(valid_from) || !t.Before(valid_to) {
+		return limit{}, false
+	}
+	start, ok := p.scheduleStart(t, relativeStart)
+	if !ok || t.Before(start) {
+		return limit{}, false
+	}
+	schedule := p.ChargingProfile.ChargingSchedule[0]
+	offset := int(t.Sub(start) / time.Second)
+	if schedule.Duration != nil && offset >= *schedule.Duration {
+		return limit{}, false
+	}
+	result := limit{unit: schedule.ChargingRateUnit}
+	for _, period := range schedule.ChargingSchedulePeriod {
+		if period.StartPeriod > offset {
+			break
+		}
+		result.value = period.Limit
+		result.phases = period.NumberPhases
+	}
+	return result, true
+}
+
+// Points of time in (from, to) where the limit of the profile may change
+func (p Profile) changesBetween(from time.Time, to time.Time, relativeStart time.Time) []time.Time {
+	valid_from, valid_to, _ := validity(&p.ChargingProfile)
+	candidates := []time.Time{valid_from, valid_to}
+
+	// A recurring profile also changes at every recurrence, its first start may be after from
+	first, _ := p.scheduleStart(from, relativeStart)
+	starts := []time.Time{first}
+	if p.ChargingProfile.ChargingProfileKind == SetChargingProfileRequest.ChargingProfileKindEnumType_1_Recurring {
+		recurrence := recurrencePeriod(p.ChargingProfile)
+		for next := first.Add(recurrence); next.Before(to); next = next.Add(recurrence) {
+			starts = append(starts, next)
+		}
+	}
+
+	schedule := p.ChargingProfile.ChargingSchedule[0]
+	for _, start := range starts {
+		for _, period := range schedule.ChargingSchedulePeriod {
+			candidates = append(candidates, start.Add(time.Duration(period.StartPeriod)*time.Second))
+		}
+		if schedule.Duration != nil {
+			candidates = append(candidates, start.Add(time.Duration(*schedule.Duration)*time.Second))
+		}
+	}
+
+	result := make([]time.Time, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.After(from) && candidate.Before(to) {
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
+
+// Profile of the highest stack level that limits at t
+func highestLimit(profiles []Profile, t time.Time, relativeStart time.Time) (limit, bool) {
+	best_level := -1
+	var best limit
+	for _, profile := range profiles {
+		if profile.ChargingProfile.StackLevel <= best_level {
+			continue
+		}
+		if l, ok := profile.limitAt(t, relativeStart); ok {
+			best_level = profile.ChargingProfile.StackLevel
+			best = l
+		}
+	}
+	return best, best_level >= 0
+}
+
+// Profiles that apply to the EVSE, grouped by what they limit
+type applicableProfiles struct {
+	station        []Profile // ChargingStationMaxProfile and ChargingStationExternalConstraints
+	tx             []Profile // TxProfiles of the transaction
+	evseDefault    []Profile // TxDefaultProfiles of the EVSE
+	stationDefault []Profile // TxDefaultProfiles of the whole Charging Station
+}
+
+func (pm *ProfileManager) applicable(evseId int, tx *Transaction) applicableProfiles {
+	result := applicableProfiles{}
+	for _, profile := range pm.Profiles(func(Profile) bool { return true }) {
+		switch profile.ChargingProfile.ChargingProfilePurpose {
+		case SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_ChargingStationMaxProfile,
+			SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_ChargingStationExternalConstraints:
+			result.station = append(result.station, profile)
+		case SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxProfile:
+			if evseId != 0 && profile.EvseId == evseId && tx != nil && *profile.ChargingProfile.TransactionId == tx.Id {
+				result.tx = append(result.tx, profile)
+			}
+		case SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxDefaultProfile:
+			if evseId == 0 {
+				continue
+			}
+			if profile.EvseId == evseId {
+				result.evseDefault = append(result.evseDefault, profile)
+			} else if profile.EvseId == 0 {
+				result.stationDefault = append(result.stationDefault, profile)
+			}
+		}
+	}
+	return result
+}
+
+// Lowest of the limits at t. The station limits apply together, a TxProfile overrules the TxDefaultProfiles,
+// a TxDefaultProfile of the EVSE overrules the one of the whole Charging Station.
+func (a applicableProfiles) limitAt(t time.Time, relativeStart time.Time, unit RateUnit, maxLimit limit) (float64, *int) {
+	value := maxLimit.in(unit)
+	phases := maxLimit.phases
+	apply := func(l limit) {
+		if l.in(unit) < value {
+			value = l.in(unit)
+			phases = l.phases
+		}
+	}
+
+	purposes := map[SetChargingProfileRequest.ChargingProfilePurposeEnumType_1][]Profile{}
+	for _, profile := range a.station {
+		purpose := profile.ChargingProfile.ChargingProfilePurpose
+		purposes[purpose] = append(purposes[purpose], profile)
+	}
+	for _, profiles := range purposes {
+		if l, ok := highestLimit(profiles, t, relativeStart); ok {
+			apply(l)
+		}
+	}
+	for _, profiles := range [][]Profile{a.tx, a.evseDefault, a.stationDefault} {
+		if l, ok := highestLimit(profiles, t, relativeStart); ok {
+			apply(l)
+			break
+		}
+	}
+	return value, phases
+}
+
+func (a applicableProfiles) all() []Profile {
+	result := append([]Profile{}, a.station...)
+	result = append(result, a.tx...)
+	result = append(result, a.evseDefault...)
+	return append(result, a.stationDefault...)
+}
+
+// Calculates the limits of the EVSE for the duration from start, or of the whole Charging Station if evseId is 0.
+// maxPower is the power in W the EVSE can deliver without any profile.
+func (pm *ProfileManager) CompositeSchedule(evseId int, start time.Time, duration time.Duration, unit RateUnit, tx *Transaction, maxPower float64) CompositeSchedule {
+	start = start.Truncate(time.Second)
+	end := start.Add(duration)
+	relative_start := start
+	if tx != nil {
+		relative_start = tx.StartedAt
+	}
+	profiles := pm.applicable(evseId, tx)
+	max_limit := limit{value: maxPower, unit: Watts}
+
+	changes := []time.Time{start}
+	for _, profile := range profiles.all() {
+		changes = append(changes, profile.changesBetween(start, end, relative_start)...)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Before(changes[j]) })
+
+	composite := CompositeSchedule{
+		EvseId:        evseId,
+		ScheduleStart: start,
+		Duration:      int(duration / time.Second),
+		RateUnit:      unit,
+		Periods:       make([]Period, 0),
+	}
+	for _, change := range changes {
+		value, phases := profiles.limitAt(change, relative_start, unit, max_limit)
+		value = math.Round(value*10) / 10
+		start_period := int(change.Sub(start) / time.Second)
+		if n := len(composite.Periods); n > 0 {
+			last := &composite.Periods[n-1]
+			if last.Limit == value && samePhases(last.NumberPhases, phases) {
+				continue
+			}
+			if last.StartPeriod == start_period {
+				*last = Period{StartPeriod: start_period, Limit: value, NumberPhases: phases}
+				continue
+			}
+		}
+		composite.Periods = append(composite.Periods, Period{StartPeriod: start_period, Limit: value, NumberPhases: phases})
+	}
+	return composite
+}
+
+// A change of the number of phases is a new period, even if the limit stays the same
+func samePhases(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Limit of the EVSE at t in the given unit, maxPower if no profile limits it
+func (pm *ProfileManager) LimitAt(evseId int, t time.Time, unit RateUnit, tx *Transaction, maxPower float64) float64 {
+	relative_start := t
+	if tx != nil {
+		relative_start = tx.StartedAt
+	}
+	value, _ := pm.applicable(evseId, tx).limitAt(t, relative_start, unit, limit{value: maxPower, unit: Watts})
+	return value
+}
+
+// True if a profile limits the EVSE at t, otherwise the EVSE may deliver its maximum
+func (pm *ProfileManager) IsLimited(evseId int, t time.Time, tx *Transaction) bool {
+	relative_start := t
+	if tx != nil {
+		relative_start = tx.StartedAt
+	}
+	for _, profile := range pm.applicable(evseId, tx).all() {
+		if _, ok := profile.limitAt(t, relative_start); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,358 @@
+package smartcharging
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gregszalay/ocpp-charging-station-go/persistence"
+	"github.com/gregszalay/ocpp-messages-go/types/SetChargingProfileRequest"
+)
+
+var testStart = time.Date(2022, 10, 3, 12, 0, 0, 0, time.UTC)
+
+// 32 A on 3 phases
+const testMaxPower = 32 * NominalVoltage * 3
+
+var testLimits = Limits{MaxStackLevel: 10, PeriodsPerSchedule: 24, MaxEntries: 20, RateUnits: "A,W"}
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+func timePtr(t time.Time) *string {
+	return stringPtr(t.Format(time.RFC3339))
+}
+
+// period is [startPeriod, limit]
+func testProfile(
+	id int,
+	purpose SetChargingProfileRequest.ChargingProfilePurposeEnumType_1,
+	kind SetChargingProfileRequest.ChargingProfileKindEnumType_1,
+	unit RateUnit,
+	periods ...[2]float64,
+) ChargingProfile {
+	schedule := SetChargingProfileRequest.ChargingScheduleType{Id: id, ChargingRateUnit: unit}
+	for _, period := range periods {
+		schedule.ChargingSchedulePeriod = append(schedule.ChargingSchedulePeriod,
+			SetChargingProfileRequest.ChargingSchedulePeriodType{StartPeriod: int(period[0]), Limit: period[1]})
+	}
+	if kind != SetChargingProfileRequest.ChargingProfileKindEnumType_1_Relative {
+		schedule.StartSchedule = timePtr(testStart)
+	}
+	return ChargingProfile{
+		Id:                     id,
+		ChargingProfilePurpose: purpose,
+		ChargingProfileKind:    kind,
+		ChargingSchedule:       []SetChargingProfileRequest.ChargingScheduleType{schedule},
+	}
+}
+
+const (
+	txDefault  = SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxDefaultProfile
+	txProfile  = SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_TxProfile
+	maxProfile = SetChargingProfileRequest.ChargingProfilePurposeEnumType_1_ChargingStationMaxProfile
+	absolute   = SetChargingProfileRequest.ChargingProfileKindEnumType_1_Absolute
+	relative   = SetChargingProfileRequest.ChargingProfileKindEnumType_1_Relative
+	recurring  = SetChargingProfileRequest.ChargingProfileKindEnumType_1_Recurring
+)
+
+func TestLimitConversion(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit limit
+		unit  RateUnit
+		want  float64
+	}{
+		{"A to W with the default phases", limit{value: 16, unit: Amperes}, Watts, 16 * NominalVoltage * 3},
+		{"A to W on 1 phase", limit{value: 16, unit: Amperes, phases: intPtr(1)}, Watts, 16 * NominalVoltage},
+		{"W to A with the default phases", limit{value: 11040, unit: Watts}, Amperes, 16},
+		{"W to A on 2 phases", limit{value: 9200, unit: Watts, phases: intPtr(2)}, Amperes, 20},
+		{"0 phases fall back to the default", limit{value: 6900, unit: Watts, phases: intPtr(0)}, Amperes, 10},
+		{"same unit", limit{value: 7.5, unit: Amperes}, Amperes, 7.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.limit.in(test.unit); got != test.want {
+				t.Errorf("in(%s) = %v, want %v", test.unit, got, test.want)
+			}
+		})
+	}
+}
+
+func TestChangesBetween(t *testing.T) {
+	with_duration := testProfile(1, txDefault, absolute, Amperes, [2]float64{0, 16}, [2]float64{600, 10})
+	with_duration.ChargingSchedule[0].Duration = intPtr(1800)
+
+	valid_to := testProfile(2, txDefault, absolute, Amperes, [2]float64{0, 16})
+	valid_to.ValidTo = timePtr(testStart.Add(time.Minute * 20))
+
+	daily := testProfile(3, txDefault, recurring, Amperes, [2]float64{0, 6}, [2]float64{3600, 16})
+	daily.RecurrencyKind = &[]SetChargingProfileRequest.RecurrencyKindEnumType{SetChargingProfileRequest.RecurrencyKindEnumTypeDaily}[0]
+
+	tx_start := testStart.Add(-time.Minute)
+	tests := []struct {
+		name    string
+		profile ChargingProfile
+		from    time.Time
+		to      time.Time
+		want    []time.Time
+	}{
+		{
+			"Absolute periods and duration",
+			with_duration,
+			testStart.Add(-time.Hour),
+			testStart.Add(time.Hour),
+			[]time.Time{testStart, testStart.Add(time.Minute * 10), testStart.Add(time.Minute * 30)},
+		},
+		{
+			"only changes inside the interval",
+			with_duration,
+			testStart,
+			testStart.Add(time.Minute * 20),
+			[]time.Time{testStart.Add(time.Minute * 10)},
+		},
+		{
+			"end of the validity",
+			valid_to,
+			testStart.Add(-time.Hour),
+			testStart.Add(time.Hour),
+			[]time.Time{testStart.Add(time.Minute * 20), testStart},
+		},
+		{
+			"Recurring profile changes on every recurrence",
+			daily,
+			testStart.Add(time.Hour * 2),
+			testStart.Add(time.Hour * 48),
+			[]time.Time{testStart.Add(time.Hour * 24), testStart.Add(time.Hour * 25)},
+		},
+		{
+			"Relative profile starts with the transaction",
+			testProfile(4, txDefault, relative, Amperes, [2]float64{0, 10}, [2]float64{300, 20}),
+			testStart,
+			testStart.Add(time.Hour),
+			[]time.Time{tx_start.Add(time.Minute * 5)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := Profile{EvseId: 1, ChargingProfile: test.profile}
+			got := profile.changesBetween(test.from, test.to, tx_start)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("changesBetween() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+type installedProfile struct {
+	evseId  int
+	profile ChargingProfile
+}
+
+func TestCompositeSchedule(t *testing.T) {
+	with_duration := testProfile(1, txDefault, absolute, Amperes, [2]float64{0, 16}, [2]float64{600, 10})
+	with_duration.ChargingSchedule[0].Duration = intPtr(1800)
+
+	daily := testProfile(2, txDefault, recurring, Amperes, [2]float64{0, 6}, [2]float64{1800, 16})
+	daily.RecurrencyKind = &[]SetChargingProfileRequest.RecurrencyKindEnumType{SetChargingProfileRequest.RecurrencyKindEnumTypeDaily}[0]
+	daily.ChargingSchedule[0].StartSchedule = timePtr(testStart.Add(-time.Hour * 24 * 3))
+	daily.ChargingSchedule[0].Duration = intPtr(7200)
+
+	tx_high := testProfile(3, txProfile, absolute, Amperes, [2]float64{0, 20})
+	tx_high.TransactionId = stringPtr("tx1")
+	tx_low := testProfile(4, txProfile, absolute, Amperes, [2]float64{0, 10})
+	tx_low.TransactionId = stringPtr("tx1")
+
+	default_stack_1 := testProfile(5, txDefault, absolute, Amperes, [2]float64{0, 12})
+	default_stack_1.StackLevel = 1
+	default_stack_1.ValidTo = timePtr(testStart.Add(time.Minute * 15))
+
+	tx := &Transaction{Id: "tx1", StartedAt: testStart.Add(-time.Second * 100)}
+
+	tests := []struct {
+		name     string
+		profiles []installedProfile
+		tx       *Transaction
+		unit     RateUnit
+		want     []Period
+	}{
+		{
+			"no profile, the maximum of the EVSE",
+			nil,
+			nil,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 32}},
+		},
+		{
+			"Absolute with duration",
+			[]installedProfile{{1, with_duration}},
+			nil,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 16}, {StartPeriod: 600, Limit: 10}, {StartPeriod: 1800, Limit: 32}},
+		},
+		{
+			"Relative to the start of the transaction",
+			[]installedProfile{{1, testProfile(6, txDefault, relative, Amperes, [2]float64{0, 10}, [2]float64{300, 20})}},
+			tx,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 10}, {StartPeriod: 200, Limit: 20}},
+		},
+		{
+			"Recurring daily",
+			[]installedProfile{{1, daily}},
+			nil,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 6}, {StartPeriod: 1800, Limit: 16}},
+		},
+		{
+			"higher stack level wins while it is valid",
+			[]installedProfile{{1, testProfile(7, txDefault, absolute, Amperes, [2]float64{0, 16})}, {1, default_stack_1}},
+			nil,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 12}, {StartPeriod: 900, Limit: 16}},
+		},
+		{
+			"TxProfile overrides a lower TxDefaultProfile",
+			[]installedProfile{{1, testProfile(8, txDefault, absolute, Amperes, [2]float64{0, 16})}, {1, tx_high}},
+			tx,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 20}},
+		},
+		{
+			"TxProfile overrides a higher TxDefaultProfile",
+			[]installedProfile{{1, testProfile(8, txDefault, absolute, Amperes, [2]float64{0, 16})}, {1, tx_low}},
+			tx,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 10}},
+		},
+		{
+			"TxProfile of another transaction does not apply",
+			[]installedProfile{{1, testProfile(8, txDefault, absolute, Amperes, [2]float64{0, 16})}, {1, tx_low}},
+			&Transaction{Id: "tx2", StartedAt: testStart},
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 16}},
+		},
+		{
+			"TxDefaultProfile of the EVSE overrides the one of the station",
+			[]installedProfile{
+				{0, testProfile(9, txDefault, absolute, Amperes, [2]float64{0, 8})},
+				{1, testProfile(10, txDefault, absolute, Amperes, [2]float64{0, 16})},
+			},
+			nil,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 16}},
+		},
+		{
+			"ChargingStationMaxProfile caps the TxProfile",
+			[]installedProfile{{0, testProfile(11, maxProfile, absolute, Amperes, [2]float64{0, 8})}, {1, tx_high}},
+			tx,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 8}},
+		},
+		{
+			"W profile in A",
+			[]installedProfile{{1, testProfile(12, txDefault, absolute, Watts, [2]float64{0, 6900})}},
+			nil,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 10}},
+		},
+		{
+			"A profile in W",
+			[]installedProfile{{1, testProfile(13, txDefault, absolute, Amperes, [2]float64{0, 10})}},
+			nil,
+			Watts,
+			[]Period{{StartPeriod: 0, Limit: 6900}},
+		},
+		{
+			"equal consecutive limits collapse",
+			[]installedProfile{{1, testProfile(14, txDefault, absolute, Amperes, [2]float64{0, 16}, [2]float64{600, 16}, [2]float64{1200, 10})}},
+			nil,
+			Amperes,
+			[]Period{{StartPeriod: 0, Limit: 16}, {StartPeriod: 1200, Limit: 10}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pm := CreateProfileManager(persistence.NewMemoryStore())
+			for _, installed := range test.profiles {
+				pm.Install(installed.evseId, installed.profile)
+			}
+			got := pm.CompositeSchedule(1, testStart, time.Hour, test.unit, test.tx, testMaxPower)
+			for i := range got.Periods {
+				got.Periods[i].NumberPhases = nil
+			}
+			if !reflect.DeepEqual(got.Periods, test.want) {
+				t.Errorf("CompositeSchedule() periods = %+v, want %+v", got.Periods, test.want)
+			}
+		})
+	}
+}
+
+func TestCompositeScheduleNumberPhases(t *testing.T) {
+	profile := testProfile(1, txDefault, absolute, Amperes, [2]float64{0, 16}, [2]float64{600, 16}, [2]float64{1200, 16})
+	profile.ChargingSchedule[0].ChargingSchedulePeriod[1].NumberPhases = intPtr(1)
+	profile.ChargingSchedule[0].ChargingSchedulePeriod[2].NumberPhases = intPtr(1)
+
+	pm := CreateProfileManager(persistence.NewMemoryStore())
+	pm.Install(1, profile)
+	got := pm.CompositeSchedule(1, testStart, time.Hour, Amperes, nil, testMaxPower)
+	want := []Period{
+		{StartPeriod: 0, Limit: 16},
+		{StartPeriod: 600, Limit: 16, NumberPhases: intPtr(1)},
+	}
+	if !reflect.DeepEqual(got.Periods, want) {
+		t.Errorf("CompositeSchedule() periods = %+v, want %+v", got.Periods, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	installed := testProfile(1, txDefault, absolute, Amperes, [2]float64{0, 16})
+	installed.ValidTo = timePtr(testStart.Add(time.Hour))
+
+	overlapping := testProfile(2, txDefault, absolute, Amperes, [2]float64{0, 10})
+	overlapping.ValidFrom = timePtr(testStart.Add(time.Minute * 30))
+
+	after := testProfile(3, txDefault, absolute, Amperes, [2]float64{0, 10})
+	after.ValidFrom = timePtr(testStart.Add(time.Hour))
+
+	other_level := testProfile(4, txDefault, absolute, Amperes, [2]float64{0, 10})
+	other_level.StackLevel = 1
+
+	two_schedules := testProfile(5, txDefault, absolute, Amperes, [2]float64{0, 10})
+	two_schedules.ChargingSchedule = append(two_schedules.ChargingSchedule, two_schedules.ChargingSchedule[0])
+
+	replacement := testProfile(1, txDefault, absolute, Amperes, [2]float64{0, 10})
+
+	tests := []struct {
+		name    string
+		evseId  int
+		profile ChargingProfile
+		want    string // ReasonCode, empty if valid
+	}{
+		{"K01.FR.39: same purpose and stack level while valid", 1, overlapping, "DuplicateProfile"},
+		{"validity periods do not overlap", 1, after, ""},
+		{"other stack level", 1, other_level, ""},
+		{"other EVSE", 2, overlapping, ""},
+		{"same id replaces the profile", 1, replacement, ""},
+		{"more than one schedule", 1, two_schedules, "InvalidSchedule"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pm := CreateProfileManager(persistence.NewMemoryStore())
+			pm.Install(1, installed)
+			err := pm.Validate(test.evseId, &test.profile, testLimits, "")
+			got := ""
+			if err != nil {
+				got = err.(*ValidationError).ReasonCode
+			}
+			if got != test.want {
+				t.Errorf("Validate() = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
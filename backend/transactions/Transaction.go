@@ -1,6 +1,7 @@
 package transactions
 
 import (
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,11 +10,38 @@ import (
 	"github.com/gregszalay/ocpp-messages-go/wrappers"
 )
 
+// The EVSEs have a single connector
+const connectorId = 1
+
 type Transaction struct {
-	Id           string
-	Evse         *evsemanager.EVSE
-	TxSeqNo      int
-	IsInProgress bool
+	Id            string
+	Evse          *evsemanager.EVSE
+	TxSeqNo       int
+	IsInProgress  bool
+	StoppedReason *tx_lib.ReasonEnumType_1
+	StartedAt     time.Time
+	// Set if the transaction was started by a RequestStartTransaction of the CSMS
+	RemoteStartId *int
+	// idToken that authorized the transaction, sent in the first TransactionEvent after the authorization
+	IdToken     *tx_lib.IdTokenType
+	IdTokenSent bool
+	// Charging state in the last TransactionEvent, it is sent again only when it changes
+	ChargingState tx_lib.ChargingStateEnumType_1
+	// Held while the fields are changed and while a TransactionEvent is built and queued,
+	// so the seqNos are given out in the order the events are sent
+	mu sync.Mutex
+}
+
+// State of an ongoing transaction that is kept across restarts
+type TransactionState struct {
+	Id            string
+	EvseId        int
+	TxSeqNo       int
+	IsInProgress  bool
+	RemoteStartId *int                           `json:",omitempty"`
+	IdToken       *tx_lib.IdTokenType            `json:",omitempty"`
+	IdTokenSent   bool                           `json:",omitempty"`
+	ChargingState tx_lib.ChargingStateEnumType_1 `json:",omitempty"`
 }
 
 func CreateTransaction(evse *evsemanager.EVSE) (*Transaction, error) {
@@ -22,19 +50,115 @@ func CreateTransaction(evse *evsemanager.EVSE) (*Transaction, error) {
 		Evse:         evse,
 		TxSeqNo:      0,
 		IsInProgress: false,
+		StartedAt:    time.Now(),
 	}
 	return tx_new, nil
 }
 
+func (tx *Transaction) Lock() {
+	tx.mu.Lock()
+}
+
+func (tx *Transaction) Unlock() {
+	tx.mu.Unlock()
+}
+
+func (tx *Transaction) State() TransactionState {
+	state := TransactionState{
+		Id:            tx.Id,
+		TxSeqNo:       tx.TxSeqNo,
+		IsInProgress:  tx.IsInProgress,
+		RemoteStartId: tx.RemoteStartId,
+		IdToken:       tx.IdToken,
+		IdTokenSent:   tx.IdTokenSent,
+		ChargingState: tx.ChargingState,
+	}
+	if tx.Evse != nil {
+		state.EvseId = tx.Evse.Id
+	}
+	return state
+}
+
+// Recreates a transaction that was ongoing before a restart. evse is nil if the EVSE no longer exists.
+func RestoreTransaction(state TransactionState, evse *evsemanager.EVSE) *Transaction {
+	return &Transaction{
+		Id:            state.Id,
+		Evse:          evse,
+		TxSeqNo:       state.TxSeqNo,
+		IsInProgress:  state.IsInProgress,
+		RemoteStartId: state.RemoteStartId,
+		IdToken:       state.IdToken,
+		IdTokenSent:   state.IdTokenSent,
+		ChargingState: state.ChargingState,
+	}
+}
+
+// Charging state derived from the EVSE. Energy is only offered once the transaction is authorized,
+// a connected EV that does not take the offered energy is SuspendedEV.
+func (tx *Transaction) CurrentChargingState() tx_lib.ChargingStateEnumType_1 {
+	switch {
+	case tx.Evse == nil || tx.Evse.IsEVConnected == 0:
+		return tx_lib.ChargingStateEnumType_1_Idle
+	case tx.Evse.IsCharging == 1:
+		return tx_lib.ChargingStateEnumType_1_Charging
+	case tx.Evse.IsChargingEnabled == 1:
+		return tx_lib.ChargingStateEnumType_1_SuspendedEV
+	case tx.IsInProgress:
+		return tx_lib.ChargingStateEnumType_1_SuspendedEVSE
+	default:
+		return tx_lib.ChargingStateEnumType_1_EVConnected
+	}
+}
+
+// True if the charging state differs from the one in the last TransactionEvent
+func (tx *Transaction) ChargingStateChanged() bool {
+	return tx.CurrentChargingState() != tx.ChargingState
+}
+
+// Must be called with the transaction locked.
+// offline is set if the event happened while the CSMS could not be reached, the event is sent once it is back
 func (tx *Transaction) MakeTransactionEventReq(
 	_eventType tx_lib.TransactionEventEnumType_1,
 	_triggerR tx_lib.TriggerReasonEnumType_1,
+	offline bool,
 ) (wrappers.CALL, error) {
-	energy_active_net_type := tx_lib.MeasurandEnumType_1_EnergyActiveNet
-	power_active_import_type := tx_lib.MeasurandEnumType_1_PowerActiveImport
 	tx_req := &tx_lib.TransactionEventRequestJson{
 		EventType: _eventType,
-		MeterValue: []tx_lib.MeterValueType{
+		SeqNo:     tx.TxSeqNo,
+		Timestamp: time.Now().Format(time.RFC3339),
+		TransactionInfo: tx_lib.TransactionType{
+			TransactionId: tx.Id,
+			RemoteStartId: tx.RemoteStartId,
+		},
+		TriggerReason: _triggerR,
+		Offline:       offline,
+	}
+	// The reason is only reported when the transaction ends
+	if _eventType == tx_lib.TransactionEventEnumType_1_Ended {
+		tx_req.TransactionInfo.StoppedReason = tx.StoppedReason
+	}
+	if tx.IdToken != nil && !tx.IdTokenSent {
+		tx_req.IdToken = tx.IdToken
+		tx.IdTokenSent = true
+	}
+	if state := tx.CurrentChargingState(); state != tx.ChargingState {
+		tx_req.TransactionInfo.ChargingState = &state
+		tx.ChargingState = state
+	}
+	// The EVSE is reported in the first event of the transaction
+	if tx.Evse != nil && tx.TxSeqNo == 0 {
+		connector_id := connectorId
+		tx_req.Evse = &tx_lib.EVSEType{Id: tx.Evse.Id, ConnectorId: &connector_id}
+	}
+	if phases, ok := phasesUsed(tx.Evse); ok {
+		tx_req.NumberOfPhasesUsed = &phases
+	}
+
+	// No meter values without the EVSE, e.g. for a transaction recovered after the EVSE was removed
+	if tx.Evse != nil {
+		energy_active_net_type := tx_lib.MeasurandEnumType_1_EnergyActiveNet
+		power_active_import_type := tx_lib.MeasurandEnumType_1_PowerActiveImport
+		tx_req.MeterValue = []tx_lib.MeterValueType{
 			tx_lib.MeterValueType{
 				SampledValue: []tx_lib.SampledValueType{
 					tx_lib.SampledValueType{
@@ -56,13 +180,10 @@ func (tx *Transaction) MakeTransactionEventReq(
 				},
 				Timestamp: time.Now().Format(time.RFC3339),
 			},
-		},
-		SeqNo:     tx.TxSeqNo,
-		Timestamp: time.Now().Format(time.RFC3339),
-		TransactionInfo: tx_lib.TransactionType{
-			TransactionId: tx.Id,
-		},
-		TriggerReason: _triggerR,
+		}
+		if offered, ok := offeredValue(tx.Evse); ok {
+			tx_req.MeterValue[0].SampledValue = append(tx_req.MeterValue[0].SampledValue, offered)
+		}
 	}
 
 	tx.TxSeqNo += 1
@@ -76,4 +197,31 @@ func (tx *Transaction) MakeTransactionEventReq(
 
 	return call_wrapper, nil
 
-}
\ No newline at end of file
+}
+
+// Phases of the last limit sent to the EVSE controller, known only while charging
+func phasesUsed(evse *evsemanager.EVSE) (int, bool) {
+	if evse == nil || evse.IsCharging == 0 || evse.ChargingLimitPhases <= 0 {
+		return 0, false
+	}
+	return evse.ChargingLimitPhases, true
+}
+
+// The limit the EVSE offers to the EV, set by the charging profiles
+func offeredValue(evse *evsemanager.EVSE) (tx_lib.SampledValueType, bool) {
+	if evse.ChargingLimit <= 0 {
+		return tx_lib.SampledValueType{}, false
+	}
+	measurand := tx_lib.MeasurandEnumType_1_CurrentOffered
+	if evse.ChargingLimitUnit == "W" {
+		measurand = tx_lib.MeasurandEnumType_1_PowerOffered
+	}
+	return tx_lib.SampledValueType{
+		Measurand: &measurand,
+		UnitOfMeasure: &tx_lib.UnitOfMeasureType{
+			Multiplier: 0,
+			Unit:       evse.ChargingLimitUnit,
+		},
+		Value: evse.ChargingLimit,
+	}, true
+}
@@ -3,8 +3,9 @@ import React, { ReactElement, useState } from "react";
 import Stack from "@mui/material/Stack";
 import { CircularProgress } from "@mui/material";
 import { EVSEStatusDataForUI } from "./typedefs/EVSEStatusDataForUI";
-import { RFID } from "./typedefs/RFID";
+import { IdToken, IdTokenType } from "./typedefs/IdToken";
 import TextField from "@mui/material/TextField";
+import MenuItem from "@mui/material/MenuItem";
 import Paper from "@mui/material/Paper";
 import Grid from "@mui/material/Grid";
 import Typography from "@mui/material/Typography";
@@ -12,6 +13,17 @@ import Button from "@mui/material/Button";
 import appTheme from "../app/theme/AppTheme";
 import { useNavigate, useParams } from "react-router-dom";
 
+const idTokenTypes: IdTokenType[] = [
+  "ISO14443",
+  "ISO15693",
+  "KeyCode",
+  "Central",
+  "eMAID",
+  "Local",
+  "MacAddress",
+  "NoAuthorization",
+];
+
 export default function EVSE() {
   let navigate = useNavigate();
   let { evseId } = useParams();
@@ -22,6 +34,7 @@ export default function EVSE() {
   const [isRFIDReadInProgressStop, setIsRFIDReadInProgressStop] =
     useState<boolean>(false);
   const [evseInfo, setevseInfo] = useState<EVSEStatusDataForUI>();
+  const [idTokenType, setIdTokenType] = useState<IdTokenType>("ISO14443");
 
   React.useEffect(() => {
     setInterval(() => {
@@ -70,27 +83,55 @@ export default function EVSE() {
     setIsRFIDReadInProgressStop(true);
   };
 
-  const readRFIDAndStart = (rfid: RFID) => {
+  const readRFIDAndStart = (idToken: IdToken) => {
     console.info("You clicked the startcharge Chip.");
     fetch("http://127.0.0.1:8090/start/" + evseId, {
       method: "POST",
       mode: "no-cors",
-      body: JSON.stringify(rfid),
+      body: JSON.stringify(idToken),
       headers: { "Content-type": "application/json; charset=UTF-8" },
     })
     setIsRFIDReadInProgressStart(false);
   };
-  const readRFIDAndStop = (rfid: RFID) => {
+  const readRFIDAndStop = (idToken: IdToken) => {
     console.info("You clicked the stopcharge Chip.");
     fetch("http://127.0.0.1:8090/stop/" + evseId, {
       method: "POST",
       mode: "no-cors",
-      body: JSON.stringify(rfid),
+      body: JSON.stringify(idToken),
       headers: { "Content-type": "application/json; charset=UTF-8" },
     })
     setIsRFIDReadInProgressStop(false);
   };
 
+  const idTokenPrompt = (): string => {
+    if (idTokenType === "ISO14443") {
+      return "Please touch RFID card to the reader";
+    }
+    if (idTokenType === "NoAuthorization") {
+      return "Press Enter to continue without identification";
+    }
+    return "Please enter your " + idTokenType + " token and press Enter";
+  };
+
+  const idTokenTypeSelect = (): ReactElement => (
+    <TextField
+      select
+      label="Token type"
+      value={idTokenType}
+      style={{ margin: 8 }}
+      onChange={(event: React.ChangeEvent<HTMLInputElement>) => {
+        setIdTokenType(event.target.value as IdTokenType);
+      }}
+    >
+      {idTokenTypes.map((type) => (
+        <MenuItem key={type} value={type}>
+          {type}
+        </MenuItem>
+      ))}
+    </TextField>
+  );
+
   if (error) {
     return <div>Error: {error.message}</div>;
   } else if (!isLoaded || !evseInfo) {
@@ -129,12 +170,22 @@ export default function EVSE() {
           }}
           type="password"
           onChange={(event: React.ChangeEvent<HTMLInputElement>) => {
-            if (event.target.value.length >= 10) {
-              readRFIDAndStart({ rfid: event.target.value });
+            // RFID readers type the card number without a closing Enter
+            if (idTokenType === "ISO14443" && event.target.value.length >= 10) {
+              readRFIDAndStart({ idToken: event.target.value, type: idTokenType });
+            }
+          }}
+          onKeyDown={(event: React.KeyboardEvent<HTMLInputElement>) => {
+            if (idTokenType !== "ISO14443" && event.key === "Enter") {
+              readRFIDAndStart({
+                idToken: (event.target as HTMLInputElement).value,
+                type: idTokenType,
+              });
             }
           }}
           autoFocus
         />
+        {idTokenTypeSelect()}
         <Typography
           variant="h1"
           component="div"
@@ -146,7 +197,7 @@ export default function EVSE() {
             paddingTop: 1,
           }}
         >
-          Please touch RFID card to the reader
+          {idTokenPrompt()}
         </Typography>
       </Box>
     );
@@ -175,12 +226,22 @@ export default function EVSE() {
           }}
           type="password"
           onChange={(event: React.ChangeEvent<HTMLInputElement>) => {
-            if (event.target.value.length >= 10) {
-              readRFIDAndStop({ rfid: event.target.value });
+            // RFID readers type the card number without a closing Enter
+            if (idTokenType === "ISO14443" && event.target.value.length >= 10) {
+              readRFIDAndStop({ idToken: event.target.value, type: idTokenType });
+            }
+          }}
+          onKeyDown={(event: React.KeyboardEvent<HTMLInputElement>) => {
+            if (idTokenType !== "ISO14443" && event.key === "Enter") {
+              readRFIDAndStop({
+                idToken: (event.target as HTMLInputElement).value,
+                type: idTokenType,
+              });
             }
           }}
           autoFocus
         />
+        {idTokenTypeSelect()}
         <Typography
           variant="h1"
           component="div"
@@ -192,7 +253,7 @@ export default function EVSE() {
             paddingTop: 1,
           }}
         >
-          Please touch RFID card to the reader
+          {idTokenPrompt()}
         </Typography>
       </Box>
     );
@@ -279,6 +340,26 @@ export default function EVSE() {
                 {evseInfo.energyActiveNet_kwh_float.toFixed(3) + " kWh"}
               </Paper>
             </Grid>
+            {(evseInfo.totalCost !== undefined ||
+              evseInfo.personalMessage) && (
+              <Grid item xs={12}>
+                <Paper
+                  sx={{
+                    background: appTheme.palette.secondary.light,
+                    fontSize: 30,
+                    paddingLeft: 4,
+                    paddingRight: 4,
+                  }}
+                >
+                  {evseInfo.personalMessage}
+                  {evseInfo.totalCost !== undefined &&
+                    " " +
+                      evseInfo.totalCost.toFixed(2) +
+                      " " +
+                      (evseInfo.currency ?? "")}
+                </Paper>
+              </Grid>
+            )}
             <Grid item xs={6}>
               <Button
                 sx={{
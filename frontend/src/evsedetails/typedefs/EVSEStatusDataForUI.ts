@@ -5,4 +5,7 @@ export type EVSEStatusDataForUI = {
   isError: number;
   energyActiveNet_kwh_float: number;
   powerActiveImport_kw_float: number;
+  totalCost?: number;
+  currency?: string;
+  personalMessage?: string;
 };
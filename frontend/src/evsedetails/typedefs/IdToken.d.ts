@@ -0,0 +1,20 @@
+export type IdTokenType =
+  | "Central"
+  | "eMAID"
+  | "ISO14443"
+  | "ISO15693"
+  | "KeyCode"
+  | "Local"
+  | "MacAddress"
+  | "NoAuthorization";
+
+export type AdditionalInfo = {
+  additionalIdToken: string;
+  type: string;
+};
+
+export type IdToken = {
+  idToken: string;
+  type: IdTokenType;
+  additionalInfo?: AdditionalInfo[];
+};
@@ -1,3 +0,0 @@
-export type RFID = {
-  rfid: string;
-};